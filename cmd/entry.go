@@ -10,15 +10,15 @@ import (
 )
 
 type EntryCommand struct {
-	ConfigFile string `short:"c" long:"config" description:"Config file path" default:"config.entry.json"`
+	ConfigFile string `short:"c" long:"config" description:"Config file path, URL, or - for stdin" default:"config.entry.json"`
 	Reverse    bool   `long:"reverse" description:"Reverse mode"`
 }
 
 var entryCommand EntryCommand
 
 func (e *EntryCommand) Execute(args []string) error {
-	config := &tuna.EntryConfiguration{}
-	err := util.ReadJSON(e.ConfigFile, config)
+	config := tuna.DefaultEntryConfig()
+	err := util.ReadConfigSource(e.ConfigFile, config, opts.StrictConfig)
 	if err != nil {
 		log.Fatalln("Load config error:", err)
 	}
@@ -31,6 +31,11 @@ func (e *EntryCommand) Execute(args []string) error {
 		config.Reverse = true
 	}
 
+	err = config.Validate()
+	if err != nil {
+		log.Fatalln("Invalid config:", err)
+	}
+
 	if len(config.ReverseBeneficiaryAddr) > 0 {
 		err = nkn.VerifyWalletAddress(config.ReverseBeneficiaryAddr)
 		if err != nil {
@@ -64,7 +69,7 @@ func (e *EntryCommand) Execute(args []string) error {
 		RPCConcurrency:    4,
 	}
 
-	wallet, err := nkn.NewWallet(&nkn.Account{account}, walletConfig)
+	wallet, err := nkn.NewWallet(&nkn.Account{Account: account}, walletConfig)
 	if err != nil {
 		log.Fatalln("Create wallet error:", err)
 	}
@@ -77,33 +82,29 @@ func (e *EntryCommand) Execute(args []string) error {
 			log.Fatalln(err)
 		}
 	} else {
-		var services []tuna.Service
-		err = util.ReadJSON(opts.ServicesFile, &services)
+		services, err := tuna.ReadServices(opts.ServicesFile, opts.StrictConfig)
 		if err != nil {
 			log.Fatalln("Load service file error:", err)
 		}
 
-	service:
 		for serviceName, serviceInfo := range config.Services {
-			for _, service := range services {
-				if service.Name == serviceName {
-					go func(service tuna.Service, serviceInfo tuna.ServiceInfo) {
-						for {
-							te, err := tuna.NewTunaEntry(service, serviceInfo, wallet, config)
-							if err != nil {
-								log.Fatalln(err)
-							}
-
-							err = te.Start(false)
-							if err != nil {
-								log.Println(err)
-							}
-						}
-					}(service, serviceInfo)
-					continue service
-				}
+			service, ok := tuna.FindService(services, serviceName)
+			if !ok {
+				log.Fatalln("Service", serviceName, "not found in service file")
 			}
-			log.Fatalln("Service", serviceName, "not found in service file")
+			go func(service tuna.Service, serviceInfo tuna.ServiceInfo) {
+				for {
+					te, err := tuna.NewTunaEntry(service, serviceInfo, wallet, config)
+					if err != nil {
+						log.Fatalln(err)
+					}
+
+					err = te.Start(false)
+					if err != nil {
+						log.Println(err)
+					}
+				}
+			}(service, serviceInfo)
 		}
 	}
 
@@ -10,15 +10,16 @@ import (
 )
 
 type ExitCommand struct {
-	ConfigFile string `short:"c" long:"config" description:"Config file path" default:"config.exit.json"`
+	ConfigFile string `short:"c" long:"config" description:"Config file path, URL, or - for stdin" default:"config.exit.json"`
 	Reverse    bool   `long:"reverse" description:"Reverse mode"`
+	DryRun     bool   `long:"dry-run" description:"Print metadata to subscribe and exit without subscribing"`
 }
 
 var exitCommand ExitCommand
 
 func (e *ExitCommand) Execute(args []string) error {
 	config := &tuna.ExitConfiguration{}
-	err := util.ReadJSON(e.ConfigFile, config)
+	err := util.ReadConfigSource(e.ConfigFile, config, opts.StrictConfig)
 	if err != nil {
 		log.Fatalln("Load config file error:", err)
 	}
@@ -61,15 +62,14 @@ func (e *ExitCommand) Execute(args []string) error {
 		RPCConcurrency:    4,
 	}
 
-	wallet, err := nkn.NewWallet(&nkn.Account{account}, walletConfig)
+	wallet, err := nkn.NewWallet(&nkn.Account{Account: account}, walletConfig)
 	if err != nil {
 		log.Fatalln("Create wallet error:", err)
 	}
 
 	log.Println("Your NKN wallet address is:", wallet.Address())
 
-	var services []tuna.Service
-	err = util.ReadJSON(opts.ServicesFile, &services)
+	services, err := tuna.ReadServices(opts.ServicesFile, opts.StrictConfig)
 	if err != nil {
 		log.Fatalln("Load service file error:", err)
 	}
@@ -86,7 +86,7 @@ func (e *ExitCommand) Execute(args []string) error {
 
 						go func() {
 							for range te.OnConnect.C {
-								log.Printf("Service: %s, Address: %v:%v\n", service.Name, te.GetReverseIP(), te.GetReverseTCPPorts())
+								log.Printf("Service: %s, Reverse service: %s, Address: %v:%v\n", service.Name, te.Service.Name, te.GetReverseIP(), te.GetReverseTCPPorts())
 							}
 						}()
 
@@ -104,6 +104,14 @@ func (e *ExitCommand) Execute(args []string) error {
 			log.Fatalln(err)
 		}
 
+		if exitCommand.DryRun {
+			err = te.DryRun()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			return nil
+		}
+
 		err = te.Start()
 		if err != nil {
 			log.Fatalln(err)
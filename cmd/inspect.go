@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+)
+
+type InspectCommand struct {
+	ServiceName string `short:"n" long:"name" description:"Service name to inspect" required:"true"`
+	Prefix      string `long:"prefix" description:"Subscription prefix" default:"tuna_v1."`
+}
+
+var inspectCommand InspectCommand
+
+func (i *InspectCommand) Execute(args []string) error {
+	// only used to query subscribers, so a random account is enough
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		log.Fatalln("Create account error:", err)
+	}
+
+	var seedRPCServerAddr *nkn.StringArray
+	if len(opts.SeedRPCServerAddr) > 0 {
+		seedRPCServerAddr = nkn.NewStringArrayFromString(strings.ReplaceAll(opts.SeedRPCServerAddr, ",", " "))
+	}
+
+	wallet, err := nkn.NewWallet(account, &nkn.WalletConfig{SeedRPCServerAddr: seedRPCServerAddr})
+	if err != nil {
+		log.Fatalln("Create wallet error:", err)
+	}
+
+	infos, err := tuna.InspectService(wallet, i.Prefix, i.ServiceName)
+	if err != nil {
+		log.Fatalln("Inspect service error:", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tTCP\tUDP\tPRICE\tBENEFICIARY\tREACHABLE\tRTT\tERROR")
+	for _, info := range infos {
+		if info.Err != nil {
+			fmt.Fprintf(w, "%s\t\t\t\t\t\t\t%v\n", info.Address, info.Err)
+			continue
+		}
+		rtt := ""
+		if info.Reachable {
+			rtt = info.DialRTT.String()
+		}
+		fmt.Fprintf(w, "%s\t%s:%d\t%d\t%s\t%s\t%v\t%s\t\n", info.Address, info.Metadata.Ip, info.Metadata.TcpPort, info.Metadata.UdpPort, info.Price, info.Metadata.BeneficiaryAddr, info.Reachable, rtt)
+	}
+	w.Flush()
+	fmt.Printf("%d subscribers of %s%s\n", len(infos), i.Prefix, i.ServiceName)
+
+	return nil
+}
+
+func init() {
+	parser.AddCommand("inspect", "Inspect service", "Print metadata advertised by subscribers of a service", &inspectCommand)
+}
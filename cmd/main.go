@@ -9,10 +9,11 @@ import (
 
 var opts struct {
 	BeneficiaryAddr   string `short:"b" long:"beneficiary-addr" description:"Beneficiary address (NKN wallet address to receive rewards)"`
-	ServicesFile      string `short:"s" long:"services" description:"Services file path" default:"services.json"`
+	ServicesFile      string `short:"s" long:"services" description:"Comma separated services file paths, directories, URLs, or - for stdin" default:"services.json"`
 	WalletFile        string `short:"w" long:"wallet" description:"Wallet file path" default:"wallet.json"`
 	PasswordFile      string `short:"p" long:"password-file" description:"Wallet password file path" default:"wallet.pswd"`
 	SeedRPCServerAddr string `long:"rpc" description:"Seed RPC server address, separated by comma"`
+	StrictConfig      bool   `long:"strict-config" description:"Reject unknown keys in config and services files instead of warning"`
 	Version           bool   `short:"v" long:"version" description:"Print version"`
 }
 
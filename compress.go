@@ -0,0 +1,93 @@
+package tuna
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+	"time"
+)
+
+// countingStream counts bytes read from and written to the underlying stream
+// using CountingReader and CountingWriter.
+type countingStream struct {
+	io.ReadWriteCloser
+	reader *CountingReader
+	writer *CountingWriter
+}
+
+// newCountingStream returns a countingStream that adds bytes read from and
+// written to stream to bytesRead and bytesWritten, which can be nil.
+func newCountingStream(stream io.ReadWriteCloser, bytesRead, bytesWritten *uint64) *countingStream {
+	return &countingStream{
+		ReadWriteCloser: stream,
+		reader:          NewCountingReader(stream, bytesRead),
+		writer:          NewCountingWriter(stream, bytesWritten),
+	}
+}
+
+func (s *countingStream) Read(b []byte) (int, error) {
+	return s.reader.Read(b)
+}
+
+func (s *countingStream) Write(b []byte) (int, error) {
+	return s.writer.Write(b)
+}
+
+// SetWriteDeadline sets write deadline of the underlying stream, or does
+// nothing if it's not supported.
+func (s *countingStream) SetWriteDeadline(t time.Time) error {
+	if d, ok := s.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// compressedStream compresses data written to and decompresses data read from
+// the underlying stream using flate. Each write is flushed immediately so that
+// interactive protocols are not delayed.
+type compressedStream struct {
+	stream io.ReadWriteCloser
+	reader io.ReadCloser
+	writer *flate.Writer
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newCompressedStream(stream io.ReadWriteCloser) (*compressedStream, error) {
+	writer, err := flate.NewWriter(stream, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedStream{
+		stream: stream,
+		reader: flate.NewReader(stream),
+		writer: writer,
+	}, nil
+}
+
+func (s *compressedStream) Read(b []byte) (int, error) {
+	return s.reader.Read(b)
+}
+
+func (s *compressedStream) Write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	n, err := s.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, s.writer.Flush()
+}
+
+func (s *compressedStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.writeLock.Lock()
+		s.writer.Close()
+		s.writeLock.Unlock()
+		s.reader.Close()
+		s.closeErr = s.stream.Close()
+	})
+	return s.closeErr
+}
@@ -1,20 +1,32 @@
 package tuna
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/imdario/mergo"
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
 	"github.com/nknorg/tuna/geo"
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/types"
+	"github.com/xtaci/smux"
 )
 
 const (
 	DefaultSubscriptionPrefix = "tuna_v1."
 	DefaultReverseServiceName = "reverse"
 
+	// ConfigVersion is the version of config format supported by this package.
+	// Config without configVersion has version 0, which is the same format as
+	// version 1.
+	ConfigVersion = 1
+
 	defaultNanoPayDuration                   = 4320 * 30
-	defaultNanoPayUpdateInterval             = time.Minute
+	defaultNanoPayUpdateInterval             = 60 // second
 	defaultNanoPayMinFlushAmount             = "0.01"
 	defaultServiceListenIP                   = "127.0.0.1"
 	defaultReverseServiceListenIP            = "0.0.0.0"
@@ -27,19 +39,89 @@ const (
 	defaultMeasureBandwidthWorkersTimeout    = 8  // second
 	defaultMeasurementBytesDownLink          = 256 << 10
 	defaultMaxMeasureWorkerPoolSize          = 64
+	defaultReconnectBackoffMin               = 1000  // millisecond
+	defaultReconnectBackoffMax               = 60000 // millisecond
+	defaultStartupRetryInterval              = 1000  // millisecond
+	defaultTrafficLogInterval                = 60    // second
+	defaultReverseAcceptBackoffMin           = 5     // millisecond
+	defaultReverseAcceptBackoffMax           = 1000  // millisecond
+	defaultUpstreamPoolIdleTimeout           = 30    // second
+	defaultHealthCheckTimeout                = 10    // second
+	defaultFailedExitBlockDuration           = 60    // second
+	defaultSubscriberCacheTTL                = 10    // second
+	defaultParallelDial                      = 1
+	defaultDialTimeout                       = Duration(10 * time.Second)
 )
 
+// Duration is a time.Duration that can be unmarshaled from a JSON string like
+// "3s" or "500ms", or from a JSON number in unit of second for backward
+// compatibility.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// SmuxConfiguration tunes smux sessions, e.g. larger receive buffer keeps the
+// pipe full on high latency links. Zero fields use smux defaults.
+type SmuxConfiguration struct {
+	MaxFrameSize      int32 `json:"maxFrameSize"`
+	MaxReceiveBuffer  int32 `json:"maxReceiveBuffer"`
+	KeepAliveInterval int32 `json:"keepAliveInterval"` // millisecond
+	KeepAliveTimeout  int32 `json:"keepAliveTimeout"`  // millisecond
+}
+
 type EntryConfiguration struct {
+	ConfigVersion                  int32                  `json:"configVersion"`
 	Services                       map[string]ServiceInfo `json:"services"`
-	DialTimeout                    int32                  `json:"dialTimeout"`
+	ListenIP                       string                 `json:"listenIP"`
+	DialTimeout                    Duration               `json:"dialTimeout"`
+	WriteTimeout                   Duration               `json:"writeTimeout"`
+	DialRetries                    int32                  `json:"dialRetries"`
+	ParallelDial                   int32                  `json:"parallelDial"`
+	LogDialRTT                     bool                   `json:"logDialRTT"`
+	FailedExitBlockDuration        int32                  `json:"failedExitBlockDuration"`
+	SubscriberCacheTTL             int32                  `json:"subscriberCacheTTL"`
+	DNSResolver                    string                 `json:"dnsResolver"`
+	Encryption                     string                 `json:"encryption"`
+	ConnectTimeout                 int32                  `json:"connectTimeout"`
 	UDPTimeout                     int32                  `json:"udpTimeout"`
+	UDPChannelBufferSize           int32                  `json:"udpChannelBufferSize"`
 	NanoPayFee                     string                 `json:"nanoPayFee"`
+	MaxTotalSpend                  string                 `json:"maxTotalSpend"`
+	PaymentScheme                  string                 `json:"paymentScheme"`
+	NanoPayUpdateInterval          int32                  `json:"nanoPayUpdateInterval"`
 	SubscriptionPrefix             string                 `json:"subscriptionPrefix"`
 	Reverse                        bool                   `json:"reverse"`
 	ReverseBeneficiaryAddr         string                 `json:"reverseBeneficiaryAddr"`
 	ReverseTCP                     int32                  `json:"reverseTCP"`
 	ReverseUDP                     int32                  `json:"reverseUDP"`
+	ReverseTCPBindAddr             string                 `json:"reverseTCPBindAddr"`
+	ReverseUDPBindAddr             string                 `json:"reverseUDPBindAddr"`
+	ReverseNetwork                 string                 `json:"reverseNetwork"`
 	ReverseServiceListenIP         string                 `json:"reverseServiceListenIP"`
+	ReverseIP                      string                 `json:"reverseIP"`
+	ReverseIPRefreshInterval       int32                  `json:"reverseIPRefreshInterval"`
 	ReversePrice                   string                 `json:"reversePrice"`
 	ReverseClaimInterval           int32                  `json:"reverseClaimInterval"`
 	ReverseMinFlushAmount          string                 `json:"reverseMinFlushAmount"`
@@ -47,6 +129,9 @@ type EntryConfiguration struct {
 	ReverseSubscriptionPrefix      string                 `json:"reverseSubscriptionPrefix"`
 	ReverseSubscriptionDuration    int32                  `json:"reverseSubscriptionDuration"`
 	ReverseSubscriptionFee         string                 `json:"reverseSubscriptionFee"`
+	ReverseMaxSubscribesPerDay     int32                  `json:"reverseMaxSubscribesPerDay"`
+	ReverseAcceptBackoffMin        int32                  `json:"reverseAcceptBackoffMin"`
+	ReverseAcceptBackoffMax        int32                  `json:"reverseAcceptBackoffMax"`
 	GeoDBPath                      string                 `json:"geoDBPath"`
 	DownloadGeoDB                  bool                   `json:"downloadGeoDB"`
 	GetSubscribersBatchSize        int32                  `json:"getSubscribersBatchSize"`
@@ -56,11 +141,34 @@ type EntryConfiguration struct {
 	MeasurementBytesDownLink       int32                  `json:"measurementBytesDownLink"`
 	MeasureStoragePath             string                 `json:"measureStoragePath"`
 	MaxMeasureWorkerPoolSize       int32                  `json:"maxMeasureWorkerPoolSize"`
+	ReconnectBackoffMin            int32                  `json:"reconnectBackoffMin"`
+	ReconnectBackoffMax            int32                  `json:"reconnectBackoffMax"`
+	ServerSelectionStrategy        string                 `json:"serverSelectionStrategy"`
+	AllowSelfConnect               bool                   `json:"allowSelfConnect"`
+	MinSubscribers                 int32                  `json:"minSubscribers"`
+	StartupRetry                   bool                   `json:"startupRetry"`
+	StartupRetryInterval           int32                  `json:"startupRetryInterval"`
+	Compression                    bool                   `json:"compression"`
+	SmuxConfig                     *SmuxConfiguration     `json:"smuxConfig"`
+	MaxConcurrentStreams           int32                  `json:"maxConcurrentStreams"`
+	RequiredTags                   map[string]string      `json:"requiredTags"`
+	ExcludedTags                   map[string]string      `json:"excludedTags"`
+	AllowedBeneficiaries           []string               `json:"allowedBeneficiaries"`
+	PreferredServer                string                 `json:"preferredServer"`
+	ServerCacheFile                string                 `json:"serverCacheFile"`
+	UDPLocalIP                     string                 `json:"udpLocalIP"`
+	UDPLocalPortRange              string                 `json:"udpLocalPortRange"`
+	UDPOverTCP                     bool                   `json:"udpOverTCP"`
+	Transport                      string                 `json:"transport"`
+	MaxMetadataSize                int32                  `json:"maxMetadataSize"`
+	HealthCheckInterval            int32                  `json:"healthCheckInterval"`
+	HealthCheckTimeout             int32                  `json:"healthCheckTimeout"`
 	SortMeasuredNodes              func(types.Nodes)      `json:"-"`
 }
 
 var defaultEntryConfiguration = EntryConfiguration{
 	SubscriptionPrefix:             DefaultSubscriptionPrefix,
+	DialTimeout:                    defaultDialTimeout,
 	GetSubscribersBatchSize:        defaultGetSubscribersBatchSize,
 	MeasureBandwidthTimeout:        defaultMeasureBandwidthTimeout,
 	MeasureBandwidthWorkersTimeout: defaultMeasureBandwidthWorkersTimeout,
@@ -70,6 +178,18 @@ var defaultEntryConfiguration = EntryConfiguration{
 	ReverseServiceName:             DefaultReverseServiceName,
 	ReverseMinFlushAmount:          defaultNanoPayMinFlushAmount,
 	ReverseServiceListenIP:         defaultReverseServiceListenIP,
+	ReconnectBackoffMin:            defaultReconnectBackoffMin,
+	ReconnectBackoffMax:            defaultReconnectBackoffMax,
+	StartupRetryInterval:           defaultStartupRetryInterval,
+	ReverseAcceptBackoffMin:        defaultReverseAcceptBackoffMin,
+	ReverseAcceptBackoffMax:        defaultReverseAcceptBackoffMax,
+	HealthCheckTimeout:             defaultHealthCheckTimeout,
+	FailedExitBlockDuration:        defaultFailedExitBlockDuration,
+	SubscriberCacheTTL:             defaultSubscriberCacheTTL,
+	ParallelDial:                   defaultParallelDial,
+	ServerSelectionStrategy:        SelectionStrategyPerformance,
+	PaymentScheme:                  PaymentSchemeNanoPay,
+	NanoPayUpdateInterval:          defaultNanoPayUpdateInterval,
 }
 
 func DefaultEntryConfig() *EntryConfiguration {
@@ -78,16 +198,31 @@ func DefaultEntryConfig() *EntryConfiguration {
 }
 
 type ExitConfiguration struct {
+	ConfigVersion                  int32                      `json:"configVersion"`
 	BeneficiaryAddr                string                     `json:"beneficiaryAddr"`
 	ListenTCP                      int32                      `json:"listenTCP"`
 	ListenUDP                      int32                      `json:"listenUDP"`
-	DialTimeout                    int32                      `json:"dialTimeout"`
+	ListenQUIC                     int32                      `json:"listenQUIC"`
+	DialTimeout                    Duration                   `json:"dialTimeout"`
+	WriteTimeout                   Duration                   `json:"writeTimeout"`
 	UDPTimeout                     int32                      `json:"udpTimeout"`
 	SubscriptionPrefix             string                     `json:"subscriptionPrefix"`
 	SubscriptionDuration           int32                      `json:"subscriptionDuration"`
 	SubscriptionFee                string                     `json:"subscriptionFee"`
+	MaxSubscribesPerDay            int32                      `json:"maxSubscribesPerDay"`
 	ClaimInterval                  int32                      `json:"claimInterval"`
 	MinFlushAmount                 string                     `json:"minFlushAmount"`
+	PaymentScheme                  string                     `json:"paymentScheme"`
+	NanoPayUpdateInterval          int32                      `json:"nanoPayUpdateInterval"`
+	Compression                    bool                       `json:"compression"`
+	SmuxConfig                     *SmuxConfiguration         `json:"smuxConfig"`
+	MaxConcurrentStreams           int32                      `json:"maxConcurrentStreams"`
+	MaxStreamsPerPayer             int32                      `json:"maxStreamsPerPayer"`
+	MaxBandwidthPerPayer           int64                      `json:"maxBandwidthPerPayer"`
+	TrafficLogPath                 string                     `json:"trafficLogPath"`
+	TrafficLogInterval             int32                      `json:"trafficLogInterval"`
+	UpstreamPoolSize               int32                      `json:"upstreamPoolSize"`
+	UpstreamPoolIdleTimeout        int32                      `json:"upstreamPoolIdleTimeout"`
 	Services                       map[string]ExitServiceInfo `json:"services"`
 	Reverse                        bool                       `json:"reverse"`
 	ReverseRandomPorts             bool                       `json:"reverseRandomPorts"`
@@ -96,6 +231,9 @@ type ExitConfiguration struct {
 	ReverseServiceName             string                     `json:"reverseServiceName"`
 	ReverseSubscriptionPrefix      string                     `json:"reverseSubscriptionPrefix"`
 	ReverseEncryption              string                     `json:"reverseEncryption"`
+	RequireEncryption              bool                       `json:"requireEncryption"`
+	AllowedEntries                 []string                   `json:"allowedEntries"`
+	DeniedEntries                  []string                   `json:"deniedEntries"`
 	GeoDBPath                      string                     `json:"geoDBPath"`
 	DownloadGeoDB                  bool                       `json:"downloadGeoDB"`
 	GetSubscribersBatchSize        int32                      `json:"getSubscribersBatchSize"`
@@ -106,6 +244,10 @@ type ExitConfiguration struct {
 	MeasurementBytesDownLink       int32                      `json:"measurementBytesDownLink"`
 	MeasureStoragePath             string                     `json:"measureStoragePath"`
 	MaxMeasureWorkerPoolSize       int32                      `json:"maxMeasureWorkerPoolSize"`
+	ReconnectBackoffMin            int32                      `json:"reconnectBackoffMin"`
+	ReconnectBackoffMax            int32                      `json:"reconnectBackoffMax"`
+	ReverseServerSelectionStrategy string                     `json:"reverseServerSelectionStrategy"`
+	ReverseAllowSelfConnect        bool                       `json:"reverseAllowSelfConnect"`
 	SortMeasuredNodes              func(types.Nodes)          `json:"-"`
 }
 
@@ -119,6 +261,13 @@ var defaultExitConfiguration = ExitConfiguration{
 	MinFlushAmount:                 defaultNanoPayMinFlushAmount,
 	ReverseSubscriptionPrefix:      DefaultSubscriptionPrefix,
 	ReverseServiceName:             DefaultReverseServiceName,
+	ReconnectBackoffMin:            defaultReconnectBackoffMin,
+	ReconnectBackoffMax:            defaultReconnectBackoffMax,
+	TrafficLogInterval:             defaultTrafficLogInterval,
+	UpstreamPoolIdleTimeout:        defaultUpstreamPoolIdleTimeout,
+	ReverseServerSelectionStrategy: SelectionStrategyPerformance,
+	PaymentScheme:                  PaymentSchemeNanoPay,
+	NanoPayUpdateInterval:          defaultNanoPayUpdateInterval,
 }
 
 func DefaultExitConfig() *ExitConfiguration {
@@ -126,9 +275,240 @@ func DefaultExitConfig() *ExitConfiguration {
 	return &conf
 }
 
+// smuxConfig returns smux config with zero fields set to smux defaults, or nil
+// if conf is nil.
+func (conf *SmuxConfiguration) smuxConfig() *smux.Config {
+	if conf == nil {
+		return nil
+	}
+	c := smux.DefaultConfig()
+	if conf.MaxFrameSize > 0 {
+		c.MaxFrameSize = int(conf.MaxFrameSize)
+	}
+	if conf.MaxReceiveBuffer > 0 {
+		c.MaxReceiveBuffer = int(conf.MaxReceiveBuffer)
+	}
+	if conf.KeepAliveInterval > 0 {
+		c.KeepAliveInterval = time.Duration(conf.KeepAliveInterval) * time.Millisecond
+	}
+	if conf.KeepAliveTimeout > 0 {
+		c.KeepAliveTimeout = time.Duration(conf.KeepAliveTimeout) * time.Millisecond
+	}
+	return c
+}
+
+// reverseNetworks returns TCP and UDP network of reverse listeners. Network
+// tcp (default) listens on both IPv4 and IPv6 if supported by OS, while tcp4
+// and tcp6 listen on only one of them.
+func reverseNetworks(network string) (string, string, error) {
+	switch network {
+	case "", "tcp":
+		return "tcp", "udp", nil
+	case "tcp4":
+		return "tcp4", "udp4", nil
+	case "tcp6":
+		return "tcp6", "udp6", nil
+	default:
+		return "", "", fmt.Errorf("unknown reverse network %s", network)
+	}
+}
+
+func verifySelectionStrategy(strategy string) error {
+	switch strategy {
+	case SelectionStrategyPerformance, SelectionStrategyPrice:
+		return nil
+	default:
+		return fmt.Errorf("unknown server selection strategy %s", strategy)
+	}
+}
+
+// Validate checks if config is consistent so that errors are reported when
+// loading config instead of failing later. Config is checked as is without
+// merging default values, so an explicitly set zero value is rejected where it
+// is invalid. Config should be created by DefaultEntryConfig and then modified
+// or loaded from json, so that fields not set keep their default values.
+func (conf *EntryConfiguration) Validate() error {
+	return conf.validate(true)
+}
+
+// validate is like Validate, but services are only required in forward mode if
+// requireServices is true, since a Common can be created for a service that is
+// not in config.
+func (conf *EntryConfiguration) validate(requireServices bool) error {
+	c := conf
+	if err := checkConfigVersion(c.ConfigVersion); err != nil {
+		return err
+	}
+
+	if c.DialTimeout <= 0 {
+		return fmt.Errorf("dialTimeout should be positive, got %v", time.Duration(c.DialTimeout))
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("writeTimeout should not be negative, got %v", time.Duration(c.WriteTimeout))
+	}
+	if len(c.ListenIP) > 0 && net.ParseIP(c.ListenIP) == nil {
+		return fmt.Errorf("invalid listenIP %s", c.ListenIP)
+	}
+	for name, serviceInfo := range c.Services {
+		if len(serviceInfo.ListenIP) > 0 && net.ParseIP(serviceInfo.ListenIP) == nil {
+			return fmt.Errorf("invalid listenIP %s of service %s", serviceInfo.ListenIP, name)
+		}
+	}
+	if len(c.UDPLocalIP) > 0 && net.ParseIP(c.UDPLocalIP) == nil {
+		return fmt.Errorf("invalid udpLocalIP %s", c.UDPLocalIP)
+	}
+	if _, _, err := ParsePortRange(c.UDPLocalPortRange); err != nil {
+		return fmt.Errorf("invalid udpLocalPortRange: %v", err)
+	}
+	if c.HealthCheckInterval < 0 {
+		return fmt.Errorf("healthCheckInterval should not be negative, got %d", c.HealthCheckInterval)
+	}
+	if c.HealthCheckInterval > 0 && c.HealthCheckTimeout <= 0 {
+		return fmt.Errorf("healthCheckTimeout should be positive, got %d", c.HealthCheckTimeout)
+	}
+	if c.MaxMetadataSize < 0 {
+		return fmt.Errorf("maxMetadataSize should not be negative, got %d", c.MaxMetadataSize)
+	}
+	if len(c.Encryption) > 0 {
+		if _, err := ParseEncryptionAlgo(c.Encryption); err != nil {
+			return err
+		}
+	}
+	if c.FailedExitBlockDuration < 0 {
+		return fmt.Errorf("failedExitBlockDuration should not be negative, got %d", c.FailedExitBlockDuration)
+	}
+	if len(c.DNSResolver) > 0 {
+		if _, _, err := net.SplitHostPort(c.DNSResolver); err != nil {
+			return fmt.Errorf("invalid dnsResolver %s: %v", c.DNSResolver, err)
+		}
+	}
+	if c.SubscriberCacheTTL < 0 {
+		return fmt.Errorf("subscriberCacheTTL should not be negative, got %d", c.SubscriberCacheTTL)
+	}
+	if c.DialRetries < 0 {
+		return fmt.Errorf("dialRetries should not be negative, got %d", c.DialRetries)
+	}
+	if c.ParallelDial < 1 {
+		return fmt.Errorf("parallelDial should be at least 1, got %d", c.ParallelDial)
+	}
+	if c.ConnectTimeout < 0 {
+		return fmt.Errorf("connectTimeout should not be negative, got %d", c.ConnectTimeout)
+	}
+	if c.Transport != "" && c.Transport != TransportTCP && c.Transport != TransportQUIC {
+		return fmt.Errorf("unknown transport %s", c.Transport)
+	}
+	if c.Transport == TransportQUIC && c.Reverse {
+		return errors.New("quic transport is not supported in reverse mode")
+	}
+	if c.UDPTimeout < 0 {
+		return fmt.Errorf("udpTimeout should not be negative, got %d", c.UDPTimeout)
+	}
+	if c.UDPChannelBufferSize < 0 {
+		return fmt.Errorf("udpChannelBufferSize should not be negative, got %d", c.UDPChannelBufferSize)
+	}
+	if len(c.SubscriptionPrefix) == 0 {
+		return errors.New("subscriptionPrefix should not be empty")
+	}
+	if c.ReverseIPRefreshInterval < 0 {
+		return fmt.Errorf("reverseIPRefreshInterval should not be negative, got %d", c.ReverseIPRefreshInterval)
+	}
+	if c.ReverseMaxSubscribesPerDay < 0 {
+		return fmt.Errorf("reverseMaxSubscribesPerDay should not be negative, got %d", c.ReverseMaxSubscribesPerDay)
+	}
+	if c.MaxConcurrentStreams < 0 {
+		return fmt.Errorf("maxConcurrentStreams should not be negative, got %d", c.MaxConcurrentStreams)
+	}
+	if c.MinSubscribers < 0 {
+		return fmt.Errorf("minSubscribers should not be negative, got %d", c.MinSubscribers)
+	}
+	if c.ReconnectBackoffMin <= 0 || c.ReconnectBackoffMax < c.ReconnectBackoffMin {
+		return fmt.Errorf("invalid reconnect backoff range [%d, %d]", c.ReconnectBackoffMin, c.ReconnectBackoffMax)
+	}
+	if len(c.MaxTotalSpend) > 0 {
+		if _, err := common.StringToFixed64(c.MaxTotalSpend); err != nil {
+			return fmt.Errorf("invalid maxTotalSpend %s: %v", c.MaxTotalSpend, err)
+		}
+	}
+	if c.StartupRetry && c.StartupRetryInterval <= 0 {
+		return fmt.Errorf("startupRetryInterval should be positive, got %d", c.StartupRetryInterval)
+	}
+	if err := verifySelectionStrategy(c.ServerSelectionStrategy); err != nil {
+		return err
+	}
+	if _, err := ParseBeneficiaries(c.AllowedBeneficiaries); err != nil {
+		return err
+	}
+	if len(c.PreferredServer) > 0 {
+		if _, err := nkn.ClientAddrToPubKey(c.PreferredServer); err != nil {
+			return fmt.Errorf("invalid preferredServer %s: %v", c.PreferredServer, err)
+		}
+	}
+	if c.SmuxConfig != nil {
+		if err := smux.VerifyConfig(c.SmuxConfig.smuxConfig()); err != nil {
+			return fmt.Errorf("invalid smuxConfig: %v", err)
+		}
+	}
+
+	if c.Reverse {
+		if c.ReverseTCP <= 0 || c.ReverseTCP > 65535 {
+			return fmt.Errorf("reverseTCP should be a valid port in reverse mode, got %d", c.ReverseTCP)
+		}
+		if c.ReverseUDP <= 0 || c.ReverseUDP > 65535 {
+			return fmt.Errorf("reverseUDP should be a valid port in reverse mode, got %d", c.ReverseUDP)
+		}
+		if _, _, err := reverseNetworks(c.ReverseNetwork); err != nil {
+			return err
+		}
+		if c.ReverseAcceptBackoffMin <= 0 || c.ReverseAcceptBackoffMax < c.ReverseAcceptBackoffMin {
+			return fmt.Errorf("invalid reverse accept backoff range [%d, %d]", c.ReverseAcceptBackoffMin, c.ReverseAcceptBackoffMax)
+		}
+		if len(c.ReverseSubscriptionPrefix) == 0 {
+			return errors.New("reverseSubscriptionPrefix should not be empty in reverse mode")
+		}
+		if len(c.ReverseServiceName) == 0 {
+			return errors.New("reverseServiceName should not be empty in reverse mode")
+		}
+		if _, err := ParsePrice(c.ReversePrice); err != nil {
+			return fmt.Errorf("invalid reversePrice %q: %v", c.ReversePrice, err)
+		}
+		for name, addr := range map[string]string{
+			"reverseTCPBindAddr": c.ReverseTCPBindAddr,
+			"reverseUDPBindAddr": c.ReverseUDPBindAddr,
+			"reverseIP":          c.ReverseIP,
+		} {
+			if len(addr) > 0 && net.ParseIP(addr) == nil {
+				return fmt.Errorf("invalid %s %s", name, addr)
+			}
+		}
+	} else {
+		if requireServices && len(c.Services) == 0 {
+			return errors.New("services should not be empty")
+		}
+		for serviceName, serviceInfo := range c.Services {
+			if _, err := ParsePrice(serviceInfo.MaxPrice); err != nil {
+				return fmt.Errorf("invalid maxPrice %q of service %s: %v", serviceInfo.MaxPrice, serviceName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkConfigVersion returns error if config of version is newer than this
+// package supports, since its fields may have different meanings.
+func checkConfigVersion(version int32) error {
+	if version < 0 || version > ConfigVersion {
+		return fmt.Errorf("unsupported configVersion %d, max supported version is %d", version, ConfigVersion)
+	}
+	return nil
+}
+
 func MergedEntryConfig(conf *EntryConfiguration) (*EntryConfiguration, error) {
 	merged := DefaultEntryConfig()
 	if conf != nil {
+		if err := checkConfigVersion(conf.ConfigVersion); err != nil {
+			return nil, err
+		}
 		err := mergo.Merge(merged, conf, mergo.WithOverride)
 		if err != nil {
 			return nil, err
@@ -140,6 +520,9 @@ func MergedEntryConfig(conf *EntryConfiguration) (*EntryConfiguration, error) {
 func MergedExitConfig(conf *ExitConfiguration) (*ExitConfiguration, error) {
 	merged := DefaultExitConfig()
 	if conf != nil {
+		if err := checkConfigVersion(conf.ConfigVersion); err != nil {
+			return nil, err
+		}
 		err := mergo.Merge(merged, conf, mergo.WithOverride)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,64 @@
+package tuna
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CountingReader counts bytes read from the underlying reader. The counter is
+// updated atomically, so it can be read by other goroutines while reading.
+type CountingReader struct {
+	reader io.Reader
+	count  *uint64
+}
+
+// NewCountingReader returns a CountingReader that adds bytes read from r to
+// count. A new counter is used if count is nil.
+func NewCountingReader(r io.Reader, count *uint64) *CountingReader {
+	if count == nil {
+		count = new(uint64)
+	}
+	return &CountingReader{reader: r, count: count}
+}
+
+func (r *CountingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		atomic.AddUint64(r.count, uint64(n))
+	}
+	return n, err
+}
+
+// Count returns the number of bytes read so far.
+func (r *CountingReader) Count() uint64 {
+	return atomic.LoadUint64(r.count)
+}
+
+// CountingWriter counts bytes written to the underlying writer. The counter
+// is updated atomically, so it can be read by other goroutines while writing.
+type CountingWriter struct {
+	writer io.Writer
+	count  *uint64
+}
+
+// NewCountingWriter returns a CountingWriter that adds bytes written to w to
+// count. A new counter is used if count is nil.
+func NewCountingWriter(w io.Writer, count *uint64) *CountingWriter {
+	if count == nil {
+		count = new(uint64)
+	}
+	return &CountingWriter{writer: w, count: count}
+}
+
+func (w *CountingWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	if n > 0 {
+		atomic.AddUint64(w.count, uint64(n))
+	}
+	return n, err
+}
+
+// Count returns the number of bytes written so far.
+func (w *CountingWriter) Count() uint64 {
+	return atomic.LoadUint64(w.count)
+}
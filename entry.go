@@ -1,10 +1,14 @@
 package tuna
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,10 +17,11 @@ import (
 
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/filter"
+	"github.com/nknorg/tuna/geo"
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/util"
 	"github.com/patrickmn/go-cache"
-	"github.com/rdegges/go-ipify"
 	"github.com/xtaci/smux"
 )
 
@@ -32,26 +37,73 @@ type TunaEntry struct {
 
 	*Common
 	config             *EntryConfiguration
-	tcpListeners       map[byte]*net.TCPListener
+	tcpListeners       map[byte]net.Listener
+	socks5Listener     net.Listener
+	httpProxyListener  net.Listener
 	serviceConn        map[byte]*net.UDPConn
 	clientAddr         *cache.Cache
 	session            *smux.Session
 	paymentStream      *smux.Stream
 	reverseBeneficiary common.Uint160
 	sessionLock        sync.Mutex
+	streamLimiter      *streamLimiter
 }
 
-func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet, config *EntryConfiguration) (*TunaEntry, error) {
+// NewEntryCommon creates a Common to connect to exits of service the same way
+// as a tuna entry. Config is validated and then merged with default values,
+// so a non-nil config should be created by DefaultEntryConfig. If serviceInfo
+// is nil, the service info of service in config is used. Service and
+// serviceInfo are copied so they are not modified.
+func NewEntryCommon(service *Service, serviceInfo *ServiceInfo, wallet *nkn.Wallet, config *EntryConfiguration) (*Common, error) {
+	if service == nil {
+		return nil, errors.New("service is nil")
+	}
+	if wallet == nil {
+		return nil, errors.New("wallet is nil")
+	}
+	if config != nil {
+		if err := config.validate(false); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+
 	config, err := MergedEntryConfig(config)
 	if err != nil {
 		return nil, err
 	}
 
+	// reverse entry serves whatever service the reverse exit connecting to it
+	// provides
+	if len(service.Name) == 0 && !config.Reverse {
+		return nil, errors.New("service name is empty")
+	}
+
+	s := *service
+	var info ServiceInfo
+	if serviceInfo != nil {
+		info = *serviceInfo
+	} else {
+		info = config.Services[s.Name]
+	}
+	if _, err := ParsePrice(info.MaxPrice); err != nil {
+		return nil, fmt.Errorf("invalid maxPrice %q of service %s: %v", info.MaxPrice, s.Name, err)
+	}
+	if info.IPFilter == nil {
+		info.IPFilter = &geo.IPFilter{}
+	}
+	if info.NknFilter == nil {
+		info.NknFilter = &filter.NknFilter{}
+	}
+
+	if len(s.Encryption) == 0 {
+		s.Encryption = config.Encryption
+	}
+
 	c, err := NewCommon(
-		&service,
-		&serviceInfo,
+		&s,
+		&info,
 		wallet,
-		config.DialTimeout,
+		time.Duration(config.DialTimeout),
 		config.SubscriptionPrefix,
 		config.Reverse,
 		config.Reverse,
@@ -71,16 +123,96 @@ func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet,
 		return nil, err
 	}
 
-	te := &TunaEntry{
-		Common:       c,
-		config:       config,
-		tcpListeners: make(map[byte]*net.TCPListener),
-		serviceConn:  make(map[byte]*net.UDPConn),
-		clientAddr:   cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+	err = verifySelectionStrategy(config.ServerSelectionStrategy)
+	if err != nil {
+		return nil, err
+	}
+	c.SelectionStrategy = config.ServerSelectionStrategy
+	c.AllowSelfConnect = config.AllowSelfConnect
+	c.MinSubscribers = int(config.MinSubscribers)
+	c.RequiredTags = config.RequiredTags
+	c.ExcludedTags = config.ExcludedTags
+	c.AllowedBeneficiaries, err = ParseBeneficiaries(config.AllowedBeneficiaries)
+	if err != nil {
+		return nil, err
+	}
+	c.ConnectTimeout = time.Duration(config.ConnectTimeout) * time.Second
+	c.PreferredServer = config.PreferredServer
+	c.ServerCacheFile = config.ServerCacheFile
+	c.StartupRetry = config.StartupRetry
+	c.StartupRetryInterval = time.Duration(config.StartupRetryInterval) * time.Millisecond
+	if len(config.UDPLocalIP) > 0 {
+		c.UDPLocalIP = net.ParseIP(config.UDPLocalIP)
+		if c.UDPLocalIP == nil {
+			return nil, fmt.Errorf("invalid udpLocalIP %s", config.UDPLocalIP)
+		}
+	}
+	c.UDPLocalPortMin, c.UDPLocalPortMax, err = ParsePortRange(config.UDPLocalPortRange)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxMetadataSize > 0 {
+		c.MaxMetadataSize = int(config.MaxMetadataSize)
+	}
+	c.HealthCheckInterval = time.Duration(config.HealthCheckInterval) * time.Second
+	c.DialRetries = int(config.DialRetries)
+	c.ParallelDial = int(config.ParallelDial)
+	c.LogDialRTT = config.LogDialRTT
+	c.FailedServerBlockDuration = time.Duration(config.FailedExitBlockDuration) * time.Second
+	c.SubscriberCacheTTL = time.Duration(config.SubscriberCacheTTL) * time.Second
+	if len(config.DNSResolver) > 0 {
+		c.Resolver = NewResolver(config.DNSResolver)
+	}
+	c.HealthCheckTimeout = time.Duration(config.HealthCheckTimeout) * time.Second
+	c.Compression = config.Compression
+	c.WriteTimeout = time.Duration(config.WriteTimeout)
+	c.UDPOverTCP = config.UDPOverTCP
+	c.Transport = config.Transport
+	if len(config.MaxTotalSpend) > 0 {
+		c.MaxTotalSpend, err = common.StringToFixed64(config.MaxTotalSpend)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.PaymentScheme, err = NewPaymentScheme(config.PaymentScheme, wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	nanoPayUpdateInterval := config.NanoPayUpdateInterval
+	if info.NanoPayUpdateInterval > 0 {
+		nanoPayUpdateInterval = info.NanoPayUpdateInterval
+	}
+	if nanoPayUpdateInterval > 0 {
+		c.NanoPayUpdateInterval = time.Duration(nanoPayUpdateInterval) * time.Second
+	}
+
+	c.SetServerUDPReadChan(make(chan []byte, config.UDPChannelBufferSize))
+	c.SetServerUDPWriteChan(make(chan []byte, config.UDPChannelBufferSize))
+
+	return c, nil
+}
+
+func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet, config *EntryConfiguration) (*TunaEntry, error) {
+	config, err := MergedEntryConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewEntryCommon(&service, &serviceInfo, wallet, config)
+	if err != nil {
+		return nil, err
 	}
 
-	te.SetServerUDPReadChan(make(chan []byte))
-	te.SetServerUDPWriteChan(make(chan []byte))
+	te := &TunaEntry{
+		Common:        c,
+		config:        config,
+		tcpListeners:  make(map[byte]net.Listener),
+		serviceConn:   make(map[byte]*net.UDPConn),
+		clientAddr:    cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+		streamLimiter: newStreamLimiter(config.MaxConcurrentStreams),
+	}
 
 	return te, nil
 }
@@ -88,17 +220,19 @@ func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet,
 func (te *TunaEntry) Start(shouldReconnect bool) error {
 	defer te.Close()
 
-	listenIP := net.ParseIP(te.ServiceInfo.ListenIP)
-	if listenIP == nil {
-		listenIP = net.ParseIP(defaultServiceListenIP)
-	}
+	listenIP := te.getListenIP()
 
-	tcpPorts, err := te.listenTCP(listenIP, te.Service.TCP)
+	tcpPorts, err := te.listenTCP(listenIP, te.Service.TCP, te.ServiceInfo.ListenUnix)
 	if err != nil {
 		return err
 	}
 	if len(tcpPorts) > 0 {
-		log.Printf("Serving %s on localhost tcp port %v", te.Service.Name, tcpPorts)
+		log.Printf("Serving %s on %s tcp port %v", te.Service.Name, listenIP, tcpPorts)
+	}
+	for i, path := range te.ServiceInfo.ListenUnix {
+		if len(path) > 0 && i < len(te.Service.TCP) {
+			log.Printf("Serving %s tcp port %d on unix socket %s", te.Service.Name, te.Service.TCP[i], path)
+		}
 	}
 
 	udpPorts, err := te.listenUDP(listenIP, te.Service.UDP)
@@ -106,7 +240,23 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 		return err
 	}
 	if len(udpPorts) > 0 {
-		log.Printf("Serving %s on localhost udp port %v", te.Service.Name, udpPorts)
+		log.Printf("Serving %s on %s udp port %v", te.Service.Name, listenIP, udpPorts)
+	}
+
+	if len(te.ServiceInfo.SOCKS5ListenAddr) > 0 {
+		socks5Addr, err := te.listenSOCKS5(te.ServiceInfo.SOCKS5ListenAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Serving %s as socks5 proxy on %v", te.Service.Name, socks5Addr)
+	}
+
+	if len(te.ServiceInfo.HTTPProxyListenAddr) > 0 {
+		httpProxyAddr, err := te.listenHTTPProxy(te.ServiceInfo.HTTPProxyListenAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Serving %s as http proxy on %v", te.Service.Name, httpProxyAddr)
 	}
 
 	geoCloseChan := make(chan struct{})
@@ -128,12 +278,24 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 		}
 
 		go func() {
+			backoff := util.NewBackoff(
+				time.Duration(te.config.ReconnectBackoffMin)*time.Millisecond,
+				time.Duration(te.config.ReconnectBackoffMax)*time.Millisecond,
+			)
 			for {
 				session, err := te.getSession()
 				if err != nil {
-					return
+					if !shouldReconnect || te.IsClosed() {
+						return
+					}
+					delay := backoff.Next()
+					log.Printf("Couldn't reconnect: %v, retry in %v", err, delay)
+					time.Sleep(delay)
+					continue
 				}
 
+				sessionStart := time.Now()
+				sessionConn := te.GetTCPConn()
 				_, err = session.AcceptStream()
 				if err != nil {
 					log.Println("Close connection:", err)
@@ -142,6 +304,21 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 						te.Close()
 						return
 					}
+					if te.IsClosed() {
+						return
+					}
+					// Mark as disconnected so that the next session is created
+					// with a newly selected exit, unless Reconnect has already
+					// connected to one.
+					if te.GetTCPConn() == sessionConn {
+						te.SetConnected(false)
+					}
+					if time.Since(sessionStart) > backoff.Max {
+						backoff.Reset()
+					}
+					delay := backoff.Next()
+					log.Printf("Reconnecting in %v", delay)
+					time.Sleep(delay)
 				}
 			}
 		}()
@@ -161,15 +338,97 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 	return nil
 }
 
+// Dial connects to an exit providing serviceName and returns a stream to the
+// first TCP port of the service as a net.Conn, without listening on any local
+// port. Closing the returned conn also closes the underlying tuna entry.
+func Dial(wallet *nkn.Wallet, serviceName string, config *EntryConfiguration) (net.Conn, error) {
+	return DialContext(context.Background(), wallet, serviceName, config)
+}
+
+func DialContext(ctx context.Context, wallet *nkn.Wallet, serviceName string, config *EntryConfiguration) (net.Conn, error) {
+	config, err := MergedEntryConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceInfo := config.Services[serviceName]
+	if serviceInfo.IPFilter == nil {
+		serviceInfo.IPFilter = &geo.IPFilter{}
+	}
+	if serviceInfo.NknFilter == nil {
+		serviceInfo.NknFilter = &filter.NknFilter{}
+	}
+
+	// Local ports are never listened on, but service needs a TCP port so that
+	// TCP connection to exit is created.
+	te, err := NewTunaEntry(Service{Name: serviceName, TCP: []uint32{0}}, serviceInfo, wallet, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = te.CreateServerConnContext(ctx, true)
+	if err != nil {
+		te.Close()
+		return nil, err
+	}
+
+	stream, compress, err := te.openServiceStream(0, "")
+	if err != nil {
+		te.Close()
+		return nil, err
+	}
+
+	var rw io.ReadWriteCloser = newCountingStream(stream, &te.bytesExitToEntry, &te.bytesEntryToExit)
+	if compress {
+		rw, err = newCompressedStream(rw)
+		if err != nil {
+			Close(stream)
+			te.Close()
+			return nil, err
+		}
+	}
+
+	go te.startPayment(
+		&te.bytesEntryToExit, &te.bytesExitToEntry,
+		&te.bytesEntryToExitPaid, &te.bytesExitToEntryPaid,
+		te.config.NanoPayFee,
+		te.getPaymentStream,
+	)
+
+	return &entryConn{Stream: stream, rw: rw, te: te}, nil
+}
+
+// entryConn is a stream to exit that counts traffic for payment and closes
+// its tuna entry when closed.
+type entryConn struct {
+	*smux.Stream
+	rw io.ReadWriteCloser
+	te *TunaEntry
+}
+
+func (c *entryConn) Read(b []byte) (int, error) {
+	return c.rw.Read(b)
+}
+
+func (c *entryConn) Write(b []byte) (int, error) {
+	return c.rw.Write(b)
+}
+
+func (c *entryConn) Close() error {
+	err := c.rw.Close()
+	c.te.sessionLock.Lock()
+	Close(c.te.session)
+	c.te.sessionLock.Unlock()
+	c.te.Close()
+	return err
+}
+
 func (te *TunaEntry) StartReverse(stream *smux.Stream) error {
 	defer te.Close()
 
 	metadata := te.GetMetadata()
-	listenIP := net.ParseIP(te.ServiceInfo.ListenIP)
-	if listenIP == nil {
-		listenIP = net.ParseIP(defaultServiceListenIP)
-	}
-	tcpPorts, err := te.listenTCP(listenIP, metadata.ServiceTcp)
+	listenIP := te.getListenIP()
+	tcpPorts, err := te.listenTCP(listenIP, metadata.ServiceTcp, nil)
 	if err != nil {
 		return err
 	}
@@ -178,7 +437,7 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream) error {
 		return err
 	}
 
-	serviceMetadata := CreateRawMetadata(0, tcpPorts, udpPorts, "", 0, 0, "", te.config.ReverseBeneficiaryAddr)
+	serviceMetadata := CreateRawMetadata(0, tcpPorts, udpPorts, "", 0, 0, 0, "", te.config.ReverseBeneficiaryAddr, nil)
 	err = WriteVarBytes(stream, serviceMetadata)
 	if err != nil {
 		return err
@@ -193,31 +452,34 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream) error {
 	lastPaymentTime := time.Now()
 	claimInterval := time.Duration(te.config.ReverseClaimInterval) * time.Second
 	onErr := nkn.NewOnError(1, nil)
-	isClosed := false
+	sessionClosed := make(chan struct{})
+	defer close(sessionClosed)
 
-	entryToExitPrice, exitToEntryPrice, err := ParsePrice(te.config.ReversePrice)
+	price, err := ParsePrice(te.config.ReversePrice)
 	if err != nil {
 		return err
 	}
 
-	npc, err := te.Wallet.NewNanoPayClaimer(te.config.ReverseBeneficiaryAddr, int32(claimInterval/time.Millisecond), te.config.ReverseMinFlushAmount, onErr)
+	npc, err := te.PaymentScheme.NewClaimer(te.config.ReverseBeneficiaryAddr, claimInterval, te.config.ReverseMinFlushAmount, onErr)
 	if err != nil {
 		return err
 	}
 
-	defer npc.Close()
-
 	getTotalCost := func() (common.Fixed64, common.Fixed64) {
-		bytesEntryToExit := common.Fixed64(atomic.LoadUint64(&te.reverseBytesEntryToExit))
-		bytesExitToEntry := common.Fixed64(atomic.LoadUint64(&te.reverseBytesExitToEntry))
-		cost := entryToExitPrice*bytesEntryToExit/TrafficUnit + exitToEntryPrice*bytesExitToEntry/TrafficUnit
-		totalBytes := bytesEntryToExit + bytesExitToEntry
+		bytesEntryToExit := atomic.LoadUint64(&te.reverseBytesEntryToExit)
+		bytesExitToEntry := atomic.LoadUint64(&te.reverseBytesExitToEntry)
+		cost := price.Cost(bytesEntryToExit, bytesExitToEntry)
+		totalBytes := common.Fixed64(bytesEntryToExit + bytesExitToEntry)
 		return cost, totalBytes
 	}
 
-	go checkNanoPayClaim(session, npc, onErr, &isClosed)
+	if npc != nil {
+		defer npc.Close()
+
+		go checkPaymentClaim(session, npc, onErr, sessionClosed)
 
-	go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
+		go checkPayment(session, te.NanoPayUpdateInterval, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, sessionClosed, getTotalCost)
+	}
 
 	for {
 		if te.IsClosed() {
@@ -255,6 +517,10 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream) error {
 func (te *TunaEntry) Close() {
 	te.WaitSessions()
 
+	if err := te.closeAllChannels(); err != nil {
+		log.Println(err)
+	}
+
 	te.Lock()
 	defer te.Unlock()
 
@@ -267,12 +533,40 @@ func (te *TunaEntry) Close() {
 	for _, listener := range te.tcpListeners {
 		Close(listener)
 	}
+	Close(te.socks5Listener)
+	Close(te.httpProxyListener)
 	for _, conn := range te.serviceConn {
 		Close(conn)
 	}
 	te.OnConnect.close()
 }
 
+// Status returns the current connection status including traffic counters.
+func (te *TunaEntry) Status() *ConnectionStatus {
+	status := te.Common.Status()
+	if te.config.Reverse {
+		status.BytesEntryToExit = atomic.LoadUint64(&te.reverseBytesEntryToExit)
+		status.BytesExitToEntry = atomic.LoadUint64(&te.reverseBytesExitToEntry)
+	} else {
+		status.BytesEntryToExit = atomic.LoadUint64(&te.bytesEntryToExit)
+		status.BytesExitToEntry = atomic.LoadUint64(&te.bytesExitToEntry)
+	}
+	return status
+}
+
+// getListenIP returns the IP to bind local service listeners to. Service
+// listenIP takes precedence over entry listenIP, and loopback is used if
+// neither is set.
+func (te *TunaEntry) getListenIP() net.IP {
+	if ip := net.ParseIP(te.ServiceInfo.ListenIP); ip != nil {
+		return ip
+	}
+	if ip := net.ParseIP(te.config.ListenIP); ip != nil {
+		return ip
+	}
+	return net.ParseIP(defaultServiceListenIP)
+}
+
 func (te *TunaEntry) IsClosed() bool {
 	te.RLock()
 	defer te.RUnlock()
@@ -285,7 +579,7 @@ func (te *TunaEntry) createSession(force bool) (*smux.Session, *smux.Stream, err
 		return nil, nil, err
 	}
 
-	session, err := smux.Client(conn, nil)
+	session, err := smux.Client(conn, te.config.SmuxConfig.smuxConfig())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -317,61 +611,132 @@ func (te *TunaEntry) getSession() (*smux.Session, error) {
 
 		te.session = session
 		te.paymentStream = paymentStream
+
+		if te.useHealthCheck() {
+			go te.startHealthCheck(session)
+		}
 	}
 
 	return te.session, nil
 }
 
+// Session returns the current smux session to exit, which is nil if not
+// connected yet and may have been closed.
+func (te *TunaEntry) Session() *smux.Session {
+	te.sessionLock.Lock()
+	defer te.sessionLock.Unlock()
+	return te.session
+}
+
+// SetSession replaces the smux session to exit, e.g. after reconnecting.
+// Streams opened on the previous session are not affected.
+func (te *TunaEntry) SetSession(session *smux.Session) {
+	te.sessionLock.Lock()
+	defer te.sessionLock.Unlock()
+	te.session = session
+}
+
 func (te *TunaEntry) getPaymentStream() (*smux.Stream, error) {
 	_, err := te.getSession()
 	if err != nil {
 		return nil, err
 	}
+	te.sessionLock.Lock()
 	paymentStream := te.paymentStream
+	te.sessionLock.Unlock()
 	if paymentStream == nil {
 		return nil, errors.New("nil payment stream")
 	}
 	return paymentStream, nil
 }
 
-func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, error) {
+// openStream opens a stream in session to exit. If it fails, e.g. session is
+// dead but not detected yet, session is closed and rebuilt over a new
+// connection, and opening is retried once. Session can't be rebuilt in reverse
+// mode since it's exit that connects to entry.
+func (te *TunaEntry) openStream() (*smux.Stream, error) {
 	session, err := te.getSession()
 	if err != nil {
 		return nil, err
 	}
 
 	stream, err := session.OpenStream()
+	if err == nil {
+		return stream, nil
+	}
+	session.Close()
+	if te.Reverse {
+		return nil, err
+	}
+
+	log.Println("Couldn't open stream, rebuilding session:", err)
+	session, err = te.getSession()
+	if err != nil {
+		return nil, fmt.Errorf("rebuild session: %w", err)
+	}
+
+	stream, err = session.OpenStream()
 	if err != nil {
 		session.Close()
 		return nil, err
 	}
+	return stream, nil
+}
+
+// openServiceStream opens a stream to the service port portID of exit. If
+// destAddr is not empty, exit will forward the stream to destAddr instead. It
+// also returns whether stream data should be compressed.
+func (te *TunaEntry) openServiceStream(portID byte, destAddr string) (*smux.Stream, bool, error) {
+	if te.IsSpendLimitReached() {
+		return nil, false, ErrSpendLimitReached
+	}
+
+	stream, err := te.openStream()
+	if err != nil {
+		return nil, false, err
+	}
 
 	streamMetadata := &pb.StreamMetadata{
-		ServiceId: te.GetMetadata().ServiceId,
-		PortId:    uint32(portID),
-		IsPayment: false,
+		ServiceId:   te.GetMetadata().ServiceId,
+		PortId:      uint32(portID),
+		IsPayment:   false,
+		DestAddr:    destAddr,
+		Compression: te.useCompression(),
 	}
 
 	err = writeStreamMetadata(stream, streamMetadata)
 	if err != nil {
 		stream.Close()
-		return nil, err
+		return nil, false, err
 	}
 
-	return stream, nil
+	return stream, streamMetadata.Compression, nil
 }
 
-func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
+// listenTCP listens on ports of ip, or on unixPaths[i] instead of ports[i] if
+// it's not empty, and returns the TCP ports assigned.
+func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32, unixPaths []string) ([]uint32, error) {
 	assignedPorts := make([]uint32, 0, len(ports))
 	for i, _port := range ports {
-		listener, err := net.ListenTCP(tcp, &net.TCPAddr{IP: ip, Port: int(_port)})
-		if err != nil {
-			log.Println("Couldn't bind listener:", err)
-			return nil, err
-		}
-		port := listener.Addr().(*net.TCPAddr).Port
 		portID := byte(i)
-		assignedPorts = append(assignedPorts, uint32(port))
+		var listener net.Listener
+		if i < len(unixPaths) && len(unixPaths[i]) > 0 {
+			var err error
+			listener, err = listenUnix(unixPaths[i])
+			if err != nil {
+				log.Println("Couldn't bind unix listener:", err)
+				return nil, err
+			}
+		} else {
+			tcpListener, err := net.ListenTCP(tcp, &net.TCPAddr{IP: ip, Port: int(_port)})
+			if err != nil {
+				log.Println("Couldn't bind listener:", err)
+				return nil, err
+			}
+			port := tcpListener.Addr().(*net.TCPAddr).Port
+			assignedPorts = append(assignedPorts, uint32(port))
+			listener = tcpListener
+		}
 
 		te.tcpListeners[portID] = listener
 
@@ -395,19 +760,29 @@ func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
 					if te.IsClosed() {
 						return
 					}
-					stream, err := te.openServiceStream(portID)
+					if !te.streamLimiter.acquire() {
+						log.Printf("Max concurrent streams %d reached, reject connection", te.config.MaxConcurrentStreams)
+						Close(conn)
+						return
+					}
+					stream, compress, err := te.openServiceStream(portID, "")
 					if err != nil {
 						log.Println("Couldn't open stream:", err)
+						te.streamLimiter.release()
 						Close(conn)
 						return
 					}
 
 					if te.config.Reverse {
-						go te.pipe(stream, conn, &te.reverseBytesEntryToExit)
-						go te.pipe(conn, stream, &te.reverseBytesExitToEntry)
+						err = te.pipeStream(stream, conn, compress, &te.reverseBytesEntryToExit, &te.reverseBytesExitToEntry, te.streamLimiter)
 					} else {
-						go te.pipe(stream, conn, &te.bytesEntryToExit)
-						go te.pipe(conn, stream, &te.bytesExitToEntry)
+						err = te.pipeStream(stream, conn, compress, &te.bytesEntryToExit, &te.bytesExitToEntry, te.streamLimiter)
+					}
+					if err != nil {
+						log.Println("Couldn't pipe stream:", err)
+						te.streamLimiter.release()
+						Close(stream)
+						Close(conn)
 					}
 				}()
 			}
@@ -417,6 +792,152 @@ func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
 	return assignedPorts, nil
 }
 
+// listenUnix listens on unix socket path. A stale socket left by a previous
+// run is removed first, but other kinds of files are never removed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// proxyProtocol is the protocol of a local proxy listener, which tunnels each
+// connection to the destination requested by client through exit dynamic
+// upstream.
+type proxyProtocol struct {
+	name string
+	// handshake reads the destination requested on conn and returns the conn
+	// to use for the rest of the connection.
+	handshake func(conn net.Conn) (net.Conn, string, error)
+	// reply tells client whether the destination is connected.
+	reply func(conn net.Conn, ok bool) error
+}
+
+var socks5Protocol = proxyProtocol{
+	name: "socks5",
+	handshake: func(conn net.Conn) (net.Conn, string, error) {
+		destAddr, err := socks5Handshake(conn)
+		return conn, destAddr, err
+	},
+	reply: func(conn net.Conn, ok bool) error {
+		if ok {
+			return socks5Reply(conn, socks5ReplySucceeded)
+		}
+		return socks5Reply(conn, socks5ReplyGeneralFailure)
+	},
+}
+
+var httpProxyProtocol = proxyProtocol{
+	name:      "http",
+	handshake: httpProxyHandshake,
+	reply: func(conn net.Conn, ok bool) error {
+		if ok {
+			return httpProxyReply(conn, http.StatusOK)
+		}
+		return httpProxyReply(conn, http.StatusBadGateway)
+	},
+}
+
+func (te *TunaEntry) listenSOCKS5(addr string) (net.Addr, error) {
+	listener, err := te.listenProxy(addr, socks5Protocol)
+	if err != nil {
+		return nil, err
+	}
+	te.Lock()
+	te.socks5Listener = listener
+	te.Unlock()
+	return listener.Addr(), nil
+}
+
+func (te *TunaEntry) listenHTTPProxy(addr string) (net.Addr, error) {
+	listener, err := te.listenProxy(addr, httpProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	te.Lock()
+	te.httpProxyListener = listener
+	te.Unlock()
+	return listener.Addr(), nil
+}
+
+// listenProxy serves proxy of protocol on addr.
+func (te *TunaEntry) listenProxy(addr string, protocol proxyProtocol) (net.Listener, error) {
+	listener, err := net.Listen(tcp, addr)
+	if err != nil {
+		log.Printf("Couldn't bind %s listener: %v", protocol.name, err)
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if te.IsClosed() {
+					return
+				}
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					te.Close()
+					return
+				}
+				log.Printf("Couldn't accept %s connection: %v", protocol.name, err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			go func() {
+				if te.IsClosed() {
+					Close(conn)
+					return
+				}
+
+				proxyConn, destAddr, err := protocol.handshake(conn)
+				if err != nil {
+					log.Printf("%s proxy handshake error: %v", protocol.name, err)
+					Close(conn)
+					return
+				}
+				conn := proxyConn
+
+				if !te.streamLimiter.acquire() {
+					log.Printf("Max concurrent streams %d reached, reject connection", te.config.MaxConcurrentStreams)
+					protocol.reply(conn, false)
+					Close(conn)
+					return
+				}
+
+				stream, compress, err := te.openServiceStream(0, destAddr)
+				if err != nil {
+					log.Println("Couldn't open stream:", err)
+					te.streamLimiter.release()
+					protocol.reply(conn, false)
+					Close(conn)
+					return
+				}
+
+				err = protocol.reply(conn, true)
+				if err != nil {
+					te.streamLimiter.release()
+					Close(stream)
+					Close(conn)
+					return
+				}
+
+				err = te.pipeStream(stream, conn, compress, &te.bytesEntryToExit, &te.bytesExitToEntry, te.streamLimiter)
+				if err != nil {
+					log.Println("Couldn't pipe stream:", err)
+					te.streamLimiter.release()
+					Close(stream)
+					Close(conn)
+				}
+			}()
+		}
+	}()
+
+	return listener, nil
+}
+
 func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 	assignedPorts := make([]uint32, 0, len(ports))
 	if len(ports) == 0 {
@@ -436,9 +957,17 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 			}
 
 			data := <-serverReadChan
+			if len(data) < udpHeaderSize {
+				log.Println("Couldn't parse data from server: too short")
+				continue
+			}
 
 			portID := data[3]
-			port := ConnIDToPort(data)
+			port, err := ConnIDToPort(data)
+			if err != nil {
+				log.Println("Couldn't get conn id:", err)
+				continue
+			}
 			connID := strconv.Itoa(int(port))
 
 			var serviceConn *net.UDPConn
@@ -455,13 +984,17 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 			}
 			clientAddr := x.(*net.UDPAddr)
 
-			_, err = serviceConn.WriteToUDP(data, clientAddr)
+			_, err = serviceConn.WriteToUDP(data[udpHeaderSize:], clientAddr)
 			if err != nil {
 				log.Println("Couldn't send data to client:", err)
 			}
 		}
 	}()
 
+	if te.UDPOverTCP && !te.Reverse {
+		go te.forwardUDPOverTCP()
+	}
+
 	for i, _port := range ports {
 		localConn, err := net.ListenUDP(udp, &net.UDPAddr{IP: ip, Port: int(_port)})
 		if err != nil {
@@ -498,7 +1031,7 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 				}
 				connID := PortToConnID(uint16(addr.Port))
 				serviceID := te.GetMetadata().ServiceId
-				serverWriteChan <- append([]byte{connID[0], connID[1], byte(serviceID), portID}, localBuffer[:n]...)
+				sendDatagram(serverWriteChan, append([]byte{connID[0], connID[1], byte(serviceID), portID}, localBuffer[:n]...), te.closeChan)
 			}
 		}()
 	}
@@ -506,7 +1039,191 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 	return assignedPorts, nil
 }
 
+// forwardUDPOverTCP forwards data between server UDP channels and a UDP stream
+// to exit until entry is closed, opening a new stream when the previous one or
+// its session is closed.
+func (te *TunaEntry) forwardUDPOverTCP() {
+	backoff := util.NewBackoff(time.Second, 8*time.Second)
+	for !te.IsClosed() {
+		start := time.Now()
+		err := te.pipeUDPStream()
+		if te.IsClosed() {
+			return
+		}
+		log.Println("UDP stream closed:", err)
+		// a stream that lasted long was not failing to open
+		if time.Since(start) > 8*time.Second {
+			backoff.Reset()
+		}
+		time.Sleep(backoff.Next())
+	}
+}
+
+// pipeUDPStream opens a UDP stream to exit and forwards datagrams framed by
+// WriteVarBytes between it and server UDP channels until it's closed.
+func (te *TunaEntry) pipeUDPStream() error {
+	stream, err := te.openStream()
+	if err != nil {
+		return err
+	}
+	defer Close(stream)
+
+	err = writeStreamMetadata(stream, &pb.StreamMetadata{
+		ServiceId: te.GetMetadata().ServiceId,
+		IsUdp:     true,
+	})
+	if err != nil {
+		return err
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			data, err := ReadVarBytes(stream, maxUDPFrameSize)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if !sendDatagram(te.udpReadChan, data, te.closeChan) {
+				readErr <- nil
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case data := <-te.udpWriteChan:
+			err = WriteVarBytes(stream, data)
+			if err != nil {
+				return err
+			}
+		case err = <-readErr:
+			return err
+		case <-te.closeChan:
+			return nil
+		}
+	}
+}
+
+// writeReverseUDP sends datagrams from udpWriteChan of a reverse session to
+// addr through the shared udpConn, and routes replies of their flows to
+// udpReadChan, until udpCloseChan or sessionDone is closed.
+func writeReverseUDP(udpConn *net.UDPConn, addr *net.UDPAddr, demux *udpDemux, udpReadChan, udpWriteChan chan []byte, udpCloseChan, sessionDone chan struct{}) {
+	for {
+		select {
+		case data := <-udpWriteChan:
+			if len(data) >= connIDSize {
+				demux.set(addr, data[:connIDSize], udpReadChan)
+			}
+			_, err := udpConn.WriteToUDP(data, addr)
+			if err != nil {
+				log.Println("Couldn't send data to server:", err)
+			}
+		case <-udpCloseChan:
+			return
+		case <-sessionDone:
+			return
+		}
+	}
+}
+
+// udpDemux routes datagrams received on the shared reverse UDP listener to the
+// entry that owns the flow. The first connIDSize bytes of each datagram are the
+// conn id, so flows are keyed by both remote address and conn id to keep
+// concurrent flows from the same remote address separate. Flows without
+// traffic for idleTimeout are removed by reapIdle.
+type udpDemux struct {
+	sync.RWMutex
+	flows       map[string]*udpFlow
+	idleTimeout time.Duration
+}
+
+type udpFlow struct {
+	lastActive int64 // unix nano, keep on top for atomic access on arm32
+	c          chan []byte
+}
+
+func newUDPDemux(idleTimeout time.Duration) *udpDemux {
+	return &udpDemux{
+		flows:       make(map[string]*udpFlow),
+		idleTimeout: idleTimeout,
+	}
+}
+
+func udpDemuxKey(addr *net.UDPAddr, connID []byte) string {
+	port, _ := ConnIDToPort(connID)
+	return addr.String() + ":" + strconv.Itoa(int(port))
+}
+
+func (d *udpDemux) get(addr *net.UDPAddr, connID []byte) (chan []byte, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	f, ok := d.flows[udpDemuxKey(addr, connID)]
+	if !ok {
+		return nil, false
+	}
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+	return f.c, true
+}
+
+func (d *udpDemux) set(addr *net.UDPAddr, connID []byte, c chan []byte) {
+	key := udpDemuxKey(addr, connID)
+	now := time.Now().UnixNano()
+	d.RLock()
+	existing, ok := d.flows[key]
+	d.RUnlock()
+	if ok && existing.c == c {
+		atomic.StoreInt64(&existing.lastActive, now)
+		return
+	}
+	d.Lock()
+	d.flows[key] = &udpFlow{lastActive: now, c: c}
+	d.Unlock()
+}
+
+func (d *udpDemux) remove(c chan []byte) {
+	d.Lock()
+	defer d.Unlock()
+	for key, f := range d.flows {
+		if f.c == c {
+			delete(d.flows, key)
+		}
+	}
+}
+
+// reapIdle periodically removes flows idle for longer than idleTimeout until
+// done is closed. It returns immediately if idleTimeout is not positive.
+func (d *udpDemux) reapIdle(done <-chan struct{}) {
+	if d.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(d.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		deadline := time.Now().Add(-d.idleTimeout).UnixNano()
+		d.Lock()
+		for key, f := range d.flows {
+			if atomic.LoadInt64(&f.lastActive) < deadline {
+				delete(d.flows, key)
+			}
+		}
+		d.Unlock()
+	}
+}
+
 func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
+	return StartReverseContext(context.Background(), config, wallet)
+}
+
+// StartReverseContext starts a reverse entry. Listeners and subscription
+// renewal are stopped when ctx is done.
+func StartReverseContext(ctx context.Context, config *EntryConfiguration, wallet *nkn.Wallet) error {
 	config, err := MergedEntryConfig(config)
 	if err != nil {
 		return err
@@ -519,23 +1236,52 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 		serviceListenIP = config.ReverseServiceListenIP
 	}
 
-	ip, err := ipify.GetIp()
+	ip := config.ReverseIP
+	if len(ip) > 0 {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid reverse ip %s", ip)
+		}
+	} else {
+		ip, err = getPublicIP(ctx)
+		if err != nil {
+			return fmt.Errorf("Couldn't get IP: %v", err)
+		}
+	}
+
+	var tcpBindIP, udpBindIP net.IP
+	if len(config.ReverseTCPBindAddr) > 0 {
+		tcpBindIP = net.ParseIP(config.ReverseTCPBindAddr)
+		if tcpBindIP == nil {
+			return fmt.Errorf("invalid reverse tcp bind address %s", config.ReverseTCPBindAddr)
+		}
+	}
+	if len(config.ReverseUDPBindAddr) > 0 {
+		udpBindIP = net.ParseIP(config.ReverseUDPBindAddr)
+		if udpBindIP == nil {
+			return fmt.Errorf("invalid reverse udp bind address %s", config.ReverseUDPBindAddr)
+		}
+	}
+
+	tcpNetwork, udpNetwork, err := reverseNetworks(config.ReverseNetwork)
 	if err != nil {
-		return fmt.Errorf("Couldn't get IP: %v", err)
+		return err
 	}
 
-	listener, err := net.ListenTCP(tcp, &net.TCPAddr{Port: int(config.ReverseTCP)})
+	listener, err := net.ListenTCP(tcpNetwork, &net.TCPAddr{IP: tcpBindIP, Port: int(config.ReverseTCP)})
 	if err != nil {
 		return err
 	}
 
-	udpConn, err := net.ListenUDP(udp, &net.UDPAddr{Port: int(config.ReverseUDP)})
+	udpConn, err := net.ListenUDP(udpNetwork, &net.UDPAddr{IP: udpBindIP, Port: int(config.ReverseUDP)})
 	if err != nil {
 		return err
 	}
 
-	udpReadChans := make(map[string]chan []byte)
+	udpReadChans := newUDPDemux(time.Duration(config.UDPTimeout) * time.Second)
+	// closed (never sent to) when udpConn is closed, so that UDP writers of
+	// all sessions stop instead of only one of them
 	udpCloseChan := make(chan struct{})
+	go udpReadChans.reapIdle(ctx.Done())
 
 	go func() {
 		for {
@@ -544,22 +1290,33 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 			if err != nil {
 				log.Println("Couldn't receive data from server:", err)
 				if strings.Contains(err.Error(), "use of closed network connection") {
-					udpCloseChan <- struct{}{}
+					close(udpCloseChan)
 					return
 				}
 				continue
 			}
 
+			if n < udpHeaderSize {
+				log.Println("Couldn't parse data from server: too short")
+				continue
+			}
+
 			data := make([]byte, n)
 			copy(data, buffer)
 
-			if udpReadChan, ok := udpReadChans[addr.String()]; ok {
-				udpReadChan <- data
+			if udpReadChan, ok := udpReadChans.get(addr, data[:connIDSize]); ok {
+				sendDatagram(udpReadChan, data, nil)
 			}
 		}
 	}()
 
 	go func() {
+		// persistent accept error like too many open files should not result
+		// in a busy loop, while a transient one should not delay clients long
+		backoff := util.NewBackoff(
+			time.Duration(config.ReverseAcceptBackoffMin)*time.Millisecond,
+			time.Duration(config.ReverseAcceptBackoffMax)*time.Millisecond,
+		)
 		for {
 			tcpConn, err := listener.Accept()
 			if err != nil {
@@ -567,9 +1324,10 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 					return
 				}
 				log.Println("Couldn't accept client connection:", err)
-				time.Sleep(time.Second)
+				time.Sleep(backoff.Next())
 				continue
 			}
+			backoff.Reset()
 
 			go func() {
 				err := func() error {
@@ -585,33 +1343,31 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 						return err
 					}
 
+					te.setRemoteCompression(connMetadata.Compression)
+
 					defer Close(encryptedConn)
 
 					if connMetadata.IsMeasurement {
 						return util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), 0)
 					}
 
-					te.session, err = smux.Server(encryptedConn, nil)
+					session, err := smux.Server(encryptedConn, te.config.SmuxConfig.smuxConfig())
 					if err != nil {
 						return fmt.Errorf("create session error: %v", err)
 					}
+					te.SetSession(session)
 
-					stream, err := te.session.AcceptStream()
+					stream, err := session.AcceptStream()
 					if err != nil {
-						te.session.Close()
+						session.Close()
 						return fmt.Errorf("couldn't accept stream: %v", err)
 					}
 
-					buf, err := ReadVarBytes(stream, maxServiceMetadataSize)
+					metadata, err := te.readMetadataFromStream(stream)
 					if err != nil {
 						return fmt.Errorf("couldn't read service metadata: %v", err)
 					}
 
-					metadata, err := ReadMetadata(string(buf))
-					if err != nil {
-						return fmt.Errorf("couldn't decode service metadata: %v", err)
-					}
-
 					te.SetMetadata(metadata)
 
 					te.SetServerTCPConn(encryptedConn)
@@ -623,24 +1379,14 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 						}
 
 						udpAddr := net.UDPAddr{IP: net.ParseIP(ip), Port: int(metadata.UdpPort)}
-						udpReadChan := make(chan []byte)
-						udpWriteChan := make(chan []byte)
-
-						go func() {
-							for {
-								select {
-								case data := <-udpWriteChan:
-									_, err := udpConn.WriteToUDP(data, &udpAddr)
-									if err != nil {
-										log.Println("Couldn't send data to server:", err)
-									}
-								case <-udpCloseChan:
-									return
-								}
-							}
-						}()
-
-						udpReadChans[udpAddr.String()] = udpReadChan
+						udpReadChan := make(chan []byte, config.UDPChannelBufferSize)
+						udpWriteChan := make(chan []byte, config.UDPChannelBufferSize)
+						sessionDone := make(chan struct{})
+						defer close(sessionDone)
+
+						go writeReverseUDP(udpConn, &udpAddr, udpReadChans, udpReadChan, udpWriteChan, udpCloseChan, sessionDone)
+
+						defer udpReadChans.remove(udpReadChan)
 
 						te.SetServerUDPReadChan(udpReadChan)
 						te.SetServerUDPWriteChan(udpWriteChan)
@@ -660,24 +1406,69 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 		}
 	}()
 
-	for _, rsn := range strings.Split(config.ReverseServiceName, ",") {
-		UpdateMetadata(
-			strings.Trim(rsn, " "),
-			0,
-			nil,
-			nil,
-			ip,
-			uint32(config.ReverseTCP),
-			uint32(config.ReverseUDP),
-			config.ReversePrice,
-			config.ReverseBeneficiaryAddr,
-			config.ReverseSubscriptionPrefix,
-			uint32(config.ReverseSubscriptionDuration),
-			config.ReverseSubscriptionFee,
-			wallet,
-			make(chan struct{}),
-		)
+	subscribe := func(ip string) []func() {
+		stopSubscriptions := make([]func(), 0)
+		for _, rsn := range strings.Split(config.ReverseServiceName, ",") {
+			stop := UpdateMetadata(
+				strings.Trim(rsn, " "),
+				0,
+				nil,
+				nil,
+				ip,
+				uint32(config.ReverseTCP),
+				uint32(config.ReverseUDP),
+				0,
+				config.ReversePrice,
+				config.ReverseBeneficiaryAddr,
+				nil,
+				config.ReverseSubscriptionPrefix,
+				uint32(config.ReverseSubscriptionDuration),
+				config.ReverseSubscriptionFee,
+				config.ReverseMaxSubscribesPerDay,
+				wallet,
+				nil,
+			)
+			stopSubscriptions = append(stopSubscriptions, stop)
+		}
+		return stopSubscriptions
 	}
 
+	stopSubscriptions := subscribe(ip)
+
+	go func() {
+		var refresh <-chan time.Time
+		if len(config.ReverseIP) == 0 && config.ReverseIPRefreshInterval > 0 {
+			ticker := time.NewTicker(time.Duration(config.ReverseIPRefreshInterval) * time.Second)
+			defer ticker.Stop()
+			refresh = ticker.C
+		}
+		for {
+			select {
+			case <-refresh:
+				newIP, err := getPublicIP(ctx)
+				if err != nil {
+					log.Println("Couldn't refresh IP:", err)
+					continue
+				}
+				if newIP == ip {
+					continue
+				}
+				log.Printf("Public IP changed from %s to %s, updating metadata", ip, newIP)
+				ip = newIP
+				for _, stop := range stopSubscriptions {
+					stop()
+				}
+				stopSubscriptions = subscribe(ip)
+			case <-ctx.Done():
+				for _, stop := range stopSubscriptions {
+					stop()
+				}
+				Close(listener)
+				Close(udpConn)
+				return
+			}
+		}
+	}()
+
 	return nil
 }
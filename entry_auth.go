@@ -0,0 +1,179 @@
+package tuna
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/crypto/ed25519"
+	"github.com/nknorg/nkn/v2/util"
+	"github.com/nknorg/tuna/pb"
+)
+
+const (
+	maxEntryAuthSize = 1024
+	entryAuthPrefix  = "tuna-entry-auth:"
+)
+
+// entryFilter decides which entries can connect to exit by their public keys.
+// Entries in denied are always rejected, and if allowed is not empty, only
+// entries in it are accepted.
+type entryFilter struct {
+	allowed map[string]struct{}
+	denied  map[string]struct{}
+}
+
+// newEntryFilter creates an entry filter from hex encoded public keys, or
+// returns nil if both lists are empty.
+func newEntryFilter(allowed, denied []string) (*entryFilter, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	f := &entryFilter{}
+	var err error
+	f.allowed, err = parsePublicKeys(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowedEntries: %v", err)
+	}
+	f.denied, err = parsePublicKeys(denied)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deniedEntries: %v", err)
+	}
+	return f, nil
+}
+
+func parsePublicKeys(publicKeys []string) (map[string]struct{}, error) {
+	m := make(map[string]struct{}, len(publicKeys))
+	for _, s := range publicKeys {
+		// NKN address like identifier.publickey is also accepted
+		if i := strings.LastIndex(s, "."); i >= 0 {
+			s = s[i+1:]
+		}
+		pk, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("decode public key %s: %v", s, err)
+		}
+		if len(pk) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key size %d of %s", len(pk), s)
+		}
+		m[string(pk)] = struct{}{}
+	}
+	return m, nil
+}
+
+// check returns ErrEntryNotAllowed if entry with publicKey is not allowed.
+func (f *entryFilter) check(publicKey []byte) error {
+	if _, ok := f.denied[string(publicKey)]; ok {
+		return fmt.Errorf("%w: %x is denied", ErrEntryNotAllowed, publicKey)
+	}
+	if len(f.allowed) > 0 {
+		if _, ok := f.allowed[string(publicKey)]; !ok {
+			return fmt.Errorf("%w: %x is not allowed", ErrEntryNotAllowed, publicKey)
+		}
+	}
+	return nil
+}
+
+// newConnNonce returns a random connection nonce, which is also signed by
+// entry to authenticate itself.
+func newConnNonce() []byte {
+	return util.RandomBytes(connNonceSize)
+}
+
+func entryAuthData(nonce []byte) []byte {
+	return append([]byte(entryAuthPrefix), nonce...)
+}
+
+// requestEntryAuth proves to server that entry owns the public key it sent in
+// connection metadata by signing nonce chosen by server, and waits for server
+// to accept it. ErrEntryNotAllowed is returned if server rejects the entry.
+func requestEntryAuth(conn net.Conn, wallet *nkn.Wallet, nonce []byte) error {
+	err := conn.SetDeadline(time.Now().Add(serviceHandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	signature, err := ed25519.Sign(ed25519.GetPrivateKeyFromSeed(wallet.Seed()), entryAuthData(nonce))
+	if err != nil {
+		return err
+	}
+
+	b, err := proto.Marshal(&pb.EntryAuthRequest{
+		Signature: signature,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarBytes(conn, b)
+	if err != nil {
+		return err
+	}
+
+	b, err = ReadVarBytes(conn, maxEntryAuthSize)
+	if err != nil {
+		return err
+	}
+
+	resp := &pb.EntryAuthResponse{}
+	err = proto.Unmarshal(b, resp)
+	if err != nil {
+		return err
+	}
+
+	if !resp.Accepted {
+		return fmt.Errorf("%w: %s", ErrEntryNotAllowed, resp.Error)
+	}
+
+	return nil
+}
+
+// handleEntryAuth reads the signature of nonce from conn, verifies it with
+// publicKey of entry, checks the entry with f and writes the result back.
+func handleEntryAuth(conn net.Conn, publicKey, nonce []byte, f *entryFilter) error {
+	err := conn.SetDeadline(time.Now().Add(serviceHandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	b, err := ReadVarBytes(conn, maxEntryAuthSize)
+	if err != nil {
+		return err
+	}
+
+	req := &pb.EntryAuthRequest{}
+	err = proto.Unmarshal(b, req)
+	if err != nil {
+		return err
+	}
+
+	resp := &pb.EntryAuthResponse{Accepted: true}
+	checkErr := ed25519.Verify(publicKey, entryAuthData(nonce), req.Signature)
+	if checkErr != nil {
+		checkErr = fmt.Errorf("%w: %v", ErrEntryNotAllowed, checkErr)
+	} else {
+		checkErr = f.check(publicKey)
+	}
+	if checkErr != nil {
+		resp.Accepted = false
+		resp.Error = checkErr.Error()
+	}
+
+	b, err = proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarBytes(conn, b)
+	if err != nil {
+		return err
+	}
+
+	return checkErr
+}
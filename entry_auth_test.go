@@ -0,0 +1,116 @@
+package tuna
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestEntryAuth(t *testing.T) {
+	wallet := newTestWallet(t)
+	publicKey := hex.EncodeToString(wallet.PubKey())
+	other := hex.EncodeToString(newTestWallet(t).PubKey())
+
+	cases := []struct {
+		name      string
+		allowed   []string
+		denied    []string
+		badNonce  bool
+		expectErr bool
+	}{
+		{name: "allowed", allowed: []string{publicKey}},
+		{name: "denied", allowed: []string{publicKey}, denied: []string{publicKey}, expectErr: true},
+		{name: "not in allowlist", allowed: []string{other}, expectErr: true},
+		{name: "wrong nonce", allowed: []string{publicKey}, badNonce: true, expectErr: true},
+	}
+	for _, c := range cases {
+		f, err := newEntryFilter(c.allowed, c.denied)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nonce := newConnNonce()
+		signedNonce := nonce
+		if c.badNonce {
+			signedNonce = newConnNonce()
+		}
+
+		entryConn, exitConn := net.Pipe()
+		entryErr := make(chan error, 1)
+		go func() {
+			entryErr <- requestEntryAuth(entryConn, wallet, signedNonce)
+		}()
+		exitErr := handleEntryAuth(exitConn, wallet.PubKey(), nonce, f)
+		err = <-entryErr
+		entryConn.Close()
+		exitConn.Close()
+
+		if !c.expectErr {
+			if exitErr != nil || err != nil {
+				t.Fatalf("%s: expect entry to be accepted, got %v and %v", c.name, exitErr, err)
+			}
+			continue
+		}
+		if !errors.Is(exitErr, ErrEntryNotAllowed) || !errors.Is(err, ErrEntryNotAllowed) {
+			t.Fatalf("%s: expect ErrEntryNotAllowed on both sides, got %v and %v", c.name, exitErr, err)
+		}
+	}
+}
+
+func TestEntryAuthBeforeMeasurement(t *testing.T) {
+	exitWallet := newTestWallet(t)
+	te, err := NewTunaExit([]Service{{Name: "test", TCP: []uint32{80}}}, exitWallet, &ExitConfiguration{
+		Services:       map[string]ExitServiceInfo{"test": {Address: "127.0.0.1", Price: "0"}},
+		AllowedEntries: []string{hex.EncodeToString(newTestWallet(t).PubKey())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entryWallet := newTestWallet(t)
+	c, err := NewEntryCommon(&Service{Name: "test"}, nil, entryWallet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	exitErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			exitErr <- err
+			return
+		}
+		exitErr <- te.ServeConn(conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encryptedConn, remoteConnMetadata, err := c.wrapConn(conn, exitWallet.PubKey(), &pb.ConnectionMetadata{
+		IsMeasurement:            true,
+		MeasurementBytesDownlink: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remoteConnMetadata.EntryAuth {
+		t.Fatal("expect exit to require entry auth")
+	}
+	err = requestEntryAuth(encryptedConn, entryWallet, remoteConnMetadata.Nonce)
+	if !errors.Is(err, ErrEntryNotAllowed) {
+		t.Fatalf("expect measurement from entry not allowed to be rejected, got %v", err)
+	}
+	if err := <-exitErr; !errors.Is(err, ErrEntryNotAllowed) {
+		t.Fatalf("expect exit to reject entry before measurement, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package tuna
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+func TestWriteReverseUDPStopsOnClose(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	addr := server.LocalAddr().(*net.UDPAddr)
+	demux := newUDPDemux(0)
+	udpCloseChan := make(chan struct{})
+	stopped := make(chan struct{}, 2)
+	writeChans := make([]chan []byte, 2)
+	for i := range writeChans {
+		writeChans[i] = make(chan []byte)
+		go func(udpWriteChan chan []byte) {
+			writeReverseUDP(udpConn, addr, demux, make(chan []byte), udpWriteChan, udpCloseChan, make(chan struct{}))
+			stopped <- struct{}{}
+		}(writeChans[i])
+	}
+
+	// both flows are forwarding before shutdown
+	buf := make([]byte, 64)
+	for i, c := range writeChans {
+		c <- append(PortToConnID(uint16(1000+i)), 0, 0, byte(i))
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != udpHeaderSize+1 || buf[udpHeaderSize] != byte(i) {
+			t.Fatalf("unexpected datagram %v of flow %d", buf[:n], i)
+		}
+	}
+
+	close(udpCloseChan)
+	for range writeChans {
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("expect both UDP writers to stop on shutdown")
+		}
+	}
+}
+
+func TestUDPOverTCPRoundTrip(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	echoPort := uint32(echo.LocalAddr().(*net.UDPAddr).Port)
+
+	te, err := NewTunaExit([]Service{{Name: "udp", UDP: []uint32{echoPort}}}, newTestWallet(t), &ExitConfiguration{
+		Services: map[string]ExitServiceInfo{"udp": {Address: "127.0.0.1", Price: "0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.PaymentScheme = &fakePaymentScheme{beneficiaries: make(chan string, 1), claims: make(chan []byte, 1)}
+
+	entryConn, exitConn := net.Pipe()
+	exitSession, err := smux.Server(exitConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entrySession, err := smux.Client(entryConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go te.handleSession(exitSession, "")
+
+	entry, err := NewTunaEntry(Service{Name: "udp", UDP: []uint32{0}}, ServiceInfo{}, newTestWallet(t), &EntryConfiguration{UDPOverTCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	entry.SetMetadata(&pb.ServiceMetadata{})
+	entry.SetSession(entrySession)
+	entry.SetConnected(true)
+
+	ports, err := entry.listenUDP(net.IPv4(127, 0, 0, 1), entry.Service.UDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(ports[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("expect echoed ping, got %q", buf[:n])
+	}
+}
+
+// serveExitSession serves a session of exit over an in-memory connection, and
+// returns the entry side of the connection.
+func serveExitSession(t *testing.T, te *TunaExit) net.Conn {
+	entryConn, exitConn := net.Pipe()
+	exitSession, err := smux.Server(exitConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go te.handleSession(exitSession, "")
+	return entryConn
+}
+
+func TestOpenStreamRebuildsSession(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	echoPort := uint32(echo.Addr().(*net.TCPAddr).Port)
+
+	te, err := NewTunaExit([]Service{{Name: "echo", TCP: []uint32{echoPort}}}, newTestWallet(t), &ExitConfiguration{
+		Services: map[string]ExitServiceInfo{"echo": {Address: "127.0.0.1", Price: "0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each session to exit creates a claimer
+	te.PaymentScheme = &fakePaymentScheme{beneficiaries: make(chan string, 2), claims: make(chan []byte, 1)}
+
+	entry, err := NewTunaEntry(Service{Name: "echo", TCP: []uint32{0}}, ServiceInfo{}, newTestWallet(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	entry.SetMetadata(&pb.ServiceMetadata{})
+
+	oldConn := serveExitSession(t, te)
+	oldSession, err := smux.Client(oldConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.SetSession(oldSession)
+	// connected entry reuses server connection when rebuilding session
+	entry.SetServerTCPConn(serveExitSession(t, te))
+	entry.SetConnected(true)
+
+	// session is not closed yet when its connection is gone, so the first
+	// attempt to open stream fails and session is rebuilt
+	oldConn.Close()
+	stream, _, err := entry.openServiceStream(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if !oldSession.IsClosed() {
+		t.Fatal("expect old session to be closed")
+	}
+	if entry.Session() == oldSession {
+		t.Fatal("expect session to be rebuilt")
+	}
+
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("expect echoed ping, got %q", buf)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tuna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tuna.sock")
+
+	// socket file is left behind as if the previous run crashed
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
+
+func TestListenUnixRegularFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tuna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tuna.sock")
+
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := listenUnix(path); err == nil {
+		listener.Close()
+		t.Fatal("expect listening on regular file to fail")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data" {
+		t.Fatalf("expect regular file to be kept, got %q", b)
+	}
+}
+
+func TestListenTCPUnixPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tuna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tuna.sock")
+
+	// each upstream service port replies its name
+	names := []string{"a", "b", "c"}
+	ports := make([]uint32, len(names))
+	for i, name := range names {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func(name string) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name))
+				conn.Close()
+			}
+		}(name)
+		ports[i] = uint32(listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	te, err := NewTunaExit([]Service{{Name: "test", TCP: ports}}, newTestWallet(t), &ExitConfiguration{
+		Services: map[string]ExitServiceInfo{"test": {Address: "127.0.0.1", Price: "0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.PaymentScheme = &fakePaymentScheme{beneficiaries: make(chan string, 1), claims: make(chan []byte, 1)}
+
+	entry, err := NewTunaEntry(Service{Name: "test", TCP: make([]uint32, len(ports))}, ServiceInfo{}, newTestWallet(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	entry.SetMetadata(&pb.ServiceMetadata{})
+	session, err := smux.Client(serveExitSession(t, te), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.SetSession(session)
+	entry.SetConnected(true)
+
+	// the first slot is empty and the last port has no slot, so only the
+	// second port listens on unix socket
+	assigned, err := entry.listenTCP(net.IPv4(127, 0, 0, 1), entry.Service.TCP, []string{"", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assigned) != 2 {
+		t.Fatalf("expect 2 TCP ports assigned, got %v", assigned)
+	}
+
+	for i, addr := range []struct{ network, address string }{
+		{"tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(assigned[0])))},
+		{"unix", path},
+		{"tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(assigned[1])))},
+	} {
+		conn, err := net.Dial(addr.network, addr.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != names[i] {
+			t.Fatalf("expect %s %s to reach port %d of service, got %q", addr.network, addr.address, i, b)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package tuna
+
+import "errors"
+
+// Error definitions.
+var (
+	ErrUnsupportedMetadataVersion = errors.New("unsupported service metadata version")
+	ErrInsufficientServers        = errors.New("insufficient service providers")
+	ErrNoServiceProviders         = errors.New("there is no service providers")
+	ErrNoAllowedServiceProviders  = errors.New("none of the NKN address whitelist can provide service")
+	ErrPriceTooHigh               = errors.New("service price too high")
+	ErrInvalidMetadata            = errors.New("invalid service metadata")
+	ErrClosed                     = errors.New("tuna is closed")
+	ErrConnectTimeout             = errors.New("connect to server timeout")
+	ErrServerNotSubscribed        = errors.New("server is not subscribed")
+	ErrSpendLimitReached          = errors.New("max total spend reached")
+	ErrServiceNotProvided         = errors.New("service is not provided by server")
+	ErrMetadataTooLarge           = errors.New("service metadata is too large")
+	ErrPayerLimitReached          = errors.New("payer limit reached")
+	ErrSubscribeLimitReached      = errors.New("max subscribe attempts reached")
+	ErrSubscriptionFeeTooLow      = errors.New("subscription fee too low")
+	ErrEntryNotAllowed            = errors.New("entry is not allowed by server")
+)
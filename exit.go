@@ -1,12 +1,17 @@
 package tuna
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,13 +20,20 @@ import (
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/util"
 	"github.com/patrickmn/go-cache"
-	"github.com/rdegges/go-ipify"
 	"github.com/xtaci/smux"
 )
 
 type ExitServiceInfo struct {
-	Address string `json:"address"`
-	Price   string `json:"price"`
+	Address              string                `json:"address"`
+	Price                string                `json:"price"`
+	BeneficiaryAddr      string                `json:"beneficiaryAddr"`
+	AllowDynamicUpstream bool                  `json:"allowDynamicUpstream"`
+	AllowedUpstreams     []string              `json:"allowedUpstreams"`
+	Tags                 map[string]string     `json:"tags"`
+	ReverseServiceName   string                `json:"reverseServiceName"`
+	ReverseMaxPrice      string                `json:"reverseMaxPrice"`
+	Topic                string                `json:"topic"`
+	TLS                  *ExitTLSConfiguration `json:"tls"`
 }
 
 type TunaExit struct {
@@ -33,15 +45,28 @@ type TunaExit struct {
 	reverseBytesExitToEntryPaid uint64
 
 	*Common
-	OnConnect   *OnConnect // override Common.OnConnect
-	config      *ExitConfiguration
-	services    []Service
-	serviceConn *cache.Cache
-	tcpListener net.Listener
-	udpConn     *net.UDPConn
-	reverseIP   net.IP
-	reverseTCP  []uint32
-	reverseUDP  []uint32
+	OnConnect    *OnConnect // override Common.OnConnect
+	config       *ExitConfiguration
+	services     []Service
+	serviceConn  *cache.Cache
+	tlsConfigs   map[string]*tls.Config
+	pool         *upstreamPool
+	payerLimits  *payerLimits
+	entryFilter  *entryFilter
+	tcpListener  net.Listener
+	quicListener net.Listener
+	udpConn      *net.UDPConn
+	reverseIP    net.IP
+	reverseTCP   []uint32
+	reverseUDP   []uint32
+
+	isDraining        bool
+	stopSubscriptions []func()
+
+	serviceBytesLock   sync.Mutex
+	activeServiceBytes map[*serviceBytes]struct{}
+	closedServiceBytes *serviceBytes
+	pendingTraffic     map[trafficKey]*TrafficRecord
 }
 
 func NewTunaExit(services []Service, wallet *nkn.Wallet, config *ExitConfiguration) (*TunaExit, error) {
@@ -61,13 +86,29 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, config *ExitConfigurati
 
 		subscriptionPrefix = config.ReverseSubscriptionPrefix
 
+		// each service can be exposed by a different kind of reverse entry at
+		// a different price when running multiple reverse exits in one process
+		reverseServiceName := config.ReverseServiceName
+		reverseMaxPrice := config.ReverseMaxPrice
+		if exitServiceInfo, ok := config.Services[services[0].Name]; ok {
+			if len(exitServiceInfo.ReverseServiceName) > 0 {
+				reverseServiceName = exitServiceInfo.ReverseServiceName
+			}
+			if len(exitServiceInfo.ReverseMaxPrice) > 0 {
+				reverseMaxPrice = exitServiceInfo.ReverseMaxPrice
+			}
+		}
+
 		service = &Service{
-			Name:       config.ReverseServiceName,
+			Name:       reverseServiceName,
 			Encryption: services[0].Encryption,
 		}
+		if len(service.Encryption) == 0 {
+			service.Encryption = config.ReverseEncryption
+		}
 
 		serviceInfo = &ServiceInfo{
-			MaxPrice: config.ReverseMaxPrice,
+			MaxPrice: reverseMaxPrice,
 			IPFilter: &config.ReverseIPFilter,
 		}
 
@@ -82,7 +123,7 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, config *ExitConfigurati
 		service,
 		serviceInfo,
 		wallet,
-		config.DialTimeout,
+		time.Duration(config.DialTimeout),
 		subscriptionPrefix,
 		config.Reverse,
 		!config.Reverse,
@@ -102,17 +143,101 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, config *ExitConfigurati
 		return nil, err
 	}
 
+	if config.Reverse {
+		err = verifySelectionStrategy(config.ReverseServerSelectionStrategy)
+		if err != nil {
+			return nil, err
+		}
+		c.SelectionStrategy = config.ReverseServerSelectionStrategy
+		c.AllowSelfConnect = config.ReverseAllowSelfConnect
+	}
+
+	c.Compression = config.Compression
+	c.WriteTimeout = time.Duration(config.WriteTimeout)
+
+	c.PaymentScheme, err = NewPaymentScheme(config.PaymentScheme, wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.NanoPayUpdateInterval > 0 {
+		c.NanoPayUpdateInterval = time.Duration(config.NanoPayUpdateInterval) * time.Second
+	}
+
+	tlsConfigs := make(map[string]*tls.Config)
+	for serviceName, serviceInfo := range config.Services {
+		if len(serviceInfo.BeneficiaryAddr) > 0 {
+			if _, err := common.ToScriptHash(serviceInfo.BeneficiaryAddr); err != nil {
+				return nil, fmt.Errorf("invalid beneficiary address %s of service %s: %v", serviceInfo.BeneficiaryAddr, serviceName, err)
+			}
+		}
+		if serviceInfo.AllowDynamicUpstream && len(serviceInfo.AllowedUpstreams) == 0 {
+			return nil, fmt.Errorf("service %s allows dynamic upstream but allowedUpstreams is empty", serviceName)
+		}
+		if serviceInfo.TLS == nil {
+			continue
+		}
+		tlsConfigs[serviceName], err = serviceInfo.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config of service %s: %v", serviceName, err)
+		}
+	}
+
 	te := &TunaExit{
 		Common:      c,
 		OnConnect:   NewOnConnect(1, nil),
 		config:      config,
 		services:    services,
 		serviceConn: cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+		tlsConfigs:  tlsConfigs,
+
+		activeServiceBytes: make(map[*serviceBytes]struct{}),
+		closedServiceBytes: newServiceBytes(),
+	}
+
+	if config.MaxStreamsPerPayer > 0 || config.MaxBandwidthPerPayer > 0 {
+		te.payerLimits = newPayerLimits(config.MaxStreamsPerPayer, config.MaxBandwidthPerPayer)
+	}
+
+	te.entryFilter, err = newEntryFilter(config.AllowedEntries, config.DeniedEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	// payer is derived from the public key claimed by entry, which is only
+	// proven by encryption or entry auth, otherwise anyone could use up the
+	// limits of another payer
+	if te.payerLimits != nil && !config.RequireEncryption && te.entryFilter == nil {
+		return nil, errors.New("maxStreamsPerPayer and maxBandwidthPerPayer require requireEncryption, allowedEntries or deniedEntries")
+	}
+
+	if config.ListenQUIC < 0 {
+		return nil, fmt.Errorf("listenQUIC should not be negative, got %d", config.ListenQUIC)
+	}
+	if config.ListenQUIC > 0 && config.ListenQUIC == config.ListenUDP {
+		return nil, errors.New("listenQUIC and listenUDP should be different ports")
+	}
+
+	if config.UpstreamPoolSize > 0 {
+		te.pool = newUpstreamPool(int(config.UpstreamPoolSize), time.Duration(config.UpstreamPoolIdleTimeout)*time.Second)
+		go te.pool.reapIdle(te.closeChan)
 	}
 
 	return te, nil
 }
 
+// isUpstreamAllowed returns whether addr matches any of patterns, which are
+// host:port in path.Match syntax like "*.example.com:443" or "10.0.0.*:*".
+// Empty patterns allow no upstream, so that exit is not an open proxy.
+func isUpstreamAllowed(addr string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, addr); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (te *TunaExit) getServiceID(serviceName string) (byte, error) {
 	for i, service := range te.services {
 		if service.Name == serviceName {
@@ -123,24 +248,24 @@ func (te *TunaExit) getServiceID(serviceName string) (byte, error) {
 	return 0, errors.New("Service " + serviceName + " not found")
 }
 
-func (te *TunaExit) handleSession(session *smux.Session) {
-	bytesEntryToExit := make([]uint64, 256)
-	bytesExitToEntry := make([]uint64, 256)
+func (te *TunaExit) handleSession(session *smux.Session, payer string) {
+	sessionBytes := te.addServiceBytes(payer)
+	defer te.removeServiceBytes(sessionBytes)
+	bytesEntryToExit := sessionBytes.entryToExit
+	bytesExitToEntry := sessionBytes.exitToEntry
 
-	var npc *nkn.NanoPayClaimer
+	var npc PaymentClaimer
 	var lastPaymentAmount, bytesPaid common.Fixed64
-	var err error
 	claimInterval := time.Duration(te.config.ClaimInterval) * time.Second
 	onErr := nkn.NewOnError(1, nil)
 	lastPaymentTime := time.Now()
-	isClosed := false
 
 	getTotalCost := func() (common.Fixed64, common.Fixed64) {
 		cost := common.Fixed64(0)
 		totalBytes := common.Fixed64(0)
 		for i := range bytesEntryToExit {
-			entryToExit := common.Fixed64(atomic.LoadUint64(&bytesEntryToExit[i]))
-			exitToEntry := common.Fixed64(atomic.LoadUint64(&bytesExitToEntry[i]))
+			entryToExit := atomic.LoadUint64(&bytesEntryToExit[i])
+			exitToEntry := atomic.LoadUint64(&bytesExitToEntry[i])
 			if entryToExit == 0 && exitToEntry == 0 {
 				continue
 			}
@@ -149,29 +274,81 @@ func (te *TunaExit) handleSession(session *smux.Session) {
 				continue
 			}
 			serviceInfo := te.config.Services[service.Name]
-			entryToExitPrice, exitToEntryPrice, err := ParsePrice(serviceInfo.Price)
+			price, err := ParsePrice(serviceInfo.Price)
 			if err != nil {
 				continue
 			}
-			cost += entryToExitPrice*entryToExit/TrafficUnit + exitToEntryPrice*exitToEntry/TrafficUnit
-			totalBytes += entryToExit + exitToEntry
+			cost += price.Cost(entryToExit, exitToEntry)
+			totalBytes += common.Fixed64(entryToExit + exitToEntry)
 		}
 		return cost, totalBytes
 	}
 
-	if !te.config.Reverse {
-		npc, err = te.Wallet.NewNanoPayClaimer(te.config.BeneficiaryAddr, int32(claimInterval/time.Millisecond), te.config.MinFlushAmount, onErr)
+	// An entry pays the beneficiary of the service it selected, so when
+	// services have different beneficiaries the claimer is created once the
+	// service of the session is known from its first stream. claimerReady is
+	// closed once the claimer is started, or is known not to be needed.
+	var npcLock sync.Mutex
+	claimerStarted := false
+	var claimerErr error
+	claimerReady := make(chan struct{})
+	sessionClosed := make(chan struct{})
+	startClaimer := func(beneficiaryAddr string) error {
+		npcLock.Lock()
+		defer npcLock.Unlock()
+		if claimerStarted {
+			return claimerErr
+		}
+		claimerStarted = true
+		defer close(claimerReady)
+		if te.config.Reverse {
+			return nil
+		}
+
+		claimer, err := te.PaymentScheme.NewClaimer(beneficiaryAddr, claimInterval, te.config.MinFlushAmount, onErr)
 		if err != nil {
-			log.Fatalln(err)
+			Close(session)
+			claimerErr = fmt.Errorf("create payment claimer error: %v", err)
+			return claimerErr
 		}
+		npc = claimer
+
+		if npc != nil {
+			go checkPaymentClaim(session, npc, onErr, sessionClosed)
 
-		defer npc.Close()
+			go checkPayment(session, te.NanoPayUpdateInterval, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, sessionClosed, getTotalCost)
+		}
+		return nil
+	}
+	getClaimer := func() PaymentClaimer {
+		npcLock.Lock()
+		defer npcLock.Unlock()
+		return npc
+	}
+	defer func() {
+		if npc := getClaimer(); npc != nil {
+			npc.Close()
+		}
+	}()
 
-		go checkNanoPayClaim(session, npc, onErr, &isClosed)
+	if !te.hasServiceBeneficiary() {
+		if err := startClaimer(te.config.BeneficiaryAddr); err != nil {
+			log.Println(err)
+			close(sessionClosed)
+			return
+		}
+	}
 
-		go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
+	var payerUsage *payerLimit
+	var payerStreams *streamLimiter
+	if te.payerLimits != nil && len(payer) > 0 {
+		payerUsage = te.payerLimits.addSession(payer, sessionBytes)
+		defer te.payerLimits.removeSession(payer, sessionBytes)
+		payerStreams = payerUsage.streams
 	}
 
+	streamLimiter := newStreamLimiter(te.config.MaxConcurrentStreams)
+
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
@@ -188,7 +365,48 @@ func (te *TunaExit) handleSession(session *smux.Session) {
 				}
 
 				if streamMetadata.IsPayment {
-					return handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+					// entry opens payment stream as soon as session is created,
+					// which can be before its first service stream starts the
+					// claimer
+					select {
+					case <-claimerReady:
+					case <-sessionClosed:
+						return nil
+					}
+					return handlePaymentStream(stream, getClaimer(), &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+				}
+
+				if streamMetadata.IsHealthCheck {
+					return handleHealthCheckStream(stream)
+				}
+
+				if te.IsDraining() {
+					return errors.New("exit is draining, reject stream")
+				}
+
+				if streamMetadata.Compression && !te.Compression {
+					return errors.New("stream compression is not enabled")
+				}
+
+				if !streamLimiter.acquire() {
+					return fmt.Errorf("max concurrent streams %d reached, reject stream", te.config.MaxConcurrentStreams)
+				}
+				piped := false
+				defer func() {
+					if !piped {
+						streamLimiter.release()
+					}
+				}()
+
+				if payerUsage != nil {
+					if err := te.payerLimits.acquire(payerUsage); err != nil {
+						return fmt.Errorf("payer %s: %w, reject stream", payer, err)
+					}
+					defer func() {
+						if !piped {
+							payerStreams.release()
+						}
+					}()
 				}
 
 				serviceID := byte(streamMetadata.ServiceId)
@@ -198,36 +416,74 @@ func (te *TunaExit) handleSession(session *smux.Session) {
 				if err != nil {
 					return err
 				}
-				tcpPortsCount := len(service.TCP)
-				udpPortsCount := len(service.UDP)
+				serviceInfo := te.config.Services[service.Name]
+				if err := startClaimer(te.beneficiaryAddr(serviceInfo)); err != nil {
+					return err
+				}
+
+				// stream slots are released when it returns since piped is
+				// false
+				if streamMetadata.IsUdp {
+					if te.config.Reverse {
+						return te.handleUDPStream(stream, serviceID, &te.reverseBytesEntryToExit, &te.reverseBytesExitToEntry)
+					}
+					return te.handleUDPStream(stream, serviceID, &bytesEntryToExit[serviceID], &bytesExitToEntry[serviceID])
+				}
+
 				var protocol string
-				var port int
-				if portID < tcpPortsCount {
+				var host string
+				var tlsConfig *tls.Config
+				pooled := false
+				if len(streamMetadata.DestAddr) > 0 {
+					if !serviceInfo.AllowDynamicUpstream {
+						return fmt.Errorf("service %s does not allow dynamic upstream", service.Name)
+					}
+					if !isUpstreamAllowed(streamMetadata.DestAddr, serviceInfo.AllowedUpstreams) {
+						return fmt.Errorf("upstream %s is not allowed by service %s", streamMetadata.DestAddr, service.Name)
+					}
 					protocol = tcp
-					port = int(service.TCP[portID])
-				} else if portID-tcpPortsCount < udpPortsCount {
-					protocol = udp
-					portID -= tcpPortsCount
-					port = int(service.UDP[portID])
+					host = streamMetadata.DestAddr
 				} else {
-					return fmt.Errorf("invalid portId: %d", portID)
+					var port uint32
+					protocol, port, err = service.Port(portID)
+					if err != nil {
+						return err
+					}
+					if protocol == tcp {
+						tlsConfig = te.tlsConfigs[service.Name]
+						pooled = te.pool != nil
+					}
+					host = serviceInfo.Address + ":" + strconv.Itoa(int(port))
 				}
 
-				serviceInfo := te.config.Services[service.Name]
-				host := serviceInfo.Address + ":" + strconv.Itoa(port)
+				dial := func() (net.Conn, error) {
+					if tlsConfig != nil {
+						dialer := &net.Dialer{Timeout: time.Duration(te.config.DialTimeout)}
+						return tls.DialWithDialer(dialer, protocol, host, tlsConfig)
+					}
+					return net.DialTimeout(protocol, host, time.Duration(te.config.DialTimeout))
+				}
 
-				conn, err := net.DialTimeout(string(protocol), host, time.Duration(te.config.DialTimeout)*time.Second)
+				var conn net.Conn
+				if pooled {
+					conn, err = te.pool.get(service.Name, host, dial)
+				} else {
+					conn, err = dial()
+				}
 				if err != nil {
 					return err
 				}
 
 				if te.config.Reverse {
-					go te.pipe(conn, stream, &te.reverseBytesEntryToExit)
-					go te.pipe(stream, conn, &te.reverseBytesExitToEntry)
+					err = te.pipeStream(stream, conn, streamMetadata.Compression, &te.reverseBytesExitToEntry, &te.reverseBytesEntryToExit, streamLimiter)
 				} else {
-					go te.pipe(conn, stream, &bytesEntryToExit[serviceID])
-					go te.pipe(stream, conn, &bytesExitToEntry[serviceID])
+					err = te.pipeStream(stream, conn, streamMetadata.Compression, &bytesExitToEntry[serviceID], &bytesEntryToExit[serviceID], streamLimiter, payerStreams)
 				}
+				if err != nil {
+					Close(conn)
+					return err
+				}
+				piped = true
 
 				return nil
 			}()
@@ -239,7 +495,7 @@ func (te *TunaExit) handleSession(session *smux.Session) {
 	}
 
 	Close(session)
-	isClosed = true
+	close(sessionClosed)
 }
 
 func (te *TunaExit) listenTCP(port int) error {
@@ -251,55 +507,157 @@ func (te *TunaExit) listenTCP(port int) error {
 	te.tcpListener = listener
 
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if te.IsClosed() {
-				return
+		if err := te.Serve(listener); err != nil {
+			te.Close()
+		}
+	}()
+
+	return nil
+}
+
+// listenQUIC listens for QUIC connections from entries using TransportQUIC.
+func (te *TunaExit) listenQUIC(port int) error {
+	listener, err := ListenQUIC(net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		log.Println("Couldn't bind QUIC listener:", err)
+		return err
+	}
+	te.quicListener = listener
+
+	go func() {
+		if err := te.Serve(listener); err != nil {
+			te.Close()
+		}
+	}()
+
+	return nil
+}
+
+// Serve accepts connections from entries on listener, e.g. one returned by
+// ListenQUIC, and serves each of them by ServeConn. It returns nil when exit
+// is closed, or error when listener is closed.
+func (te *TunaExit) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if te.IsClosed() {
+			return nil
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return err
 			}
+			log.Println("Couldn't accept client connection:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if te.IsDraining() {
+			Close(conn)
+			continue
+		}
+
+		go func() {
+			err := te.ServeConn(conn)
 			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					te.Close()
-					return
-				}
-				log.Println("Couldn't accept client connection:", err)
-				time.Sleep(time.Second)
-				continue
+				log.Println(err)
 			}
+		}()
+	}
+}
 
-			go func() {
-				err := func() error {
-					defer Close(conn)
-
-					encryptedConn, connMetadata, err := te.wrapConn(conn, nil, nil)
-					if err != nil {
-						return err
-					}
+// ServeConn completes handshake with the entry connected by conn and serves
+// its streams until session is closed. It is called for every connection
+// accepted by exit TCP listener, and can be used to serve entries connected
+// over another transport. Conn is closed when it returns.
+func (te *TunaExit) ServeConn(conn net.Conn) error {
+	defer Close(conn)
+
+	nonce := newConnNonce()
+	encryptedConn, connMetadata, err := te.wrapConn(conn, nil, &pb.ConnectionMetadata{
+		Nonce:            nonce,
+		ServiceHandshake: true,
+		HealthCheck:      true,
+		EntryAuth:        te.entryFilter != nil,
+	})
+	if err != nil {
+		return err
+	}
 
-					defer Close(encryptedConn)
+	defer Close(encryptedConn)
 
-					if connMetadata.IsMeasurement {
-						return util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), 0)
-					}
+	// measurement traffic is also only served to entries that are allowed
+	if te.entryFilter != nil {
+		err = handleEntryAuth(encryptedConn, connMetadata.PublicKey, nonce, te.entryFilter)
+		if err != nil {
+			return err
+		}
+	}
 
-					session, err := smux.Server(encryptedConn, nil)
-					if err != nil {
-						return err
-					}
+	if connMetadata.IsMeasurement {
+		return util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), 0)
+	}
 
-					te.handleSession(session)
+	if te.config.RequireEncryption && connMetadata.EncryptionAlgo == pb.EncryptionAlgo_ENCRYPTION_NONE {
+		return errors.New("reject unencrypted connection")
+	}
 
-					return nil
-				}()
-				if err != nil {
-					log.Println(err)
-				}
-			}()
+	if connMetadata.ServiceHandshake {
+		err = handleServiceRequest(encryptedConn, te.checkService)
+		if err != nil {
+			return err
 		}
-	}()
+	}
+
+	session, err := smux.Server(encryptedConn, te.config.SmuxConfig.smuxConfig())
+	if err != nil {
+		return err
+	}
+
+	payer, err := nkn.PubKeyToWalletAddr(connMetadata.PublicKey)
+	if err != nil {
+		log.Println("Couldn't get payer address:", err)
+	}
+
+	te.handleSession(session, payer)
 
 	return nil
 }
 
+// checkService returns error if exit does not provide the service requested
+// by entry.
+func (te *TunaExit) checkService(serviceID uint32, serviceName string) error {
+	if serviceID >= uint32(len(te.services)) {
+		return fmt.Errorf("unknown service id %d", serviceID)
+	}
+	service := te.services[serviceID]
+	if len(serviceName) > 0 && service.Name != serviceName {
+		return fmt.Errorf("service id %d is %s instead of %s", serviceID, service.Name, serviceName)
+	}
+	if _, ok := te.config.Services[service.Name]; !ok {
+		return fmt.Errorf("service %s is not provided", service.Name)
+	}
+	return nil
+}
+
+// beneficiaryAddr returns the address to receive payment for service, which
+// is BeneficiaryAddr of service if set, or of exit otherwise.
+func (te *TunaExit) beneficiaryAddr(serviceInfo ExitServiceInfo) string {
+	if len(serviceInfo.BeneficiaryAddr) > 0 {
+		return serviceInfo.BeneficiaryAddr
+	}
+	return te.config.BeneficiaryAddr
+}
+
+// hasServiceBeneficiary returns whether any service receives payment to an
+// address different from BeneficiaryAddr of exit.
+func (te *TunaExit) hasServiceBeneficiary() bool {
+	for _, serviceInfo := range te.config.Services {
+		if te.beneficiaryAddr(serviceInfo) != te.config.BeneficiaryAddr {
+			return true
+		}
+	}
+	return false
+}
+
 func (te *TunaExit) getService(serviceID byte) (*Service, error) {
 	if int(serviceID) >= len(te.services) {
 		return nil, errors.New("Wrong serviceId: " + strconv.Itoa(int(serviceID)))
@@ -307,8 +665,15 @@ func (te *TunaExit) getService(serviceID byte) (*Service, error) {
 	return &te.services[serviceID], nil
 }
 
-func (te *TunaExit) getServiceConn(addr *net.UDPAddr, connID []byte, serviceID byte, portID byte) (*net.UDPConn, error) {
-	connKey := addr.String() + ":" + strconv.Itoa(int(ConnIDToPort(connID)))
+// getServiceConn returns the UDP connection to service port of the flow
+// identified by flowKey and connID, dialing it if not exists. Data received
+// from service is prefixed with UDP header and sent back by reply.
+func (te *TunaExit) getServiceConn(flowKey string, reply func([]byte) error, connID []byte, serviceID byte, portID byte) (*net.UDPConn, error) {
+	connPort, err := ConnIDToPort(connID)
+	if err != nil {
+		return nil, err
+	}
+	connKey := flowKey + ":" + strconv.Itoa(int(connPort))
 	var conn *net.UDPConn
 	var x interface{}
 	var ok bool
@@ -341,7 +706,7 @@ func (te *TunaExit) getServiceConn(addr *net.UDPAddr, connID []byte, serviceID b
 					Close(conn)
 					break
 				}
-				_, err = te.udpConn.WriteToUDP(append(prefix, serviceBuffer[:n]...), addr)
+				err = reply(append(prefix, serviceBuffer[:n]...))
 				if err != nil {
 					log.Println("Couldn't send data to client:", err)
 					Close(conn)
@@ -379,7 +744,15 @@ func (te *TunaExit) readUDP() {
 				}
 				continue
 			}
-			serviceConn, err := te.getServiceConn(addr, clientBuffer[0:2], clientBuffer[2], clientBuffer[3])
+			if n < udpHeaderSize {
+				log.Println("Couldn't parse data from client: too short")
+				continue
+			}
+			reply := func(b []byte) error {
+				_, err := te.udpConn.WriteToUDP(b, addr)
+				return err
+			}
+			serviceConn, err := te.getServiceConn(addr.String(), reply, clientBuffer[0:connIDSize], clientBuffer[2], clientBuffer[3])
 			if err != nil {
 				continue
 			}
@@ -391,34 +764,145 @@ func (te *TunaExit) readUDP() {
 	}()
 }
 
-func (te *TunaExit) updateAllMetadata(ip string, tcpPort, udpPort uint32) error {
+// handleUDPStream forwards UDP datagrams framed by WriteVarBytes between
+// stream and service ports until stream is closed. It is used by entries with
+// UDPOverTCP enabled, which send UDP traffic through the session instead of
+// the UDP port of exit. Frames of services other than serviceID of stream are
+// dropped, since traffic is billed and paid for serviceID.
+func (te *TunaExit) handleUDPStream(stream *smux.Stream, serviceID byte, entryToExit, exitToEntry *uint64) error {
+	defer Close(stream)
+
+	// WriteVarBytes writes length and data separately, so frames from
+	// different service conns must not interleave
+	var writeLock sync.Mutex
+	reply := func(b []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		err := WriteVarBytes(stream, b)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(exitToEntry, uint64(len(b)-udpHeaderSize))
+		return nil
+	}
+	flowKey := stream.RemoteAddr().String() + "/" + strconv.FormatUint(uint64(stream.ID()), 10)
+
+	for {
+		data, err := ReadVarBytes(stream, maxUDPFrameSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("read udp frame error: %v", err)
+		}
+		if len(data) < udpHeaderSize {
+			log.Println("Couldn't parse data from client: too short")
+			continue
+		}
+		if data[2] != serviceID {
+			log.Printf("Drop UDP frame of service %d in stream of service %d", data[2], serviceID)
+			continue
+		}
+		serviceConn, err := te.getServiceConn(flowKey, reply, data[:connIDSize], serviceID, data[3])
+		if err != nil {
+			continue
+		}
+		atomic.AddUint64(entryToExit, uint64(len(data)-udpHeaderSize))
+		_, err = serviceConn.Write(data[udpHeaderSize:])
+		if err != nil {
+			log.Println("Couldn't send data to service:", err)
+		}
+	}
+}
+
+func (te *TunaExit) updateAllMetadata(ip string, tcpPort, udpPort, quicPort uint32) error {
 	for serviceName, serviceInfo := range te.config.Services {
 		serviceID, err := te.getServiceID(serviceName)
 		if err != nil {
 			return err
 		}
-		UpdateMetadata(
-			serviceName,
+		topicPrefix, topicName := te.subscriptionTopic(serviceName, serviceInfo)
+		stop := UpdateMetadata(
+			topicName,
 			serviceID,
 			nil,
 			nil,
 			ip,
 			tcpPort,
 			udpPort,
+			quicPort,
 			serviceInfo.Price,
-			te.config.BeneficiaryAddr,
-			te.config.SubscriptionPrefix,
+			te.beneficiaryAddr(serviceInfo),
+			serviceInfo.Tags,
+			topicPrefix,
 			uint32(te.config.SubscriptionDuration),
 			te.config.SubscriptionFee,
+			te.config.MaxSubscribesPerDay,
 			te.Wallet,
 			te.closeChan,
 		)
+		te.Lock()
+		te.stopSubscriptions = append(te.stopSubscriptions, stop)
+		te.Unlock()
+	}
+	return nil
+}
+
+// subscriptionTopic returns subscription prefix and name whose concatenation
+// is the topic of service, which is serviceInfo.Topic if set.
+func (te *TunaExit) subscriptionTopic(serviceName string, serviceInfo ExitServiceInfo) (string, string) {
+	if len(serviceInfo.Topic) > 0 {
+		return "", serviceInfo.Topic
+	}
+	return te.config.SubscriptionPrefix, serviceName
+}
+
+// DryRun builds and logs the metadata and topic of each service that Start
+// would subscribe with, without listening or subscribing. It returns error if
+// any of them is invalid.
+func (te *TunaExit) DryRun() error {
+	ip, err := getPublicIP(context.Background())
+	if err != nil {
+		return fmt.Errorf("couldn't get IP: %v", err)
+	}
+
+	for serviceName, serviceInfo := range te.config.Services {
+		metadataRaw, topic, err := te.buildMetadata(serviceName, serviceInfo, ip)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", serviceName, err)
+		}
+		log.Printf("Would subscribe to topic %s with metadata %s", topic, metadataRaw)
 	}
+
 	return nil
 }
 
+// buildMetadata returns the metadata and topic service subscribes with when
+// exit listens on ip.
+func (te *TunaExit) buildMetadata(serviceName string, serviceInfo ExitServiceInfo, ip string) ([]byte, string, error) {
+	serviceID, err := te.getServiceID(serviceName)
+	if err != nil {
+		return nil, "", err
+	}
+	topicPrefix, topicName := te.subscriptionTopic(serviceName, serviceInfo)
+	return BuildMetadata(
+		topicName,
+		serviceID,
+		nil,
+		nil,
+		ip,
+		uint32(te.config.ListenTCP),
+		uint32(te.config.ListenUDP),
+		uint32(te.config.ListenQUIC),
+		serviceInfo.Price,
+		te.beneficiaryAddr(serviceInfo),
+		serviceInfo.Tags,
+		topicPrefix,
+	)
+}
+
 func (te *TunaExit) Start() error {
-	ip, err := ipify.GetIp()
+	ip, err := getPublicIP(context.Background())
 	if err != nil {
 		return fmt.Errorf("couldn't get IP: %v", err)
 	}
@@ -433,7 +917,18 @@ func (te *TunaExit) Start() error {
 		return err
 	}
 
-	return te.updateAllMetadata(ip, uint32(te.config.ListenTCP), uint32(te.config.ListenUDP))
+	if te.config.ListenQUIC > 0 {
+		err = te.listenQUIC(int(te.config.ListenQUIC))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(te.config.TrafficLogPath) > 0 {
+		te.startTrafficLog(te.config.TrafficLogPath, time.Duration(te.config.TrafficLogInterval)*time.Second)
+	}
+
+	return te.updateAllMetadata(ip, uint32(te.config.ListenTCP), uint32(te.config.ListenUDP), uint32(te.config.ListenQUIC))
 }
 
 func (te *TunaExit) StartReverse(shouldReconnect bool) error {
@@ -451,12 +946,17 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 		return err
 	}
 
+	backoff := util.NewBackoff(
+		time.Duration(te.config.ReconnectBackoffMin)*time.Millisecond,
+		time.Duration(te.config.ReconnectBackoffMax)*time.Millisecond,
+	)
+
 	var tcpConn net.Conn
 	for {
 		err := te.Common.CreateServerConn(true)
 		if err != nil {
 			log.Println("Couldn't connect to reverse entry:", err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
@@ -466,20 +966,20 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			udpConn, err = te.Common.GetServerUDPConn(false)
 			if err != nil {
 				log.Println(err)
-				time.Sleep(1 * time.Second)
+				time.Sleep(backoff.Next())
 				continue
 			}
 			if udpConn != nil {
 				_, udpPortString, err := net.SplitHostPort(udpConn.LocalAddr().String())
 				if err != nil {
 					log.Println(err)
-					time.Sleep(1 * time.Second)
+					time.Sleep(backoff.Next())
 					continue
 				}
 				udpPort, err = strconv.Atoi(udpPortString)
 				if err != nil {
 					log.Println(err)
-					time.Sleep(1 * time.Second)
+					time.Sleep(backoff.Next())
 					continue
 				}
 			}
@@ -502,56 +1002,51 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			"",
 			0,
 			uint32(udpPort),
+			0,
 			"",
 			te.config.BeneficiaryAddr,
+			nil,
 		)
 
 		tcpConn, err = te.Common.GetServerTCPConn(false)
 		if err != nil {
 			log.Println(err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
-		session, err := smux.Client(tcpConn, nil)
+		session, err := smux.Client(tcpConn, te.config.SmuxConfig.smuxConfig())
 		if err != nil {
 			log.Println(err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
 		stream, err := session.OpenStream()
 		if err != nil {
 			log.Println("Couldn't open stream to reverse entry:", err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
 		err = WriteVarBytes(stream, serviceMetadata)
 		if err != nil {
 			log.Println("Couldn't send metadata to reverse entry:", err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
-		buf, err := ReadVarBytes(stream, maxServiceMetadataSize)
+		reverseMetadata, err := te.readMetadataFromStream(stream)
 		if err != nil {
 			log.Println("Couldn't read reverse metadata:", err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-
-		reverseMetadata, err := ReadMetadata(string(buf))
-		if err != nil {
-			log.Println("Couldn't unmarshal metadata:", err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
 		paymentStream, err := openPaymentStream(session)
 		if err != nil {
 			log.Println("Couldn't open payment stream:", err)
-			time.Sleep(1 * time.Second)
+			time.Sleep(backoff.Next())
 			continue
 		}
 
@@ -566,6 +1061,8 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 		te.OnConnect.receive()
 		te.RUnlock()
 
+		backoff.Reset()
+
 		if udpConn != nil {
 			te.udpConn = udpConn
 			te.readUDP()
@@ -582,7 +1079,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			getPaymentStream,
 		)
 
-		te.handleSession(session)
+		te.handleSession(session, "")
 
 		Close(tcpConn)
 
@@ -595,7 +1092,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			if !ok {
 				return nil
 			}
-		default:
+		case <-time.After(backoff.Next()):
 		}
 	}
 
@@ -617,6 +1114,10 @@ func (te *TunaExit) GetReverseUDPPorts() []uint32 {
 func (te *TunaExit) Close() {
 	te.WaitSessions()
 
+	if err := te.closeAllChannels(); err != nil {
+		log.Println(err)
+	}
+
 	te.Lock()
 	defer te.Unlock()
 
@@ -626,13 +1127,73 @@ func (te *TunaExit) Close() {
 
 	te.isClosed = true
 	close(te.closeChan)
+	if te.pool != nil {
+		te.pool.close()
+	}
 	Close(te.tcpListener)
+	Close(te.quicListener)
 	Close(te.udpConn)
 	Close(te.Common.tcpConn)
 	Close(te.Common.udpConn)
 	te.OnConnect.close()
 }
 
+// Status returns the current connection status. Traffic counters are only
+// available in reverse mode.
+func (te *TunaExit) Status() *ConnectionStatus {
+	status := te.Common.Status()
+	if te.config.Reverse {
+		status.BytesEntryToExit = atomic.LoadUint64(&te.reverseBytesEntryToExit)
+		status.BytesExitToEntry = atomic.LoadUint64(&te.reverseBytesExitToEntry)
+	}
+	return status
+}
+
+// Drain stops accepting new connections and streams and stops renewing
+// service subscriptions, so that entries will select other exits once the
+// existing subscriptions expire. Payment of existing sessions is still
+// processed. It returns after all active streams are finished, or an error if
+// they are not finished within timeout. Timeout <= 0 means waiting forever.
+// Close should be called afterwards.
+func (te *TunaExit) Drain(timeout time.Duration) error {
+	te.Lock()
+	te.isDraining = true
+	stopSubscriptions := te.stopSubscriptions
+	te.stopSubscriptions = nil
+	te.Unlock()
+
+	for _, stop := range stopSubscriptions {
+		stop()
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		n := atomic.LoadInt32(&te.activeStreams)
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("drain timeout with %d active streams", n)
+		case <-te.closeChan:
+			return ErrClosed
+		}
+	}
+}
+
+func (te *TunaExit) IsDraining() bool {
+	te.RLock()
+	defer te.RUnlock()
+	return te.isDraining
+}
+
 func (te *TunaExit) IsClosed() bool {
 	te.RLock()
 	defer te.RUnlock()
@@ -0,0 +1,149 @@
+package tuna
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+type fakePaymentScheme struct {
+	beneficiaries chan string
+	claims        chan []byte
+}
+
+func (s *fakePaymentScheme) OpenChannel(recipient, fee string) (PaymentChannel, error) {
+	return nil, nil
+}
+
+func (s *fakePaymentScheme) NewClaimer(beneficiaryAddr string, claimInterval time.Duration, minFlushAmount string, onErr *nkn.OnError) (PaymentClaimer, error) {
+	s.beneficiaries <- beneficiaryAddr
+	return &fakePaymentClaimer{claims: s.claims}, nil
+}
+
+type fakePaymentClaimer struct {
+	claims chan []byte
+}
+
+func (c *fakePaymentClaimer) Claim(data []byte) (common.Fixed64, error) {
+	c.claims <- data
+	return 0, nil
+}
+
+func (c *fakePaymentClaimer) IsClosed() bool {
+	return false
+}
+
+func (c *fakePaymentClaimer) Close() error {
+	return nil
+}
+
+func newTestWallet(t *testing.T) *nkn.Wallet {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wallet
+}
+
+func TestExitServiceBeneficiary(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+
+	exitAddr := newTestWallet(t).Address()
+	serviceAddr := newTestWallet(t).Address()
+	services := []Service{{Name: "a", TCP: []uint32{port}}, {Name: "b", TCP: []uint32{port}}}
+	te, err := NewTunaExit(services, newTestWallet(t), &ExitConfiguration{
+		BeneficiaryAddr: exitAddr,
+		Services: map[string]ExitServiceInfo{
+			"a": {Address: "127.0.0.1", Price: "0", BeneficiaryAddr: serviceAddr},
+			"b": {Address: "127.0.0.1", Price: "0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme := &fakePaymentScheme{beneficiaries: make(chan string, 1), claims: make(chan []byte, 1)}
+	te.PaymentScheme = scheme
+
+	for name, expect := range map[string]string{"a": serviceAddr, "b": exitAddr} {
+		raw, _, err := te.buildMetadata(name, te.config.Services[name], "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := ReadMetadata(string(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.BeneficiaryAddr != expect {
+			t.Fatalf("expect service %s to advertise beneficiary %s, got %s", name, expect, metadata.BeneficiaryAddr)
+		}
+	}
+
+	entryConn, exitConn := net.Pipe()
+	exitSession, err := smux.Server(exitConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entrySession, err := smux.Client(entryConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entrySession.Close()
+	go te.handleSession(exitSession, "")
+
+	// payment arriving before the first service stream waits for the claimer
+	paymentStream, err := openPaymentStream(entrySession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteVarBytes(paymentStream, []byte("payment")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case addr := <-scheme.beneficiaries:
+		t.Fatalf("expect claimer not to start before service is known, got %s", addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	serviceID, err := te.getServiceID("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := entrySession.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStreamMetadata(stream, &pb.StreamMetadata{ServiceId: uint32(serviceID)}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case addr := <-scheme.beneficiaries:
+		if addr != serviceAddr {
+			t.Fatalf("expect claimer of beneficiary %s, got %s", serviceAddr, addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect claimer to start on service stream")
+	}
+	select {
+	case data := <-scheme.claims:
+		if string(data) != "payment" {
+			t.Fatalf("unexpected payment %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect early payment to be claimed")
+	}
+}
@@ -1,9 +1,9 @@
 module github.com/nknorg/tuna
 
-go 1.12
+go 1.23
 
 require (
-	github.com/golang/protobuf v1.4.1
+	github.com/golang/protobuf v1.5.0
 	github.com/imdario/mergo v0.3.9
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/nknorg/encrypted-stream v1.0.0
@@ -11,7 +11,27 @@ require (
 	github.com/nknorg/nkn/v2 v2.0.6
 	github.com/oschwald/geoip2-golang v1.4.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/quic-go/quic-go v0.54.1
 	github.com/rdegges/go-ipify v0.0.0-20150526035502-2d94a6a86c40
 	github.com/xtaci/smux v2.0.1+incompatible
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/crypto v0.26.0
+)
+
+require (
+	github.com/gorilla/websocket v1.4.1 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.0.0 // indirect
+	github.com/itchyny/base58-go v0.0.5 // indirect
+	github.com/jpillora/backoff v1.0.0 // indirect
+	github.com/nknorg/ncp-go v1.0.3 // indirect
+	github.com/oschwald/maxminddb-golang v1.6.0 // indirect
+	github.com/pbnjay/memory v0.0.0-20190104145345-974d429e7ae4 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -0,0 +1,81 @@
+package tuna
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+func (c *Common) setRemoteHealthCheck(healthCheck bool) {
+	c.Lock()
+	c.remoteHealthCheck = healthCheck
+	c.Unlock()
+}
+
+// useHealthCheck returns whether session to remote should be health checked,
+// which requires remote to respond to health check stream.
+func (c *Common) useHealthCheck() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.HealthCheckInterval > 0 && c.remoteHealthCheck
+}
+
+// startHealthCheck periodically sends a ping over a dedicated stream of
+// session, and closes session if pong is not received within
+// HealthCheckTimeout, so that half-open session is detected before user data
+// is forwarded to it.
+func (c *Common) startHealthCheck(session *smux.Session) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		log.Println("Couldn't open health check stream:", err)
+		return
+	}
+	defer Close(stream)
+
+	err = writeStreamMetadata(stream, &pb.StreamMetadata{IsHealthCheck: true})
+	if err != nil {
+		log.Println("Couldn't write health check stream metadata:", err)
+		return
+	}
+
+	ping := []byte{0}
+	pong := make([]byte, 1)
+	for {
+		time.Sleep(c.HealthCheckInterval)
+		if session.IsClosed() {
+			return
+		}
+
+		stream.SetDeadline(time.Now().Add(c.HealthCheckTimeout))
+		_, err = stream.Write(ping)
+		if err == nil {
+			_, err = io.ReadFull(stream, pong)
+		}
+		if err != nil {
+			if session.IsClosed() {
+				return
+			}
+			log.Println("Health check failed, close session:", err)
+			session.Close()
+			return
+		}
+	}
+}
+
+// handleHealthCheckStream responds to each ping received from stream.
+func handleHealthCheckStream(stream *smux.Stream) error {
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(stream, b)
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+}
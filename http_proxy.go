@@ -0,0 +1,58 @@
+package tuna
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	httpProxyHandshakeTimeout = 10 * time.Second
+)
+
+// bufferedConn is a net.Conn whose reads go through r, so that data buffered
+// by r while reading the request is not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// httpProxyHandshake reads an HTTP CONNECT request and returns the requested
+// destination address, with conn that should be used for the tunneled data.
+// Other methods are rejected. A successful response is not sent so that the
+// caller can report failure if the destination could not be reached.
+func httpProxyHandshake(conn net.Conn) (net.Conn, string, error) {
+	err := conn.SetDeadline(time.Now().Add(httpProxyHandshakeTimeout))
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.Method != http.MethodConnect {
+		httpProxyReply(conn, http.StatusMethodNotAllowed)
+		return nil, "", fmt.Errorf("unsupported http proxy method %s", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		httpProxyReply(conn, http.StatusBadRequest)
+		return nil, "", fmt.Errorf("invalid http proxy destination %q: %v", req.Host, err)
+	}
+
+	return &bufferedConn{Conn: conn, r: r}, req.Host, nil
+}
+
+// httpProxyReply sends an HTTP response without body of status code.
+func httpProxyReply(conn net.Conn, code int) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
+	return err
+}
@@ -0,0 +1,86 @@
+package tuna
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPProxyHandshakeConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// data sent right after the request headers is buffered by handshake
+	go client.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nearly"))
+
+	conn, dest, err := httpProxyHandshake(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "example.com:443" {
+		t.Fatalf("expect destination example.com:443, got %s", dest)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "early" {
+		t.Fatalf("expect early data to be kept, got %q", b)
+	}
+
+	go httpProxyReply(conn, http.StatusOK)
+	r := bufio.NewReader(client)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect status 200, got %d", resp.StatusCode)
+	}
+
+	go client.Write([]byte("ping"))
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("expect ping through tunnel, got %q", b)
+	}
+
+	go conn.Write([]byte("pong"))
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pong" {
+		t.Fatalf("expect pong through tunnel, got %q", b)
+	}
+}
+
+func TestHTTPProxyHandshakeMethodNotAllowed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := httpProxyHandshake(server)
+		errChan <- err
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expect status 405, got %d", resp.StatusCode)
+	}
+	if err := <-errChan; err == nil {
+		t.Fatal("expect handshake error for GET")
+	}
+}
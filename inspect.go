@@ -0,0 +1,105 @@
+package tuna
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+const (
+	inspectDialTimeout = 3 * time.Second
+	inspectWorkers     = 16
+)
+
+// SubscriberInfo is the metadata advertised by a subscriber of a service
+// topic, as returned by InspectService.
+type SubscriberInfo struct {
+	Address  string
+	Metadata *pb.ServiceMetadata
+	Price    Price
+	// Err is the error parsing metadata or price, other fields except Address
+	// may be empty if it's not nil.
+	Err       error
+	Reachable bool
+	DialRTT   time.Duration
+}
+
+// InspectService is like InspectServiceContext with background context.
+func InspectService(source SubscriberSource, prefix, name string) ([]SubscriberInfo, error) {
+	return InspectServiceContext(context.Background(), source, prefix, name)
+}
+
+// InspectServiceContext fetches all subscribers of service name with
+// subscription prefix, parses their metadata, and tests whether the
+// advertised TCP address of each subscriber is reachable. Source is usually a
+// *nkn.Wallet. Subscribers are sorted by address.
+func InspectServiceContext(ctx context.Context, source SubscriberSource, prefix, name string) ([]SubscriberInfo, error) {
+	topic := prefix + name
+	count, err := source.GetSubscribersCountContext(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers := make(map[string]string, count)
+	for offset := 0; offset < count; offset += defaultGetSubscribersBatchSize {
+		res, err := source.GetSubscribersContext(ctx, topic, offset, defaultGetSubscribersBatchSize, true, false)
+		if err != nil {
+			return nil, err
+		}
+		if res.Subscribers == nil {
+			continue
+		}
+		for addr, meta := range res.Subscribers.Map {
+			subscribers[addr] = meta
+		}
+	}
+
+	infos := make([]SubscriberInfo, 0, len(subscribers))
+	for addr, meta := range subscribers {
+		info := SubscriberInfo{Address: addr}
+		info.Metadata, info.Err = ReadMetadata(meta)
+		if info.Err == nil {
+			info.Price, info.Err = parseMetadataPrice(info.Metadata)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, inspectWorkers)
+	for i := range infos {
+		if infos[i].Metadata == nil || len(infos[i].Metadata.Ip) == 0 || infos[i].Metadata.TcpPort == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(info *SubscriberInfo) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			addr := net.JoinHostPort(info.Metadata.Ip, strconv.Itoa(int(info.Metadata.TcpPort)))
+			dialer := &net.Dialer{Timeout: inspectDialTimeout}
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, tcp, addr)
+			if err != nil {
+				return
+			}
+			info.DialRTT = time.Since(start)
+			info.Reachable = true
+			conn.Close()
+		}(&infos[i])
+	}
+	wg.Wait()
+
+	return infos, nil
+}
@@ -0,0 +1,187 @@
+package tuna
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+)
+
+// Metrics is a snapshot of counters and gauges of a tuna entry or exit. It
+// does not depend on any monitoring library, so it can be serialized directly
+// or converted to the format of a monitoring system such as Prometheus.
+type Metrics struct {
+	// Traffic of each service keyed by service name.
+	Services map[string]ServiceMetrics `json:"services"`
+	// Number of streams being piped.
+	ActiveStreams int `json:"activeStreams"`
+	// Number of successful server connections after the first one.
+	Reconnects uint64 `json:"reconnects"`
+	// Number of subscribers rejected during server selection.
+	SubscriberRejects uint64 `json:"subscriberRejects"`
+	// Total payment amount sent, in the smallest unit of NKN.
+	PaymentSent common.Fixed64 `json:"paymentSent"`
+}
+
+type ServiceMetrics struct {
+	BytesEntryToExit uint64 `json:"bytesEntryToExit"`
+	BytesExitToEntry uint64 `json:"bytesExitToEntry"`
+}
+
+func (c *Common) metrics() *Metrics {
+	m := &Metrics{
+		Services:          make(map[string]ServiceMetrics),
+		ActiveStreams:     int(atomic.LoadInt32(&c.activeStreams)),
+		SubscriberRejects: atomic.LoadUint64(&c.subscriberRejects),
+		PaymentSent:       common.Fixed64(atomic.LoadInt64(&c.paymentSent)),
+	}
+	if n := atomic.LoadUint64(&c.serverConnCount); n > 1 {
+		m.Reconnects = n - 1
+	}
+	return m
+}
+
+// MetricsSnapshot returns the current metrics of the entry.
+func (te *TunaEntry) MetricsSnapshot() *Metrics {
+	m := te.Common.metrics()
+	status := te.Status()
+	m.Services[te.Service.Name] = ServiceMetrics{
+		BytesEntryToExit: status.BytesEntryToExit,
+		BytesExitToEntry: status.BytesExitToEntry,
+	}
+	return m
+}
+
+// MetricsSnapshot returns the current metrics of the exit.
+func (te *TunaExit) MetricsSnapshot() *Metrics {
+	m := te.Common.metrics()
+	if te.config.Reverse {
+		if len(te.services) > 0 {
+			m.Services[te.services[0].Name] = ServiceMetrics{
+				BytesEntryToExit: atomic.LoadUint64(&te.reverseBytesEntryToExit),
+				BytesExitToEntry: atomic.LoadUint64(&te.reverseBytesExitToEntry),
+			}
+		}
+		return m
+	}
+
+	total := newServiceBytes()
+	te.serviceBytesLock.Lock()
+	total.add(te.closedServiceBytes)
+	for sb := range te.activeServiceBytes {
+		total.add(sb)
+	}
+	te.serviceBytesLock.Unlock()
+
+	for i, service := range te.services {
+		m.Services[service.Name] = ServiceMetrics{
+			BytesEntryToExit: total.entryToExit[i],
+			BytesExitToEntry: total.exitToEntry[i],
+		}
+	}
+	return m
+}
+
+// serviceBytes holds per service traffic of an exit session indexed by
+// service id. Logged fields hold traffic already written to traffic log.
+type serviceBytes struct {
+	entryToExit []uint64
+	exitToEntry []uint64
+
+	payer             string
+	loggedEntryToExit []uint64
+	loggedExitToEntry []uint64
+}
+
+func newServiceBytes() *serviceBytes {
+	return &serviceBytes{
+		entryToExit: make([]uint64, 256),
+		exitToEntry: make([]uint64, 256),
+	}
+}
+
+func (sb *serviceBytes) add(other *serviceBytes) {
+	for i := range sb.entryToExit {
+		sb.entryToExit[i] += atomic.LoadUint64(&other.entryToExit[i])
+		sb.exitToEntry[i] += atomic.LoadUint64(&other.exitToEntry[i])
+	}
+}
+
+func (te *TunaExit) addServiceBytes(payer string) *serviceBytes {
+	sb := newServiceBytes()
+	sb.payer = payer
+	te.serviceBytesLock.Lock()
+	te.activeServiceBytes[sb] = struct{}{}
+	te.serviceBytesLock.Unlock()
+	return sb
+}
+
+// removeServiceBytes folds traffic of a finished session into the closed
+// session total.
+func (te *TunaExit) removeServiceBytes(sb *serviceBytes) {
+	te.serviceBytesLock.Lock()
+	delete(te.activeServiceBytes, sb)
+	te.closedServiceBytes.add(sb)
+	if te.pendingTraffic != nil {
+		te.collectTraffic(sb)
+	}
+	te.serviceBytesLock.Unlock()
+}
+
+// ThroughputSample is the traffic of an entry during an interval.
+type ThroughputSample struct {
+	Time             time.Time     `json:"time"` // end of the interval
+	Interval         time.Duration `json:"interval"`
+	BytesEntryToExit uint64        `json:"bytesEntryToExit"`
+	BytesExitToEntry uint64        `json:"bytesExitToEntry"`
+}
+
+// ThroughputSamples returns a channel that receives the traffic of the entry
+// during each interval. The channel is closed when the entry is closed, or
+// right away if interval is not positive. A sample is not sent until the
+// previous one is received, and the traffic in between is included in the
+// next sample.
+func (te *TunaEntry) ThroughputSamples(interval time.Duration) <-chan ThroughputSample {
+	samples := make(chan ThroughputSample)
+	if interval <= 0 {
+		log.Println("Throughput sample interval should be positive, got", interval)
+		close(samples)
+		return samples
+	}
+	go func() {
+		defer close(samples)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		status := te.Status()
+		lastEntryToExit, lastExitToEntry := status.BytesEntryToExit, status.BytesExitToEntry
+		lastTime := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+			case <-te.closeChan:
+				return
+			}
+
+			status = te.Status()
+			now := time.Now()
+			sample := ThroughputSample{
+				Time:             now,
+				Interval:         now.Sub(lastTime),
+				BytesEntryToExit: status.BytesEntryToExit - lastEntryToExit,
+				BytesExitToEntry: status.BytesExitToEntry - lastExitToEntry,
+			}
+
+			select {
+			case samples <- sample:
+			case <-te.closeChan:
+				return
+			}
+
+			lastEntryToExit, lastExitToEntry = status.BytesEntryToExit, status.BytesExitToEntry
+			lastTime = now
+		}
+	}()
+	return samples
+}
@@ -0,0 +1,73 @@
+package tuna
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThroughputSamples(t *testing.T) {
+	entry, err := NewTunaEntry(Service{Name: "test", TCP: []uint32{0}}, ServiceInfo{}, newTestWallet(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddUint64(&entry.bytesEntryToExit, 100)
+
+	samples := entry.ThroughputSamples(10 * time.Millisecond)
+	receive := func() ThroughputSample {
+		select {
+		case sample, ok := <-samples:
+			if !ok {
+				t.Fatal("expect sample, got closed channel")
+			}
+			return sample
+		case <-time.After(time.Second):
+			t.Fatal("expect sample within 1s")
+		}
+		return ThroughputSample{}
+	}
+
+	// traffic before sampling starts is not included
+	if sample := receive(); sample.BytesEntryToExit != 0 || sample.BytesExitToEntry != 0 {
+		t.Fatalf("expect empty first sample, got %+v", sample)
+	}
+
+	atomic.AddUint64(&entry.bytesEntryToExit, 10)
+	atomic.AddUint64(&entry.bytesExitToEntry, 20)
+	// traffic is split across samples if added during sampling
+	var entryToExit, exitToEntry uint64
+	for entryToExit < 10 || exitToEntry < 20 {
+		sample := receive()
+		if sample.Interval <= 0 {
+			t.Fatalf("expect positive interval, got %v", sample.Interval)
+		}
+		entryToExit += sample.BytesEntryToExit
+		exitToEntry += sample.BytesExitToEntry
+	}
+	if entryToExit != 10 || exitToEntry != 20 {
+		t.Fatalf("expect samples of 10 and 20 bytes, got %d and %d", entryToExit, exitToEntry)
+	}
+
+	entry.Close()
+	for range samples {
+	}
+}
+
+func TestThroughputSamplesInvalidInterval(t *testing.T) {
+	entry, err := NewTunaEntry(Service{Name: "test", TCP: []uint32{0}}, ServiceInfo{}, newTestWallet(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		select {
+		case _, ok := <-entry.ThroughputSamples(interval):
+			if ok {
+				t.Fatalf("expect no sample for interval %v", interval)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect channel of interval %v to be closed", interval)
+		}
+	}
+}
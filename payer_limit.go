@@ -0,0 +1,123 @@
+package tuna
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	payerBandwidthInterval = 5 * time.Second
+)
+
+// payerLimits limits concurrent streams and bandwidth of each payer across
+// all of its sessions, so that a single entry cannot monopolize an exit.
+type payerLimits struct {
+	maxStreams   int32
+	maxBandwidth int64 // bytes per second
+
+	sync.Mutex
+	payers map[string]*payerLimit
+}
+
+// payerLimit is the usage of a payer, removed when the last session of the
+// payer ends.
+type payerLimit struct {
+	streams *streamLimiter
+
+	sync.Mutex
+	sessions    map[*serviceBytes]struct{}
+	closedBytes uint64
+	windowStart time.Time
+	windowBytes uint64
+	bandwidth   float64
+}
+
+func newPayerLimits(maxStreams int32, maxBandwidth int64) *payerLimits {
+	return &payerLimits{
+		maxStreams:   maxStreams,
+		maxBandwidth: maxBandwidth,
+		payers:       make(map[string]*payerLimit),
+	}
+}
+
+// addSession adds session traffic sb to payer's usage and returns the payer
+// limit.
+func (pls *payerLimits) addSession(payer string, sb *serviceBytes) *payerLimit {
+	pls.Lock()
+	defer pls.Unlock()
+	pl, ok := pls.payers[payer]
+	if !ok {
+		pl = &payerLimit{
+			streams:     newStreamLimiter(pls.maxStreams),
+			sessions:    make(map[*serviceBytes]struct{}),
+			windowStart: time.Now(),
+		}
+		pls.payers[payer] = pl
+	}
+	pl.Lock()
+	pl.sessions[sb] = struct{}{}
+	pl.Unlock()
+	return pl
+}
+
+func (pls *payerLimits) removeSession(payer string, sb *serviceBytes) {
+	pls.Lock()
+	defer pls.Unlock()
+	pl, ok := pls.payers[payer]
+	if !ok {
+		return
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	if _, ok := pl.sessions[sb]; !ok {
+		return
+	}
+	delete(pl.sessions, sb)
+	pl.closedBytes += sb.total()
+	if len(pl.sessions) == 0 {
+		delete(pls.payers, payer)
+	}
+}
+
+// acquire reserves a stream slot for payer, or returns ErrPayerLimitReached if
+// payer has too many streams or used too much bandwidth recently.
+func (pls *payerLimits) acquire(pl *payerLimit) error {
+	if pls.maxBandwidth > 0 {
+		if bandwidth := pl.getBandwidth(); bandwidth > float64(pls.maxBandwidth) {
+			return fmt.Errorf("%w: bandwidth %.0f B/s exceeds %d B/s", ErrPayerLimitReached, bandwidth, pls.maxBandwidth)
+		}
+	}
+	if !pl.streams.acquire() {
+		return fmt.Errorf("%w: max concurrent streams %d reached", ErrPayerLimitReached, pls.maxStreams)
+	}
+	return nil
+}
+
+// getBandwidth returns bandwidth of payer in bytes per second, which is
+// averaged since last update and updated at most once per
+// payerBandwidthInterval.
+func (pl *payerLimit) getBandwidth() float64 {
+	pl.Lock()
+	defer pl.Unlock()
+	if elapsed := time.Since(pl.windowStart); elapsed >= payerBandwidthInterval {
+		total := pl.closedBytes
+		for sb := range pl.sessions {
+			total += sb.total()
+		}
+		pl.bandwidth = float64(total-pl.windowBytes) / elapsed.Seconds()
+		pl.windowStart = time.Now()
+		pl.windowBytes = total
+	}
+	return pl.bandwidth
+}
+
+// total returns traffic of all services in both directions.
+func (sb *serviceBytes) total() uint64 {
+	var total uint64
+	for i := range sb.entryToExit {
+		total += atomic.LoadUint64(&sb.entryToExit[i]) + atomic.LoadUint64(&sb.exitToEntry[i])
+	}
+	return total
+}
@@ -0,0 +1,100 @@
+package tuna
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPayerLimitsAcquire(t *testing.T) {
+	pls := newPayerLimits(2, 0)
+	pl := pls.addSession("a", newServiceBytes())
+	// streams of all sessions of the same payer count towards its limit
+	if pls.addSession("a", newServiceBytes()) != pl {
+		t.Fatal("expect sessions of the same payer to share payer limit")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := pls.acquire(pl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pls.acquire(pl); !errors.Is(err, ErrPayerLimitReached) {
+		t.Fatalf("expect ErrPayerLimitReached, got %v", err)
+	}
+	if err := pls.acquire(pls.addSession("b", newServiceBytes())); err != nil {
+		t.Fatalf("expect other payer not to be limited, got %v", err)
+	}
+
+	pl.streams.release()
+	if err := pls.acquire(pl); err != nil {
+		t.Fatalf("expect released stream slot to be reused, got %v", err)
+	}
+}
+
+func TestPayerLimitsBandwidth(t *testing.T) {
+	pls := newPayerLimits(0, 100)
+	sb := newServiceBytes()
+	pl := pls.addSession("a", sb)
+
+	atomic.AddUint64(&sb.entryToExit[0], 1000)
+	// bandwidth is not updated until payerBandwidthInterval elapsed
+	if bandwidth := pl.getBandwidth(); bandwidth != 0 {
+		t.Fatalf("expect bandwidth 0 before interval elapsed, got %f", bandwidth)
+	}
+	if err := pls.acquire(pl); err != nil {
+		t.Fatal(err)
+	}
+
+	pl.windowStart = time.Now().Add(-payerBandwidthInterval)
+	bandwidth := pl.getBandwidth()
+	if bandwidth < 150 || bandwidth > 200 {
+		t.Fatalf("expect bandwidth about 200 B/s, got %f", bandwidth)
+	}
+	if err := pls.acquire(pl); !errors.Is(err, ErrPayerLimitReached) {
+		t.Fatalf("expect ErrPayerLimitReached, got %v", err)
+	}
+
+	// bandwidth only counts traffic of the new window
+	pl.windowStart = time.Now().Add(-payerBandwidthInterval)
+	if bandwidth := pl.getBandwidth(); bandwidth != 0 {
+		t.Fatalf("expect bandwidth 0 without new traffic, got %f", bandwidth)
+	}
+	if err := pls.acquire(pl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayerLimitsRemoveSession(t *testing.T) {
+	pls := newPayerLimits(0, 100)
+	sb1, sb2 := newServiceBytes(), newServiceBytes()
+	pl := pls.addSession("a", sb1)
+	pls.addSession("a", sb2)
+
+	atomic.AddUint64(&sb1.exitToEntry[0], 1000)
+	pls.removeSession("a", sb1)
+	// removing twice or an unknown session changes nothing
+	pls.removeSession("a", sb1)
+	pls.removeSession("b", sb1)
+	if len(pls.payers) != 1 {
+		t.Fatalf("expect payer to be kept while it has sessions, got %d payers", len(pls.payers))
+	}
+	if pl.closedBytes != 1000 {
+		t.Fatalf("expect closed bytes 1000, got %d", pl.closedBytes)
+	}
+
+	// traffic of closed sessions still counts towards bandwidth
+	pl.windowStart = time.Now().Add(-payerBandwidthInterval)
+	if err := pls.acquire(pl); !errors.Is(err, ErrPayerLimitReached) {
+		t.Fatalf("expect ErrPayerLimitReached, got %v", err)
+	}
+
+	pls.removeSession("a", sb2)
+	if len(pls.payers) != 0 {
+		t.Fatalf("expect payer to be removed with its last session, got %d payers", len(pls.payers))
+	}
+	if pls.addSession("a", newServiceBytes()) == pl {
+		t.Fatal("expect new payer limit after payer is removed")
+	}
+}
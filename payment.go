@@ -0,0 +1,290 @@
+package tuna
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/nkn/v2/transaction"
+)
+
+const (
+	PaymentSchemeNanoPay = "nanopay"
+	PaymentSchemeNone    = "none"
+)
+
+// PaymentScheme is how entry and exit pay each other for traffic. A nil
+// PaymentChannel or PaymentClaimer returned without error means payment is not
+// required in that direction.
+type PaymentScheme interface {
+	// OpenChannel opens a payment channel to recipient.
+	OpenChannel(recipient, fee string) (PaymentChannel, error)
+	// NewClaimer creates a claimer that receives payment to beneficiaryAddr.
+	// Errors happened in background should be sent to onErr.
+	NewClaimer(beneficiaryAddr string, claimInterval time.Duration, minFlushAmount string, onErr *nkn.OnError) (PaymentClaimer, error)
+}
+
+// PaymentChannel sends incremental payment to a recipient.
+type PaymentChannel interface {
+	Recipient() string
+	// Pay increments the amount paid through the channel by delta and returns
+	// the payment data to be sent to recipient.
+	Pay(delta common.Fixed64) ([]byte, error)
+	Close() error
+}
+
+// PaymentClaimer claims payment data sent by a PaymentChannel.
+type PaymentClaimer interface {
+	// Claim claims payment data and returns the total amount claimed.
+	Claim(data []byte) (common.Fixed64, error)
+	IsClosed() bool
+	Close() error
+}
+
+// NewPaymentScheme creates a payment scheme by name. Empty name means
+// PaymentSchemeNanoPay.
+func NewPaymentScheme(name string, wallet *nkn.Wallet) (PaymentScheme, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", PaymentSchemeNanoPay:
+		return NewNanoPayScheme(wallet), nil
+	case PaymentSchemeNone:
+		return NoPayment{}, nil
+	default:
+		return nil, fmt.Errorf("unknown payment scheme %v", name)
+	}
+}
+
+// NanoPayScheme pays using NKN NanoPay.
+type NanoPayScheme struct {
+	wallet *nkn.Wallet
+}
+
+// NewNanoPayScheme creates a NanoPay payment scheme using wallet.
+func NewNanoPayScheme(wallet *nkn.Wallet) *NanoPayScheme {
+	return &NanoPayScheme{wallet: wallet}
+}
+
+func (s *NanoPayScheme) OpenChannel(recipient, fee string) (PaymentChannel, error) {
+	np, err := s.wallet.NewNanoPay(recipient, fee, defaultNanoPayDuration)
+	if err != nil {
+		return nil, err
+	}
+	return &nanoPayChannel{np: np}, nil
+}
+
+func (s *NanoPayScheme) NewClaimer(beneficiaryAddr string, claimInterval time.Duration, minFlushAmount string, onErr *nkn.OnError) (PaymentClaimer, error) {
+	npc, err := s.wallet.NewNanoPayClaimer(beneficiaryAddr, int32(claimInterval/time.Millisecond), minFlushAmount, onErr)
+	if err != nil {
+		return nil, err
+	}
+	return &nanoPayClaimer{npc: npc}, nil
+}
+
+type nanoPayChannel struct {
+	np *nkn.NanoPay
+}
+
+func (c *nanoPayChannel) Recipient() string {
+	return c.np.Recipient()
+}
+
+func (c *nanoPayChannel) Pay(delta common.Fixed64) ([]byte, error) {
+	var tx *transaction.Transaction
+	var err error
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			time.Sleep(1 * time.Second)
+		}
+		tx, err = c.np.IncrementAmount(delta.String())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil || tx == nil || tx.GetSize() == 0 {
+		return nil, fmt.Errorf("send nanopay tx failed: %v", err)
+	}
+
+	return tx.Marshal()
+}
+
+func (c *nanoPayChannel) Close() error {
+	return nil
+}
+
+type nanoPayClaimer struct {
+	npc *nkn.NanoPayClaimer
+}
+
+func (c *nanoPayClaimer) Claim(data []byte) (common.Fixed64, error) {
+	if len(data) == 0 {
+		return 0, errors.New("empty txn bytes")
+	}
+
+	tx := &transaction.Transaction{}
+	if err := tx.Unmarshal(data); err != nil {
+		return 0, fmt.Errorf("couldn't unmarshal payment stream data: %v", err)
+	}
+
+	if tx.UnsignedTx == nil {
+		return 0, errors.New("nil txn body")
+	}
+
+	amount, err := c.npc.Claim(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	return amount.ToFixed64(), nil
+}
+
+func (c *nanoPayClaimer) IsClosed() bool {
+	return c.npc.IsClosed()
+}
+
+func (c *nanoPayClaimer) Close() error {
+	return c.npc.Close()
+}
+
+// NoPayment disables payment, which is useful for private deployments.
+type NoPayment struct{}
+
+func (NoPayment) OpenChannel(recipient, fee string) (PaymentChannel, error) {
+	return nil, nil
+}
+
+func (NoPayment) NewClaimer(beneficiaryAddr string, claimInterval time.Duration, minFlushAmount string, onErr *nkn.OnError) (PaymentClaimer, error) {
+	return nil, nil
+}
+
+// ChannelInfo describes a payment channel opened by entry, or by exit in
+// reverse mode.
+type ChannelInfo struct {
+	Receiver string
+	Paid     common.Fixed64 // total amount paid through the channel
+}
+
+// trackedChannel is a PaymentChannel opened by payment loop that can be listed
+// and closed from outside of the loop.
+type trackedChannel struct {
+	PaymentChannel
+	sync.Mutex
+	paid         common.Fixed64
+	closeRequest chan struct{}
+	requestOnce  sync.Once
+	done         chan struct{}
+}
+
+func (tc *trackedChannel) addPaid(amount common.Fixed64) {
+	tc.Lock()
+	tc.paid += amount
+	tc.Unlock()
+}
+
+func (tc *trackedChannel) getPaid() common.Fixed64 {
+	tc.Lock()
+	defer tc.Unlock()
+	return tc.paid
+}
+
+func (tc *trackedChannel) requestClose() {
+	tc.requestOnce.Do(func() {
+		close(tc.closeRequest)
+	})
+}
+
+func (tc *trackedChannel) isCloseRequested() bool {
+	select {
+	case <-tc.closeRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Common) addPaymentChannel(pc PaymentChannel) *trackedChannel {
+	tc := &trackedChannel{
+		PaymentChannel: pc,
+		closeRequest:   make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	c.Lock()
+	c.paymentChannels[tc] = struct{}{}
+	c.Unlock()
+	return tc
+}
+
+func (c *Common) removePaymentChannel(tc *trackedChannel) {
+	c.Lock()
+	delete(c.paymentChannels, tc)
+	c.Unlock()
+	if err := tc.Close(); err != nil {
+		log.Println("Close payment channel error:", err)
+	}
+	close(tc.done)
+}
+
+// ActiveChannels returns payment channels currently used to pay for traffic.
+func (c *Common) ActiveChannels() []ChannelInfo {
+	c.RLock()
+	defer c.RUnlock()
+	channels := make([]ChannelInfo, 0, len(c.paymentChannels))
+	for tc := range c.paymentChannels {
+		channels = append(channels, ChannelInfo{
+			Receiver: tc.Recipient(),
+			Paid:     tc.getPaid(),
+		})
+	}
+	return channels
+}
+
+// CloseChannel settles traffic not paid yet and closes payment channels to
+// receiver. No more payment is sent to receiver by the closed channels, so
+// the receiver will stop serving once unpaid traffic exceeds its limit.
+func (c *Common) CloseChannel(receiver string) error {
+	c.RLock()
+	channels := make([]*trackedChannel, 0, 1)
+	for tc := range c.paymentChannels {
+		if tc.Recipient() == receiver {
+			channels = append(channels, tc)
+		}
+	}
+	c.RUnlock()
+
+	if len(channels) == 0 {
+		return fmt.Errorf("no active payment channel to %s", receiver)
+	}
+
+	return closePaymentChannels(channels)
+}
+
+// closeAllChannels settles and closes all active payment channels.
+func (c *Common) closeAllChannels() error {
+	c.RLock()
+	channels := make([]*trackedChannel, 0, len(c.paymentChannels))
+	for tc := range c.paymentChannels {
+		channels = append(channels, tc)
+	}
+	c.RUnlock()
+
+	return closePaymentChannels(channels)
+}
+
+func closePaymentChannels(channels []*trackedChannel) error {
+	for _, tc := range channels {
+		tc.requestClose()
+	}
+	timeout := time.After(closeChannelTimeout)
+	for _, tc := range channels {
+		select {
+		case <-tc.done:
+		case <-timeout:
+			return fmt.Errorf("close payment channel to %s timeout", tc.Recipient())
+		}
+	}
+	return nil
+}
@@ -41,7 +41,7 @@ func (x EncryptionAlgo) String() string {
 	return proto.EnumName(EncryptionAlgo_name, int32(x))
 }
 func (EncryptionAlgo) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_tuna_aa10095f6cda5e27, []int{0}
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{0}
 }
 
 type ConnectionMetadata struct {
@@ -50,6 +50,10 @@ type ConnectionMetadata struct {
 	Nonce                    []byte         `protobuf:"bytes,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
 	IsMeasurement            bool           `protobuf:"varint,4,opt,name=is_measurement,json=isMeasurement,proto3" json:"is_measurement,omitempty"`
 	MeasurementBytesDownlink uint32         `protobuf:"varint,5,opt,name=measurement_bytes_downlink,json=measurementBytesDownlink,proto3" json:"measurement_bytes_downlink,omitempty"`
+	Compression              bool           `protobuf:"varint,6,opt,name=compression,proto3" json:"compression,omitempty"`
+	ServiceHandshake         bool           `protobuf:"varint,7,opt,name=service_handshake,json=serviceHandshake,proto3" json:"service_handshake,omitempty"`
+	HealthCheck              bool           `protobuf:"varint,8,opt,name=health_check,json=healthCheck,proto3" json:"health_check,omitempty"`
+	EntryAuth                bool           `protobuf:"varint,9,opt,name=entry_auth,json=entryAuth,proto3" json:"entry_auth,omitempty"`
 	XXX_NoUnkeyedLiteral     struct{}       `json:"-"`
 	XXX_unrecognized         []byte         `json:"-"`
 	XXX_sizecache            int32          `json:"-"`
@@ -59,7 +63,7 @@ func (m *ConnectionMetadata) Reset()         { *m = ConnectionMetadata{} }
 func (m *ConnectionMetadata) String() string { return proto.CompactTextString(m) }
 func (*ConnectionMetadata) ProtoMessage()    {}
 func (*ConnectionMetadata) Descriptor() ([]byte, []int) {
-	return fileDescriptor_tuna_aa10095f6cda5e27, []int{0}
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{0}
 }
 func (m *ConnectionMetadata) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ConnectionMetadata.Unmarshal(m, b)
@@ -114,25 +118,233 @@ func (m *ConnectionMetadata) GetMeasurementBytesDownlink() uint32 {
 	return 0
 }
 
-type ServiceMetadata struct {
-	Ip                   string   `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
-	TcpPort              uint32   `protobuf:"varint,2,opt,name=tcp_port,json=tcpPort,proto3" json:"tcp_port,omitempty"`
-	UdpPort              uint32   `protobuf:"varint,3,opt,name=udp_port,json=udpPort,proto3" json:"udp_port,omitempty"`
-	ServiceId            uint32   `protobuf:"varint,4,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
-	ServiceTcp           []uint32 `protobuf:"varint,5,rep,packed,name=service_tcp,json=serviceTcp,proto3" json:"service_tcp,omitempty"`
-	ServiceUdp           []uint32 `protobuf:"varint,6,rep,packed,name=service_udp,json=serviceUdp,proto3" json:"service_udp,omitempty"`
-	Price                string   `protobuf:"bytes,7,opt,name=price,proto3" json:"price,omitempty"`
-	BeneficiaryAddr      string   `protobuf:"bytes,8,opt,name=beneficiary_addr,json=beneficiaryAddr,proto3" json:"beneficiary_addr,omitempty"`
+func (m *ConnectionMetadata) GetCompression() bool {
+	if m != nil {
+		return m.Compression
+	}
+	return false
+}
+
+func (m *ConnectionMetadata) GetServiceHandshake() bool {
+	if m != nil {
+		return m.ServiceHandshake
+	}
+	return false
+}
+
+func (m *ConnectionMetadata) GetHealthCheck() bool {
+	if m != nil {
+		return m.HealthCheck
+	}
+	return false
+}
+
+func (m *ConnectionMetadata) GetEntryAuth() bool {
+	if m != nil {
+		return m.EntryAuth
+	}
+	return false
+}
+
+type EntryAuthRequest struct {
+	Signature            []byte   `protobuf:"bytes,1,opt,name=signature,proto3" json:"signature,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EntryAuthRequest) Reset()         { *m = EntryAuthRequest{} }
+func (m *EntryAuthRequest) String() string { return proto.CompactTextString(m) }
+func (*EntryAuthRequest) ProtoMessage()    {}
+func (*EntryAuthRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{1}
+}
+func (m *EntryAuthRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EntryAuthRequest.Unmarshal(m, b)
+}
+func (m *EntryAuthRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EntryAuthRequest.Marshal(b, m, deterministic)
+}
+func (dst *EntryAuthRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EntryAuthRequest.Merge(dst, src)
+}
+func (m *EntryAuthRequest) XXX_Size() int {
+	return xxx_messageInfo_EntryAuthRequest.Size(m)
+}
+func (m *EntryAuthRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_EntryAuthRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EntryAuthRequest proto.InternalMessageInfo
+
+func (m *EntryAuthRequest) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+type EntryAuthResponse struct {
+	Accepted             bool     `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Error                string   `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EntryAuthResponse) Reset()         { *m = EntryAuthResponse{} }
+func (m *EntryAuthResponse) String() string { return proto.CompactTextString(m) }
+func (*EntryAuthResponse) ProtoMessage()    {}
+func (*EntryAuthResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{2}
+}
+func (m *EntryAuthResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EntryAuthResponse.Unmarshal(m, b)
+}
+func (m *EntryAuthResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EntryAuthResponse.Marshal(b, m, deterministic)
+}
+func (dst *EntryAuthResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EntryAuthResponse.Merge(dst, src)
+}
+func (m *EntryAuthResponse) XXX_Size() int {
+	return xxx_messageInfo_EntryAuthResponse.Size(m)
+}
+func (m *EntryAuthResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_EntryAuthResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EntryAuthResponse proto.InternalMessageInfo
+
+func (m *EntryAuthResponse) GetAccepted() bool {
+	if m != nil {
+		return m.Accepted
+	}
+	return false
+}
+
+func (m *EntryAuthResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type ServiceHandshakeRequest struct {
+	ServiceId            uint32   `protobuf:"varint,1,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	ServiceName          string   `protobuf:"bytes,2,opt,name=service_name,json=serviceName,proto3" json:"service_name,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ServiceHandshakeRequest) Reset()         { *m = ServiceHandshakeRequest{} }
+func (m *ServiceHandshakeRequest) String() string { return proto.CompactTextString(m) }
+func (*ServiceHandshakeRequest) ProtoMessage()    {}
+func (*ServiceHandshakeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{3}
+}
+func (m *ServiceHandshakeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ServiceHandshakeRequest.Unmarshal(m, b)
+}
+func (m *ServiceHandshakeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ServiceHandshakeRequest.Marshal(b, m, deterministic)
+}
+func (dst *ServiceHandshakeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ServiceHandshakeRequest.Merge(dst, src)
+}
+func (m *ServiceHandshakeRequest) XXX_Size() int {
+	return xxx_messageInfo_ServiceHandshakeRequest.Size(m)
+}
+func (m *ServiceHandshakeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ServiceHandshakeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ServiceHandshakeRequest proto.InternalMessageInfo
+
+func (m *ServiceHandshakeRequest) GetServiceId() uint32 {
+	if m != nil {
+		return m.ServiceId
+	}
+	return 0
+}
+
+func (m *ServiceHandshakeRequest) GetServiceName() string {
+	if m != nil {
+		return m.ServiceName
+	}
+	return ""
+}
+
+type ServiceHandshakeResponse struct {
+	Accepted             bool     `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Error                string   `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
 
+func (m *ServiceHandshakeResponse) Reset()         { *m = ServiceHandshakeResponse{} }
+func (m *ServiceHandshakeResponse) String() string { return proto.CompactTextString(m) }
+func (*ServiceHandshakeResponse) ProtoMessage()    {}
+func (*ServiceHandshakeResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{4}
+}
+func (m *ServiceHandshakeResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ServiceHandshakeResponse.Unmarshal(m, b)
+}
+func (m *ServiceHandshakeResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ServiceHandshakeResponse.Marshal(b, m, deterministic)
+}
+func (dst *ServiceHandshakeResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ServiceHandshakeResponse.Merge(dst, src)
+}
+func (m *ServiceHandshakeResponse) XXX_Size() int {
+	return xxx_messageInfo_ServiceHandshakeResponse.Size(m)
+}
+func (m *ServiceHandshakeResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ServiceHandshakeResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ServiceHandshakeResponse proto.InternalMessageInfo
+
+func (m *ServiceHandshakeResponse) GetAccepted() bool {
+	if m != nil {
+		return m.Accepted
+	}
+	return false
+}
+
+func (m *ServiceHandshakeResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type ServiceMetadata struct {
+	Ip                   string            `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	TcpPort              uint32            `protobuf:"varint,2,opt,name=tcp_port,json=tcpPort,proto3" json:"tcp_port,omitempty"`
+	UdpPort              uint32            `protobuf:"varint,3,opt,name=udp_port,json=udpPort,proto3" json:"udp_port,omitempty"`
+	ServiceId            uint32            `protobuf:"varint,4,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	ServiceTcp           []uint32          `protobuf:"varint,5,rep,packed,name=service_tcp,json=serviceTcp,proto3" json:"service_tcp,omitempty"`
+	ServiceUdp           []uint32          `protobuf:"varint,6,rep,packed,name=service_udp,json=serviceUdp,proto3" json:"service_udp,omitempty"`
+	Price                string            `protobuf:"bytes,7,opt,name=price,proto3" json:"price,omitempty"`
+	BeneficiaryAddr      string            `protobuf:"bytes,8,opt,name=beneficiary_addr,json=beneficiaryAddr,proto3" json:"beneficiary_addr,omitempty"`
+	Version              uint32            `protobuf:"varint,9,opt,name=version,proto3" json:"version,omitempty"`
+	Tags                 map[string]string `protobuf:"bytes,10,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	PriceUnit            uint64            `protobuf:"varint,11,opt,name=price_unit,json=priceUnit,proto3" json:"price_unit,omitempty"`
+	QuicPort             uint32            `protobuf:"varint,12,opt,name=quic_port,json=quicPort,proto3" json:"quic_port,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
 func (m *ServiceMetadata) Reset()         { *m = ServiceMetadata{} }
 func (m *ServiceMetadata) String() string { return proto.CompactTextString(m) }
 func (*ServiceMetadata) ProtoMessage()    {}
 func (*ServiceMetadata) Descriptor() ([]byte, []int) {
-	return fileDescriptor_tuna_aa10095f6cda5e27, []int{1}
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{5}
 }
 func (m *ServiceMetadata) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ServiceMetadata.Unmarshal(m, b)
@@ -208,10 +420,42 @@ func (m *ServiceMetadata) GetBeneficiaryAddr() string {
 	return ""
 }
 
+func (m *ServiceMetadata) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *ServiceMetadata) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *ServiceMetadata) GetPriceUnit() uint64 {
+	if m != nil {
+		return m.PriceUnit
+	}
+	return 0
+}
+
+func (m *ServiceMetadata) GetQuicPort() uint32 {
+	if m != nil {
+		return m.QuicPort
+	}
+	return 0
+}
+
 type StreamMetadata struct {
 	ServiceId            uint32   `protobuf:"varint,1,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
 	PortId               uint32   `protobuf:"varint,2,opt,name=port_id,json=portId,proto3" json:"port_id,omitempty"`
 	IsPayment            bool     `protobuf:"varint,3,opt,name=is_payment,json=isPayment,proto3" json:"is_payment,omitempty"`
+	DestAddr             string   `protobuf:"bytes,4,opt,name=dest_addr,json=destAddr,proto3" json:"dest_addr,omitempty"`
+	Compression          bool     `protobuf:"varint,5,opt,name=compression,proto3" json:"compression,omitempty"`
+	IsHealthCheck        bool     `protobuf:"varint,6,opt,name=is_health_check,json=isHealthCheck,proto3" json:"is_health_check,omitempty"`
+	IsUdp                bool     `protobuf:"varint,7,opt,name=is_udp,json=isUdp,proto3" json:"is_udp,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -221,7 +465,7 @@ func (m *StreamMetadata) Reset()         { *m = StreamMetadata{} }
 func (m *StreamMetadata) String() string { return proto.CompactTextString(m) }
 func (*StreamMetadata) ProtoMessage()    {}
 func (*StreamMetadata) Descriptor() ([]byte, []int) {
-	return fileDescriptor_tuna_aa10095f6cda5e27, []int{2}
+	return fileDescriptor_tuna_107268b2b3777a6d, []int{6}
 }
 func (m *StreamMetadata) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_StreamMetadata.Unmarshal(m, b)
@@ -262,44 +506,97 @@ func (m *StreamMetadata) GetIsPayment() bool {
 	return false
 }
 
+func (m *StreamMetadata) GetDestAddr() string {
+	if m != nil {
+		return m.DestAddr
+	}
+	return ""
+}
+
+func (m *StreamMetadata) GetCompression() bool {
+	if m != nil {
+		return m.Compression
+	}
+	return false
+}
+
+func (m *StreamMetadata) GetIsHealthCheck() bool {
+	if m != nil {
+		return m.IsHealthCheck
+	}
+	return false
+}
+
+func (m *StreamMetadata) GetIsUdp() bool {
+	if m != nil {
+		return m.IsUdp
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterType((*ConnectionMetadata)(nil), "pb.ConnectionMetadata")
+	proto.RegisterType((*EntryAuthRequest)(nil), "pb.EntryAuthRequest")
+	proto.RegisterType((*EntryAuthResponse)(nil), "pb.EntryAuthResponse")
+	proto.RegisterType((*ServiceHandshakeRequest)(nil), "pb.ServiceHandshakeRequest")
+	proto.RegisterType((*ServiceHandshakeResponse)(nil), "pb.ServiceHandshakeResponse")
 	proto.RegisterType((*ServiceMetadata)(nil), "pb.ServiceMetadata")
+	proto.RegisterMapType((map[string]string)(nil), "pb.ServiceMetadata.TagsEntry")
 	proto.RegisterType((*StreamMetadata)(nil), "pb.StreamMetadata")
 	proto.RegisterEnum("pb.EncryptionAlgo", EncryptionAlgo_name, EncryptionAlgo_value)
 }
 
-func init() { proto.RegisterFile("pb/tuna.proto", fileDescriptor_tuna_aa10095f6cda5e27) }
-
-var fileDescriptor_tuna_aa10095f6cda5e27 = []byte{
-	// 455 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5c, 0x92, 0xcd, 0x8e, 0xd3, 0x30,
-	0x14, 0x85, 0x49, 0x4b, 0xff, 0x2e, 0x24, 0xad, 0x0c, 0x02, 0x83, 0x18, 0x11, 0x55, 0x42, 0x2a,
-	0x2c, 0xca, 0x30, 0x23, 0x56, 0xb0, 0x09, 0xa5, 0x42, 0x15, 0xd3, 0x1f, 0x25, 0x83, 0xc4, 0xac,
-	0x2c, 0xc7, 0x36, 0x95, 0x35, 0xad, 0x6d, 0x39, 0x0e, 0x28, 0xcf, 0xcc, 0x13, 0xb0, 0x43, 0x49,
-	0x3a, 0x25, 0x65, 0x79, 0xcf, 0x77, 0x6c, 0x9d, 0x63, 0x5f, 0xf0, 0x4d, 0xfa, 0xd6, 0xe5, 0x8a,
-	0x4e, 0x8d, 0xd5, 0x4e, 0xa3, 0x96, 0x49, 0xc7, 0xbf, 0x3d, 0x40, 0x33, 0xad, 0x94, 0x60, 0x4e,
-	0x6a, 0xb5, 0x14, 0x8e, 0x72, 0xea, 0x28, 0xfa, 0x00, 0x43, 0xa1, 0x98, 0x2d, 0x4c, 0xa9, 0x12,
-	0xba, 0xdb, 0x6a, 0xec, 0x85, 0xde, 0x24, 0xb8, 0x40, 0x53, 0x93, 0x4e, 0xe7, 0x47, 0x14, 0xed,
-	0xb6, 0x3a, 0x0e, 0xc4, 0xc9, 0x8c, 0xce, 0x00, 0x4c, 0x9e, 0xee, 0x24, 0x23, 0xb7, 0xa2, 0xc0,
-	0xad, 0xd0, 0x9b, 0x3c, 0x8c, 0x07, 0xb5, 0xf2, 0x55, 0x14, 0xe8, 0x31, 0x74, 0x94, 0x56, 0x4c,
-	0xe0, 0x76, 0x45, 0xea, 0x01, 0xbd, 0x82, 0x40, 0x66, 0x64, 0x2f, 0x68, 0x96, 0x5b, 0xb1, 0x17,
-	0xca, 0xe1, 0xfb, 0xa1, 0x37, 0xe9, 0xc7, 0xbe, 0xcc, 0x96, 0xff, 0x44, 0xf4, 0x11, 0x9e, 0x37,
-	0x3c, 0x24, 0x2d, 0x9c, 0xc8, 0x08, 0xd7, 0xbf, 0xd4, 0x4e, 0xaa, 0x5b, 0xdc, 0x09, 0xbd, 0x89,
-	0x1f, 0xe3, 0x86, 0xe3, 0x53, 0x69, 0xf8, 0x7c, 0xe0, 0xe3, 0x3f, 0x1e, 0x0c, 0x13, 0x61, 0x7f,
-	0x4a, 0x26, 0x8e, 0x55, 0x03, 0x68, 0x49, 0x53, 0xb5, 0x1b, 0xc4, 0x2d, 0x69, 0xd0, 0x33, 0xe8,
-	0x3b, 0x66, 0x88, 0xd1, 0xd6, 0x55, 0xd9, 0xfd, 0xb8, 0xe7, 0x98, 0xd9, 0x68, 0xeb, 0x4a, 0x94,
-	0xf3, 0x03, 0x6a, 0xd7, 0x28, 0xe7, 0x35, 0x3a, 0x03, 0xc8, 0xea, 0x8b, 0x89, 0xe4, 0x55, 0x74,
-	0x3f, 0x1e, 0x1c, 0x94, 0x05, 0x47, 0x2f, 0xe1, 0xc1, 0x1d, 0x76, 0xcc, 0xe0, 0x4e, 0xd8, 0x9e,
-	0xf8, 0xf1, 0xdd, 0x89, 0x6b, 0x66, 0x9a, 0x86, 0x9c, 0x1b, 0xdc, 0x3d, 0x31, 0x7c, 0xe3, 0xa6,
-	0x7c, 0x35, 0x63, 0x25, 0x13, 0xb8, 0x57, 0x25, 0xad, 0x07, 0xf4, 0x1a, 0x46, 0xa9, 0x50, 0xe2,
-	0x87, 0x64, 0x92, 0xda, 0x82, 0x50, 0xce, 0x2d, 0xee, 0x57, 0x86, 0x61, 0x43, 0x8f, 0x38, 0xb7,
-	0xe3, 0x2d, 0x04, 0x89, 0xb3, 0x82, 0xee, 0x8f, 0xcd, 0x4f, 0x33, 0x7b, 0xff, 0x67, 0x7e, 0x0a,
-	0xbd, 0xb2, 0x69, 0xc9, 0xea, 0x77, 0xe8, 0x96, 0xe3, 0x82, 0x97, 0xe7, 0x64, 0x46, 0x0c, 0x2d,
-	0xaa, 0x6f, 0x6a, 0x57, 0xdf, 0x34, 0x90, 0xd9, 0xa6, 0x16, 0xde, 0x10, 0x08, 0x4e, 0x17, 0x04,
-	0x3d, 0x82, 0xe1, 0x7c, 0x35, 0x8b, 0x6f, 0x36, 0xd7, 0x8b, 0xf5, 0x8a, 0xac, 0xd6, 0xab, 0xf9,
-	0xe8, 0x1e, 0x0a, 0xe1, 0x45, 0x43, 0xfc, 0x9e, 0x44, 0x57, 0x49, 0x74, 0x71, 0x4e, 0x36, 0xeb,
-	0xab, 0x9b, 0x77, 0x97, 0xe7, 0xef, 0x47, 0x1e, 0x7a, 0x02, 0xa8, 0xe1, 0x88, 0xe6, 0x09, 0xf9,
-	0x32, 0x5b, 0x8e, 0x5a, 0x69, 0xb7, 0x5a, 0xdf, 0xcb, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x04,
-	0x26, 0x68, 0x72, 0xcf, 0x02, 0x00, 0x00,
+func init() { proto.RegisterFile("pb/tuna.proto", fileDescriptor_tuna_107268b2b3777a6d) }
+
+var fileDescriptor_tuna_107268b2b3777a6d = []byte{
+	// 775 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0x6d, 0x6f, 0x23, 0x35,
+	0x10, 0x66, 0xf3, 0xd6, 0xec, 0xb4, 0x79, 0x39, 0xf3, 0x72, 0x4b, 0xb9, 0x8a, 0x25, 0x12, 0x28,
+	0x80, 0x54, 0x7a, 0x3d, 0x21, 0x10, 0xf0, 0x25, 0x94, 0x88, 0xab, 0x68, 0xd3, 0xca, 0x69, 0x25,
+	0x4e, 0x7c, 0x58, 0x39, 0xb6, 0x49, 0xac, 0x26, 0x5e, 0x9f, 0xed, 0x2d, 0xca, 0x6f, 0xe3, 0xf7,
+	0xf0, 0x2f, 0xf8, 0x80, 0x6c, 0x67, 0x73, 0x9b, 0xdc, 0x07, 0xa4, 0xfb, 0xb6, 0xf3, 0x3c, 0x33,
+	0xb3, 0x33, 0x8f, 0x67, 0x06, 0x3a, 0x6a, 0xf6, 0x8d, 0x2d, 0x24, 0x39, 0x55, 0x3a, 0xb7, 0x39,
+	0xaa, 0xa9, 0xd9, 0xe0, 0xdf, 0x1a, 0xa0, 0x8b, 0x5c, 0x4a, 0x4e, 0xad, 0xc8, 0xe5, 0x35, 0xb7,
+	0x84, 0x11, 0x4b, 0xd0, 0x8f, 0xd0, 0xe3, 0x92, 0xea, 0xb5, 0x72, 0x68, 0x46, 0x96, 0xf3, 0x3c,
+	0x89, 0xd2, 0x68, 0xd8, 0x3d, 0x47, 0xa7, 0x6a, 0x76, 0x3a, 0xde, 0x52, 0xa3, 0xe5, 0x3c, 0xc7,
+	0x5d, 0xbe, 0x63, 0xa3, 0x13, 0x00, 0x55, 0xcc, 0x96, 0x82, 0x66, 0x0f, 0x7c, 0x9d, 0xd4, 0xd2,
+	0x68, 0x78, 0x84, 0xe3, 0x80, 0xfc, 0xc6, 0xd7, 0xe8, 0x03, 0x68, 0xca, 0x5c, 0x52, 0x9e, 0xd4,
+	0x3d, 0x13, 0x0c, 0xf4, 0x39, 0x74, 0x85, 0xc9, 0x56, 0x9c, 0x98, 0x42, 0xf3, 0x15, 0x97, 0x36,
+	0x69, 0xa4, 0xd1, 0xb0, 0x8d, 0x3b, 0xc2, 0x5c, 0xbf, 0x01, 0xd1, 0x4f, 0x70, 0x5c, 0xf1, 0xc9,
+	0x66, 0x6b, 0xcb, 0x4d, 0xc6, 0xf2, 0xbf, 0xe4, 0x52, 0xc8, 0x87, 0xa4, 0x99, 0x46, 0xc3, 0x0e,
+	0x4e, 0x2a, 0x1e, 0x3f, 0x3b, 0x87, 0x5f, 0x36, 0x3c, 0x4a, 0xe1, 0x90, 0xe6, 0x2b, 0xa5, 0xb9,
+	0x31, 0x22, 0x97, 0x49, 0xcb, 0xff, 0xa1, 0x0a, 0xa1, 0xaf, 0xe1, 0x89, 0xe1, 0xfa, 0x51, 0x50,
+	0x9e, 0x2d, 0x88, 0x64, 0x66, 0x41, 0x1e, 0x78, 0x72, 0xe0, 0xfd, 0xfa, 0x1b, 0xe2, 0x65, 0x89,
+	0xa3, 0xcf, 0xe0, 0x68, 0xc1, 0xc9, 0xd2, 0x2e, 0x32, 0xba, 0xe0, 0xf4, 0x21, 0x69, 0x87, 0x7c,
+	0x01, 0xbb, 0x70, 0x90, 0xd3, 0x82, 0x4b, 0xab, 0xd7, 0x19, 0x29, 0xec, 0x22, 0x89, 0xbd, 0x43,
+	0xec, 0x91, 0x51, 0x61, 0x17, 0x83, 0x33, 0xe8, 0x8f, 0x4b, 0x03, 0xf3, 0xd7, 0x05, 0x37, 0x16,
+	0x3d, 0x83, 0xd8, 0x88, 0xb9, 0x24, 0xb6, 0xd0, 0xdc, 0xab, 0x7e, 0x84, 0xdf, 0x00, 0x83, 0x31,
+	0x3c, 0xa9, 0x44, 0x18, 0x95, 0x4b, 0xc3, 0xd1, 0x31, 0xb4, 0x09, 0xa5, 0x5c, 0x59, 0xce, 0x7c,
+	0x44, 0x1b, 0x6f, 0x6d, 0x27, 0x37, 0xd7, 0x3a, 0xd7, 0xfe, 0x21, 0x62, 0x1c, 0x8c, 0xc1, 0x1f,
+	0xf0, 0x74, 0xba, 0xd7, 0x4e, 0xf9, 0xff, 0x13, 0x80, 0x52, 0x02, 0x11, 0xd2, 0x75, 0x70, 0xbc,
+	0x41, 0x2e, 0x99, 0x6b, 0xba, 0xa4, 0x25, 0x59, 0xf1, 0x4d, 0xda, 0xc3, 0x0d, 0x36, 0x21, 0x2b,
+	0x3e, 0xb8, 0x82, 0xe4, 0xed, 0xe4, 0xef, 0x5c, 0xea, 0xdf, 0x75, 0xe8, 0x6d, 0xd2, 0x6d, 0xe7,
+	0xb3, 0x0b, 0x35, 0xa1, 0x7c, 0x7c, 0x8c, 0x6b, 0x42, 0xa1, 0x8f, 0xa1, 0x6d, 0xa9, 0xca, 0x54,
+	0xae, 0xad, 0x0f, 0xee, 0xe0, 0x03, 0x4b, 0xd5, 0x6d, 0xae, 0xad, 0xa3, 0x0a, 0xb6, 0xa1, 0xea,
+	0x81, 0x2a, 0x58, 0xa0, 0x76, 0x3b, 0x6d, 0xec, 0x77, 0xfa, 0x29, 0x94, 0x5d, 0x65, 0x96, 0xaa,
+	0xa4, 0x99, 0xd6, 0x87, 0x1d, 0x5c, 0x46, 0xdc, 0x51, 0x55, 0x75, 0x28, 0x98, 0x4a, 0x5a, 0x3b,
+	0x0e, 0xf7, 0x4c, 0xb9, 0x86, 0x94, 0x16, 0x34, 0x4c, 0x50, 0x8c, 0x83, 0x81, 0xbe, 0x84, 0xfe,
+	0x8c, 0x4b, 0xfe, 0xa7, 0xa0, 0x82, 0xb8, 0xc9, 0x60, 0x4c, 0xfb, 0xd1, 0x89, 0x71, 0xaf, 0x82,
+	0x8f, 0x18, 0xd3, 0x28, 0x81, 0x83, 0x47, 0xae, 0xfd, 0xb0, 0xc6, 0xa1, 0xf6, 0x8d, 0x89, 0x9e,
+	0x43, 0xc3, 0x92, 0xb9, 0x49, 0x20, 0xad, 0x0f, 0x0f, 0xcf, 0x4f, 0xdc, 0x5a, 0xee, 0x89, 0x74,
+	0x7a, 0x47, 0xe6, 0xc6, 0xcf, 0x0a, 0xf6, 0xae, 0x7e, 0x2f, 0xb5, 0x2f, 0x56, 0x0a, 0x9b, 0x1c,
+	0xa6, 0xd1, 0xb0, 0x81, 0x63, 0x8f, 0xdc, 0x4b, 0x61, 0xd1, 0x27, 0x10, 0xbf, 0x2e, 0x04, 0x0d,
+	0x4a, 0x1d, 0xf9, 0xbf, 0xb5, 0x1d, 0xe0, 0xa4, 0x3a, 0xfe, 0x0e, 0xe2, 0x6d, 0x3a, 0xd4, 0x87,
+	0xba, 0xdb, 0xec, 0x20, 0xbf, 0xfb, 0x74, 0x8d, 0x3e, 0x92, 0x65, 0x51, 0x4e, 0x43, 0x30, 0x7e,
+	0xa8, 0x7d, 0x1f, 0x0d, 0xfe, 0x89, 0xa0, 0x3b, 0xb5, 0x9a, 0x93, 0xd5, 0xf6, 0xf1, 0xfe, 0x67,
+	0xc0, 0x9e, 0xc2, 0x81, 0x2b, 0xc1, 0x71, 0xe1, 0x29, 0x5b, 0xce, 0xbc, 0x64, 0x2e, 0x4e, 0x98,
+	0x4c, 0x91, 0xb5, 0x3f, 0x0f, 0xf5, 0xb0, 0x4b, 0xc2, 0xdc, 0x06, 0xc0, 0xd5, 0xcf, 0xb8, 0xb1,
+	0x41, 0xcf, 0x86, 0xaf, 0xa3, 0xed, 0x00, 0x2f, 0xe4, 0xde, 0xe6, 0x37, 0xdf, 0xde, 0xfc, 0x2f,
+	0xa0, 0x27, 0x4c, 0xb6, 0xb3, 0xcf, 0xad, 0xf2, 0x02, 0xbd, 0xac, 0x6c, 0xf4, 0x87, 0xd0, 0x12,
+	0xc6, 0xbf, 0x77, 0x38, 0x0b, 0x4d, 0x61, 0xee, 0x99, 0xfa, 0x2a, 0x83, 0xee, 0xee, 0x59, 0x44,
+	0xef, 0x43, 0x6f, 0x3c, 0xb9, 0xc0, 0xaf, 0x6e, 0xef, 0x2e, 0x6f, 0x26, 0xd9, 0xe4, 0x66, 0x32,
+	0xee, 0xbf, 0x87, 0x52, 0x78, 0x56, 0x01, 0x7f, 0x9f, 0x8e, 0xae, 0xa6, 0xa3, 0xf3, 0xb3, 0xec,
+	0xf6, 0xe6, 0xea, 0xd5, 0xf3, 0x17, 0x67, 0xdf, 0xf6, 0x23, 0xf4, 0x11, 0xa0, 0x8a, 0xc7, 0x68,
+	0x3c, 0xcd, 0x7e, 0xbd, 0xb8, 0xee, 0xd7, 0x66, 0x2d, 0x7f, 0xb4, 0x5f, 0xfc, 0x37, 0x00, 0xda,
+	0x65, 0x11, 0x02, 0xc5, 0x05, 0x00, 0x00,
 }
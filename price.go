@@ -0,0 +1,142 @@
+package tuna
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/pb"
+)
+
+// priceUnits are the units accepted after "/" in a price string.
+var priceUnits = map[string]uint64{
+	"B":  1,
+	"KB": 1024,
+	"MB": TrafficUnit,
+	"GB": 1024 * TrafficUnit,
+}
+
+// Price is the price of tunneled traffic in unit of NKN per Unit bytes,
+// charged separately for each direction. Zero Unit means TrafficUnit (MB).
+type Price struct {
+	EntryToExit common.Fixed64
+	ExitToEntry common.Fixed64
+	Unit        uint64
+}
+
+// ParsePrice parses a price string in the format of "entryToExit,exitToEntry",
+// e.g. "0.001,0.002". Spaces around values are ignored. If only one value is
+// given, e.g. "0.001", it is used for both directions. The price is per MB by
+// default, other units can be given after "/", e.g. "0.001,0.002/GB". Accepted
+// units are B, KB, MB and GB, or a number of bytes like "/4096".
+func ParsePrice(priceStr string) (Price, error) {
+	var unit uint64
+	if i := strings.LastIndex(priceStr, "/"); i >= 0 {
+		unitStr := strings.ToUpper(strings.Trim(priceStr[i+1:], " "))
+		var ok bool
+		unit, ok = priceUnits[unitStr]
+		if !ok {
+			var err error
+			unit, err = strconv.ParseUint(unitStr, 10, 64)
+			if err != nil || unit == 0 {
+				return Price{}, fmt.Errorf("unknown price unit %q", priceStr[i+1:])
+			}
+		}
+		if unit == TrafficUnit {
+			unit = 0
+		}
+		priceStr = priceStr[:i]
+	}
+	price := strings.Split(priceStr, ",")
+	entryToExitPrice, err := common.StringToFixed64(strings.Trim(price[0], " "))
+	if err != nil {
+		return Price{}, err
+	}
+	var exitToEntryPrice common.Fixed64
+	if len(price) > 1 {
+		exitToEntryPrice, err = common.StringToFixed64(strings.Trim(price[1], " "))
+		if err != nil {
+			return Price{}, err
+		}
+	} else {
+		exitToEntryPrice = entryToExitPrice
+	}
+	return Price{EntryToExit: entryToExitPrice, ExitToEntry: exitToEntryPrice, Unit: unit}, nil
+}
+
+// parseMetadataPrice parses the price of service metadata, which is in unit
+// of metadata PriceUnit if set.
+func parseMetadataPrice(metadata *pb.ServiceMetadata) (Price, error) {
+	price, err := ParsePrice(metadata.Price)
+	if err != nil {
+		return Price{}, err
+	}
+	if metadata.PriceUnit > 0 && metadata.PriceUnit != price.unit() {
+		return Price{}, fmt.Errorf("price %s does not match price unit %d", metadata.Price, metadata.PriceUnit)
+	}
+	return price, nil
+}
+
+// unit returns the number of bytes price is charged per.
+func (p Price) unit() uint64 {
+	if p.Unit == 0 {
+		return TrafficUnit
+	}
+	return p.Unit
+}
+
+// String returns the price in the format accepted by ParsePrice. A single value
+// is returned if both directions have the same price, and a unit without name
+// is given in bytes.
+func (p Price) String() string {
+	var s string
+	if p.EntryToExit == p.ExitToEntry {
+		s = p.EntryToExit.String()
+	} else {
+		s = p.EntryToExit.String() + "," + p.ExitToEntry.String()
+	}
+	if p.unit() != TrafficUnit {
+		for name, unit := range priceUnits {
+			if unit == p.Unit {
+				return s + "/" + name
+			}
+		}
+		return s + "/" + strconv.FormatUint(p.Unit, 10)
+	}
+	return s
+}
+
+// Cost returns the cost of traffic in each direction at price p.
+func (p Price) Cost(bytesEntryToExit, bytesExitToEntry uint64) common.Fixed64 {
+	return directionCost(p.EntryToExit, bytesEntryToExit, p.unit()) + directionCost(p.ExitToEntry, bytesExitToEntry, p.unit())
+}
+
+// directionCost returns price * bytes / unit, computed without overflow of
+// the intermediate product.
+func directionCost(price common.Fixed64, bytes, unit uint64) common.Fixed64 {
+	cost := new(big.Int).Mul(big.NewInt(int64(price)), new(big.Int).SetUint64(bytes))
+	cost.Quo(cost, new(big.Int).SetUint64(unit))
+	return common.Fixed64(cost.Int64())
+}
+
+// perTrafficUnit returns price of both directions per TrafficUnit bytes.
+func (p Price) perTrafficUnit() float64 {
+	return float64(p.EntryToExit+p.ExitToEntry) * TrafficUnit / float64(p.unit())
+}
+
+// Exceeds returns true if price of either direction is higher than max. Prices
+// of different units are compared per byte.
+func (p Price) Exceeds(max Price) bool {
+	return priceGreater(p.EntryToExit, p.unit(), max.EntryToExit, max.unit()) ||
+		priceGreater(p.ExitToEntry, p.unit(), max.ExitToEntry, max.unit())
+}
+
+// priceGreater returns true if a per aUnit bytes is higher than b per bUnit
+// bytes, without overflow.
+func priceGreater(a common.Fixed64, aUnit uint64, b common.Fixed64, bUnit uint64) bool {
+	x := new(big.Int).Mul(big.NewInt(int64(a)), new(big.Int).SetUint64(bUnit))
+	y := new(big.Int).Mul(big.NewInt(int64(b)), new(big.Int).SetUint64(aUnit))
+	return x.Cmp(y) > 0
+}
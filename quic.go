@@ -0,0 +1,210 @@
+package tuna
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// TransportTCP runs session between entry and exit over a TCP connection.
+	TransportTCP = "tcp"
+	// TransportQUIC runs session between entry and exit over a QUIC stream,
+	// which avoids TCP head-of-line blocking on lossy links.
+	TransportQUIC = "quic"
+
+	quicALPN             = "tuna"
+	quicKeepAlivePeriod  = 15 * time.Second
+	quicHandshakeTimeout = 10 * time.Second
+	quicCloseTimeout     = 3 * time.Second
+)
+
+// quicConn is a QUIC stream used as net.Conn. Each QUIC connection carries a
+// single stream, on which smux multiplexes streams as it does over TCP, so
+// session handling is the same for both transports.
+type quicConn struct {
+	*quic.Stream
+	conn      *quic.Conn
+	closeOnce sync.Once
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the stream and then the QUIC connection. Closing connection
+// discards data not yet delivered, so it's delayed to give the peer time to
+// receive it, unless the peer closes the connection first.
+func (c *quicConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Stream.Close()
+		c.Stream.CancelRead(0)
+		go func() {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(quicCloseTimeout):
+			}
+			c.conn.CloseWithError(0, "")
+		}()
+	})
+	return err
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicHandshakeTimeout,
+		KeepAlivePeriod:      quicKeepAlivePeriod,
+	}
+}
+
+// dialQUIC connects to a QUIC listener of exit and opens the stream session
+// runs over.
+func dialQUIC(address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Exit uses a self-signed certificate. It is authenticated the same way
+	// as over TCP, by its NKN key in connection handshake and encryption.
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicALPN},
+	}
+	conn, err := quic.DialAddr(ctx, address, tlsConfig, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
+
+// quicListener accepts QUIC connections and returns the first stream of each
+// of them as net.Conn.
+type quicListener struct {
+	listener  *quic.Listener
+	conns     chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenQUIC listens for QUIC connections from entries on addr using a
+// self-signed certificate. Connections returned by Accept of the listener can
+// be served by TunaExit.ServeConn like TCP connections.
+func ListenQUIC(addr string) (net.Listener, error) {
+	tlsConfig, err := newQUICServerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := quic.ListenAddr(addr, tlsConfig, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	l := &quicListener{
+		listener:  listener,
+		conns:     make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+	go l.acceptLoop()
+
+	return l, nil
+}
+
+func (l *quicListener) acceptLoop() {
+	defer l.Close()
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			if !errors.Is(err, quic.ErrServerClosed) {
+				log.Println("Couldn't accept QUIC connection:", err)
+			}
+			return
+		}
+		// stream is only accepted after entry writes to it, so it's waited
+		// in a separate goroutine to not block other connections
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				conn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case l.conns <- &quicConn{Stream: stream, conn: conn}:
+			case <-l.closeChan:
+				conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+// Accept returns net.ErrClosed after listener is closed, which has the same
+// message as error returned by a closed TCP listener.
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// newQUICServerTLSConfig returns TLS config with a self-signed certificate
+// generated in memory, since TLS is only used by QUIC for transport security
+// and exit identity is verified by its NKN key.
+func newQUICServerTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+		NextProtos:   []string{quicALPN},
+	}, nil
+}
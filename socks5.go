@@ -0,0 +1,119 @@
+package tuna
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version              = 5
+	socks5AuthNone             = 0
+	socks5AuthNoAcceptable     = 0xff
+	socks5CmdConnect           = 1
+	socks5AddrTypeIPv4         = 1
+	socks5AddrTypeDomain       = 3
+	socks5AddrTypeIPv6         = 4
+	socks5ReplySucceeded       = 0
+	socks5ReplyGeneralFailure  = 1
+	socks5ReplyCmdUnsupported  = 7
+	socks5ReplyAddrUnsupported = 8
+	socks5HandshakeTimeout     = 10 * time.Second
+)
+
+// socks5Handshake performs the server side of a SOCKS5 handshake without
+// authentication and returns the requested destination address. Only CONNECT
+// command is supported. A successful reply is not sent so that the caller can
+// report failure if the destination could not be reached.
+func socks5Handshake(conn net.Conn) (string, error) {
+	err := conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	if err != nil {
+		return "", err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	hasAuthNone := false
+	for _, method := range methods {
+		if method == socks5AuthNone {
+			hasAuthNone = true
+			break
+		}
+	}
+	if !hasAuthNone {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", errors.New("no acceptable socks auth method")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d", request[0])
+	}
+	if request[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5ReplyCmdUnsupported)
+		return "", fmt.Errorf("unsupported socks command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrTypeIPv4, socks5AddrTypeIPv6:
+		ipLen := net.IPv4len
+		if request[3] == socks5AddrTypeIPv6 {
+			ipLen = net.IPv6len
+		}
+		ip := make([]byte, ipLen)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrTypeDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, domainLen); err != nil {
+			return "", err
+		}
+		domain := make([]byte, int(domainLen[0]))
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5ReplyAddrUnsupported)
+		return "", fmt.Errorf("unsupported socks address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Reply sends a SOCKS5 reply with an empty bound address.
+func socks5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0, socks5AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,102 @@
+package tuna
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// socks5Request sends greeting and then request on client as a SOCKS5 client
+// without authentication. It returns a channel receiving the method selection
+// and then the reply of server.
+func socks5Request(client net.Conn, request []byte) chan []byte {
+	replies := make(chan []byte, 2)
+	go func() {
+		defer close(replies)
+		if _, err := client.Write([]byte{socks5Version, 1, socks5AuthNone}); err != nil {
+			return
+		}
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(client, method); err != nil {
+			return
+		}
+		replies <- method
+		if _, err := client.Write(request); err != nil {
+			return
+		}
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			return
+		}
+		replies <- reply
+	}()
+	return replies
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		dest    string
+	}{
+		{
+			name:    "ipv4",
+			request: []byte{socks5Version, socks5CmdConnect, 0, socks5AddrTypeIPv4, 1, 2, 3, 4, 0x1f, 0x90},
+			dest:    "1.2.3.4:8080",
+		},
+		{
+			name:    "domain",
+			request: append(append([]byte{socks5Version, socks5CmdConnect, 0, socks5AddrTypeDomain, 11}, "example.com"...), 0x01, 0xbb),
+			dest:    "example.com:443",
+		},
+		{
+			name:    "ipv6",
+			request: append(append([]byte{socks5Version, socks5CmdConnect, 0, socks5AddrTypeIPv6}, net.ParseIP("2001:db8::1")...), 0, 80),
+			dest:    "[2001:db8::1]:80",
+		},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		replies := socks5Request(client, tt.request)
+
+		dest, err := socks5Handshake(server)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if dest != tt.dest {
+			t.Fatalf("%s: expect destination %s, got %s", tt.name, tt.dest, dest)
+		}
+		if method := <-replies; !bytes.Equal(method, []byte{socks5Version, socks5AuthNone}) {
+			t.Fatalf("%s: expect no authentication to be selected, got %v", tt.name, method)
+		}
+
+		// success is only replied after destination is connected
+		go socks5Reply(server, socks5ReplySucceeded)
+		if reply := <-replies; len(reply) < 2 || reply[1] != socks5ReplySucceeded {
+			t.Fatalf("%s: expect succeeded reply, got %v", tt.name, reply)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSocks5HandshakeUnsupportedCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// handshake replies right after the request header with BIND command, so
+	// address is not sent to not block the synchronous pipe
+	replies := socks5Request(client, []byte{socks5Version, 2, 0, socks5AddrTypeIPv4})
+
+	if _, err := socks5Handshake(server); err == nil {
+		t.Fatal("expect BIND command to be rejected")
+	}
+	<-replies
+	if reply := <-replies; len(reply) < 2 || reply[1] != socks5ReplyCmdUnsupported {
+		t.Fatalf("expect command unsupported reply, got %v", reply)
+	}
+}
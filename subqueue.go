@@ -1,15 +1,24 @@
 package tuna
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna/util"
 )
 
 const (
-	subQueueLen = 1024
-	maxRetry    = 3
+	subQueueLen            = 1024
+	maxRetry               = 3
+	subRetryIntervalMin    = time.Second
+	subRetryIntervalMax    = 8 * time.Second
+	subscribeLimitPeriod   = 24 * time.Hour
+	resubscribeIntervalMin = time.Minute
 )
 
 type subscribeData struct {
@@ -19,6 +28,8 @@ type subscribeData struct {
 	duration   int
 	meta       string
 	config     *nkn.TransactionConfig
+	limiter    *subscribeLimiter
+	result     chan error
 }
 
 var subQueue chan *subscribeData
@@ -27,33 +38,98 @@ func init() {
 	subQueue = make(chan *subscribeData, subQueueLen)
 	go func() {
 		for subData := range subQueue {
-			for i := 0; i < maxRetry; i++ {
-				txnHash, err := subData.wallet.Subscribe(subData.identifier, subData.topic, subData.duration, subData.meta, subData.config)
-				if err != nil {
-					log.Println("subscribe to topic", subData.topic, "error:", err)
-					time.Sleep(time.Second)
-					continue
-				}
-				log.Println("Subscribed to topic", subData.topic, "success:", txnHash)
-				break
-			}
+			subData.done(subscribe(subData))
 			time.Sleep(time.Second)
 		}
 	}()
 }
 
-func addToSubscribeQueue(wallet *nkn.Wallet, identifier string, topic string, duration int, meta string, config *nkn.TransactionConfig) {
-	subData := &subscribeData{
-		wallet:     wallet,
-		identifier: identifier,
-		topic:      topic,
-		duration:   duration,
-		meta:       meta,
-		config:     config,
+// subscribe tries to subscribe up to maxRetry times with exponential backoff
+// between attempts, and returns the last error.
+func subscribe(subData *subscribeData) error {
+	backoff := util.NewBackoff(subRetryIntervalMin, subRetryIntervalMax)
+	var err error
+	for i := 0; i < maxRetry; i++ {
+		if i > 0 {
+			time.Sleep(backoff.Next())
+		}
+		if !subData.limiter.allow() {
+			err = fmt.Errorf("%w: %d attempts in %v", ErrSubscribeLimitReached, subData.limiter.max, subscribeLimitPeriod)
+			log.Println("subscribe to topic", subData.topic, "error:", err)
+			return err
+		}
+		var txnHash string
+		txnHash, err = subData.wallet.Subscribe(subData.identifier, subData.topic, subData.duration, subData.meta, subData.config)
+		if err != nil {
+			log.Println("subscribe to topic", subData.topic, "error:", err)
+			if isFeeTooLowErr(err) {
+				// retrying immediately with the same fee won't help
+				return fmt.Errorf("%w: %v", ErrSubscriptionFeeTooLow, err)
+			}
+			continue
+		}
+		log.Println("Subscribed to topic", subData.topic, "success:", txnHash)
+		return nil
+	}
+	return err
+}
+
+// txnPoolLowPriorityErrMsg is the error message of node txn pool rejecting a
+// transaction whose fee is lower than the txns it already holds when full.
+const txnPoolLowPriorityErrMsg = "rejecting transaction with low priority"
+
+// isFeeTooLowErr returns whether err is caused by transaction fee lower than
+// what txn pool of the node currently accepts.
+func isFeeTooLowErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), txnPoolLowPriorityErrMsg)
+}
+
+// done reports the result of subscription if anyone is waiting for it.
+func (subData *subscribeData) done(err error) {
+	if subData.result != nil {
+		subData.result <- err
 	}
+}
+
+func addToSubscribeQueue(subData *subscribeData) {
 	select {
 	case subQueue <- subData:
 	default:
 		log.Println("Subscribe queue full, discard request.")
+		subData.done(errors.New("subscribe queue full"))
+	}
+}
+
+// subscribeLimiter limits the number of subscribe attempts, which may cost
+// fee even if failed, in each subscribeLimitPeriod. Max <= 0 or nil limiter
+// means no limit.
+type subscribeLimiter struct {
+	max int
+
+	sync.Mutex
+	attempts []time.Time
+}
+
+func newSubscribeLimiter(max int) *subscribeLimiter {
+	return &subscribeLimiter{max: max}
+}
+
+// allow records an attempt and returns true if limit is not reached.
+func (l *subscribeLimiter) allow() bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	i := 0
+	for i < len(l.attempts) && now.Sub(l.attempts[i]) >= subscribeLimitPeriod {
+		i++
+	}
+	l.attempts = l.attempts[i:]
+	if len(l.attempts) >= l.max {
+		return false
 	}
+	l.attempts = append(l.attempts, now)
+	return true
 }
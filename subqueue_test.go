@@ -0,0 +1,26 @@
+package tuna
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsFeeTooLowErr(t *testing.T) {
+	tests := []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{errors.New("txpool full, rejecting transaction with low priority"), true},
+		{errors.New("INTERNAL ERROR, can not append tx to txpool: txpool full, rejecting transaction with low priority"), true},
+		{errors.New("registration fee is lower than MinGenIDRegistrationFee"), false},
+		{errors.New("fee is too low for slow network"), false},
+		{errors.New("duplicate transaction check failed"), false},
+		{errors.New("not sufficient funds"), false},
+	}
+	for _, test := range tests {
+		if got := isFeeTooLowErr(test.err); got != test.expect {
+			t.Errorf("isFeeTooLowErr(%v) = %v, expect %v", test.err, got, test.expect)
+		}
+	}
+}
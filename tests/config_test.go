@@ -0,0 +1,191 @@
+package tests
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/util"
+)
+
+func TestEntryConfigValidate(t *testing.T) {
+	config := tuna.DefaultEntryConfig()
+	err := util.ReadJSON("../config.entry.json.example", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expect example config to be valid, got %v", err)
+	}
+
+	invalid := []func(c *tuna.EntryConfiguration){
+		func(c *tuna.EntryConfiguration) { c.DialTimeout = -1 },
+		func(c *tuna.EntryConfiguration) { c.DialTimeout = 0 },
+		func(c *tuna.EntryConfiguration) { c.SubscriptionPrefix = "" },
+		func(c *tuna.EntryConfiguration) { c.Services = nil },
+		func(c *tuna.EntryConfiguration) { c.Reverse = true; c.ReverseTCP = -1 },
+		func(c *tuna.EntryConfiguration) { c.Reverse = true; c.ReverseIP = "invalid" },
+		func(c *tuna.EntryConfiguration) { c.UDPLocalPortRange = "40100-40000" },
+		func(c *tuna.EntryConfiguration) { c.DNSResolver = "8.8.8.8" },
+		func(c *tuna.EntryConfiguration) { c.UDPChannelBufferSize = -1 },
+		func(c *tuna.EntryConfiguration) { c.Transport = "udp" },
+		func(c *tuna.EntryConfiguration) { c.Transport = tuna.TransportQUIC; c.Reverse = true },
+	}
+	for i, f := range invalid {
+		c := *config
+		f(&c)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expect case %d to be invalid", i)
+		}
+	}
+}
+
+func TestExitConfigEntryFilter(t *testing.T) {
+	wallet := newTestWallet(t)
+	services := []tuna.Service{{Name: "test", TCP: []uint32{80}}}
+	publicKey := hex.EncodeToString(wallet.PubKey())
+
+	valid := [][]string{
+		{publicKey},
+		{"identifier." + publicKey},
+	}
+	for _, entries := range valid {
+		config := &tuna.ExitConfiguration{AllowedEntries: entries, DeniedEntries: entries}
+		if _, err := tuna.NewTunaExit(services, wallet, config); err != nil {
+			t.Fatalf("expect entries %v to be valid, got %v", entries, err)
+		}
+	}
+
+	invalid := [][]string{
+		{"invalid"},
+		{publicKey[:10]},
+	}
+	for _, entries := range invalid {
+		config := &tuna.ExitConfiguration{AllowedEntries: entries}
+		if _, err := tuna.NewTunaExit(services, wallet, config); err == nil {
+			t.Fatalf("expect allowed entries %v to be invalid", entries)
+		}
+		config = &tuna.ExitConfiguration{DeniedEntries: entries}
+		if _, err := tuna.NewTunaExit(services, wallet, config); err == nil {
+			t.Fatalf("expect denied entries %v to be invalid", entries)
+		}
+	}
+}
+
+func TestExitConfigPayerLimits(t *testing.T) {
+	wallet := newTestWallet(t)
+	services := []tuna.Service{{Name: "test", TCP: []uint32{80}}}
+	publicKey := hex.EncodeToString(wallet.PubKey())
+
+	if _, err := tuna.NewTunaExit(services, wallet, &tuna.ExitConfiguration{MaxStreamsPerPayer: 1}); err == nil {
+		t.Fatal("expect per payer limits without authenticated payer to be invalid")
+	}
+	if _, err := tuna.NewTunaExit(services, wallet, &tuna.ExitConfiguration{MaxBandwidthPerPayer: 1}); err == nil {
+		t.Fatal("expect per payer limits without authenticated payer to be invalid")
+	}
+
+	valid := []*tuna.ExitConfiguration{
+		{MaxStreamsPerPayer: 1, RequireEncryption: true},
+		{MaxBandwidthPerPayer: 1, AllowedEntries: []string{publicKey}},
+		{MaxStreamsPerPayer: 1, DeniedEntries: []string{publicKey}},
+	}
+	for i, config := range valid {
+		if _, err := tuna.NewTunaExit(services, wallet, config); err != nil {
+			t.Fatalf("expect case %d to be valid, got %v", i, err)
+		}
+	}
+}
+
+func TestExitConfigListenQUIC(t *testing.T) {
+	wallet := newTestWallet(t)
+	services := []tuna.Service{{Name: "test", TCP: []uint32{80}}}
+
+	if _, err := tuna.NewTunaExit(services, wallet, &tuna.ExitConfiguration{ListenUDP: 30021, ListenQUIC: 30021}); err == nil {
+		t.Fatal("expect listenQUIC same as listenUDP to be invalid")
+	}
+	if _, err := tuna.NewTunaExit(services, wallet, &tuna.ExitConfiguration{ListenQUIC: -1}); err == nil {
+		t.Fatal("expect negative listenQUIC to be invalid")
+	}
+	if _, err := tuna.NewTunaExit(services, wallet, &tuna.ExitConfiguration{ListenUDP: 30021, ListenQUIC: 30022}); err != nil {
+		t.Fatalf("expect listenQUIC to be valid, got %v", err)
+	}
+}
+
+func TestExitConfigDynamicUpstream(t *testing.T) {
+	wallet := newTestWallet(t)
+	services := []tuna.Service{{Name: "test", TCP: []uint32{80}}}
+
+	config := &tuna.ExitConfiguration{Services: map[string]tuna.ExitServiceInfo{
+		"test": {AllowDynamicUpstream: true},
+	}}
+	if _, err := tuna.NewTunaExit(services, wallet, config); err == nil {
+		t.Fatal("expect dynamic upstream without allowedUpstreams to be invalid")
+	}
+
+	config = &tuna.ExitConfiguration{Services: map[string]tuna.ExitServiceInfo{
+		"test": {AllowDynamicUpstream: true, AllowedUpstreams: []string{"*:*"}},
+	}}
+	if _, err := tuna.NewTunaExit(services, wallet, config); err != nil {
+		t.Fatalf("expect dynamic upstream with allowedUpstreams to be valid, got %v", err)
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	cases := map[string]time.Duration{
+		`10`:      10 * time.Second,
+		`"3s"`:    3 * time.Second,
+		`"500ms"`: 500 * time.Millisecond,
+	}
+	for in, expected := range cases {
+		var d tuna.Duration
+		if err := json.Unmarshal([]byte(in), &d); err != nil {
+			t.Fatalf("unmarshal %s: %v", in, err)
+		}
+		if time.Duration(d) != expected {
+			t.Fatalf("unmarshal %s: expect %v, got %v", in, expected, time.Duration(d))
+		}
+	}
+
+	var d tuna.Duration
+	if err := json.Unmarshal([]byte(`"abc"`), &d); err == nil {
+		t.Fatal("expect error for invalid duration")
+	}
+}
+
+func TestReadConfigSourceStrict(t *testing.T) {
+	if err := util.ReadConfigSource("../config.entry.json.example", &tuna.EntryConfiguration{}, true); err != nil {
+		t.Fatalf("expect entry example config to have no unknown keys, got %v", err)
+	}
+	if err := util.ReadConfigSource("../config.exit.json.example", &tuna.ExitConfiguration{}, true); err != nil {
+		t.Fatalf("expect exit example config to have no unknown keys, got %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "tuna-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{"listenIP": "0.0.0.0", "listenIPs": "1.1.1.1"}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := util.ReadConfigSource(f.Name(), &tuna.EntryConfiguration{}, true); err == nil {
+		t.Fatal("expect error for unknown key in strict mode")
+	}
+	config := &tuna.EntryConfiguration{}
+	if err := util.ReadConfigSource(f.Name(), config, false); err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenIP != "0.0.0.0" {
+		t.Fatalf("expect listenIP 0.0.0.0, got %s", config.ListenIP)
+	}
+
+	if _, err := tuna.MergedEntryConfig(&tuna.EntryConfiguration{ConfigVersion: tuna.ConfigVersion + 1}); err == nil {
+		t.Fatal("expect error for newer config version")
+	}
+}
@@ -0,0 +1,28 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestConnIDToPort(t *testing.T) {
+	for _, port := range []uint16{0, 1, 80, 30080, 65535} {
+		p, err := tuna.ConnIDToPort(tuna.PortToConnID(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != port {
+			t.Fatalf("expect port %d, got %d", port, p)
+		}
+	}
+}
+
+func TestConnIDToPortShortBuffer(t *testing.T) {
+	for _, data := range [][]byte{nil, {}, {1}} {
+		_, err := tuna.ConnIDToPort(data)
+		if err == nil {
+			t.Fatalf("expect error for conn id %v", data)
+		}
+	}
+}
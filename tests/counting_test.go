@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestCountingReader(t *testing.T) {
+	var count uint64
+	r := tuna.NewCountingReader(iotest.OneByteReader(strings.NewReader("hello world")), &count)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Fatalf("unexpected data %q", b)
+	}
+	if r.Count() != 11 || count != 11 {
+		t.Fatalf("expect 11 bytes counted, got %d and %d", r.Count(), count)
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := tuna.NewCountingWriter(buf, nil)
+	if _, err := io.Copy(w, strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello world!" {
+		t.Fatalf("unexpected data %q", buf.String())
+	}
+	if w.Count() != 12 {
+		t.Fatalf("expect 12 bytes counted, got %d", w.Count())
+	}
+}
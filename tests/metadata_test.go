@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna"
+)
+
+func TestReadMetadataFromStreamFragmented(t *testing.T) {
+	raw := tuna.CreateRawMetadata(1, []uint32{80}, nil, "127.0.0.1", 30020, 0, 0, "0.001", "", map[string]string{"region": "eu"})
+
+	buf := &bytes.Buffer{}
+	if err := tuna.WriteVarBytes(buf, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := tuna.ReadMetadataFromStream(iotest.OneByteReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Ip != "127.0.0.1" || metadata.TcpPort != 30020 || metadata.Tags["region"] != "eu" {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+}
+
+func TestReadVarBytesMaxSize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := tuna.WriteVarBytes(buf, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tuna.ReadVarBytes(buf, 8); err == nil {
+		t.Fatal("expect error for message exceeding max size")
+	}
+}
+
+func TestReadMetadataFromStreamTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := tuna.WriteVarBytes(buf, make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tuna.ReadMetadataFromStream(buf); !errors.Is(err, tuna.ErrMetadataTooLarge) {
+		t.Fatalf("expect ErrMetadataTooLarge, got %v", err)
+	}
+}
+
+func TestBuildMetadata(t *testing.T) {
+	raw, topic, err := tuna.BuildMetadata("httpproxy", 0, nil, nil, "127.0.0.1", 30020, 30021, 0, "0.001", "", nil, tuna.DefaultSubscriptionPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic != tuna.DefaultSubscriptionPrefix+"httpproxy" {
+		t.Fatalf("unexpected topic %s", topic)
+	}
+	metadata, err := tuna.ReadMetadata(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.TcpPort != 30020 || metadata.UdpPort != 30021 {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+
+	if _, _, err := tuna.BuildMetadata("httpproxy", 0, nil, nil, "127.0.0.1", 30020, 30021, 0, "abc", "", nil, tuna.DefaultSubscriptionPrefix); err == nil {
+		t.Fatal("expect error for invalid price")
+	}
+	if _, _, err := tuna.BuildMetadata("httpproxy", 0, nil, nil, "127.0.0.1", 30020, 30021, 0, "0.001", "invalid", nil, tuna.DefaultSubscriptionPrefix); err == nil {
+		t.Fatal("expect error for invalid beneficiary address")
+	}
+}
+
+func TestInspectService(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+
+	reachable, _, err := tuna.BuildMetadata("test", 0, nil, nil, "127.0.0.1", port, 0, 0, "0.001,0.002", "", nil, tuna.DefaultSubscriptionPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &fakeSubscriberSource{subscribers: map[string]string{
+		"exit.a": string(reachable),
+		"exit.b": "invalid",
+	}}
+
+	infos, err := tuna.InspectService(source, tuna.DefaultSubscriptionPrefix, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Address != "exit.a" || infos[1].Address != "exit.b" {
+		t.Fatalf("unexpected subscribers %+v", infos)
+	}
+	if infos[0].Err != nil || !infos[0].Reachable || infos[0].Metadata.TcpPort != port {
+		t.Fatalf("expect exit.a to be parsed and reachable, got %+v", infos[0])
+	}
+	if infos[0].Price.EntryToExit != common.Fixed64(0.001*common.StorageFactor) || infos[0].Price.ExitToEntry != common.Fixed64(0.002*common.StorageFactor) {
+		t.Fatalf("expect price 0.001,0.002, got %s", infos[0].Price)
+	}
+	if !errors.Is(infos[1].Err, tuna.ErrInvalidMetadata) || infos[1].Reachable {
+		t.Fatalf("expect exit.b to have invalid metadata, got %+v", infos[1])
+	}
+}
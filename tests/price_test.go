@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestParsePrice(t *testing.T) {
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{"0.001", "0.00100000"},
+		{"0.001, 0.002", "0.00100000,0.00200000"},
+		{"1,1", "1"},
+		{"0.1, 0.2 / gb", "0.10000000,0.20000000/GB"},
+		{"0.001/MB", "0.00100000"},
+		{"1/4096", "1/4096"},
+		{"1/1024", "1/KB"},
+	}
+	for _, c := range cases {
+		price, err := tuna.ParsePrice(c.in)
+		if err != nil {
+			t.Fatalf("parse %q: %v", c.in, err)
+		}
+		if price.String() != c.out {
+			t.Fatalf("parse %q: expect %q, got %q", c.in, c.out, price.String())
+		}
+		roundTrip, err := tuna.ParsePrice(price.String())
+		if err != nil || roundTrip != price {
+			t.Fatalf("round trip %q: got %v, %v", c.in, roundTrip, err)
+		}
+	}
+
+	if _, err := tuna.ParsePrice("abc"); err == nil {
+		t.Fatal("expect error for invalid price")
+	}
+	if _, err := tuna.ParsePrice("1/0"); err == nil {
+		t.Fatal("expect error for zero price unit")
+	}
+
+	max, _ := tuna.ParsePrice("0.001,0.002")
+	price, _ := tuna.ParsePrice("0.001,0.003")
+	if !price.Exceeds(max) {
+		t.Fatalf("expect %v to exceed %v", price, max)
+	}
+	if max.Exceeds(max) {
+		t.Fatal("expect price not to exceed itself")
+	}
+	if _, err := tuna.ParsePrice("0.001/TB"); err == nil {
+		t.Fatal("expect error for unknown price unit")
+	}
+
+	perGB, _ := tuna.ParsePrice("2/GB")
+	perMB, _ := tuna.ParsePrice("0.001")
+	if !perGB.Exceeds(perMB) || perMB.Exceeds(perGB) {
+		t.Fatalf("expect %v to exceed %v only", perGB, perMB)
+	}
+	if cost := perGB.Cost(1024*1024*1024, 0); cost != perGB.EntryToExit {
+		t.Fatalf("expect cost of 1 GB to be %v, got %v", perGB.EntryToExit, cost)
+	}
+	if cost := perMB.Cost(1<<50, 0); cost.String() != "1073741.82400000" {
+		t.Fatalf("expect cost of 1 PB to be 1073741.824, got %v", cost)
+	}
+}
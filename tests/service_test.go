@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestServicePort(t *testing.T) {
+	service := &tuna.Service{Name: "test", TCP: []uint32{80, 443, 8080}, UDP: []uint32{53}}
+
+	cases := []struct {
+		portID   int
+		protocol string
+		port     uint32
+	}{
+		{0, "tcp", 80},
+		{1, "tcp", 443},
+		{2, "tcp", 8080},
+		{3, "udp", 53},
+	}
+	for _, c := range cases {
+		protocol, port, err := service.Port(c.portID)
+		if err != nil {
+			t.Fatalf("port id %d: %v", c.portID, err)
+		}
+		if protocol != c.protocol || port != c.port {
+			t.Fatalf("port id %d: expect %s %d, got %s %d", c.portID, c.protocol, c.port, protocol, port)
+		}
+	}
+
+	for _, portID := range []int{-1, 4} {
+		if _, _, err := service.Port(portID); err == nil {
+			t.Fatalf("expect error for port id %d", portID)
+		}
+	}
+}
+
+func TestFindService(t *testing.T) {
+	services := []tuna.Service{
+		{Name: "web-*", TCP: []uint32{80}},
+		{Name: "web-api-*", TCP: []uint32{8080}},
+		{Name: "web-api-admin", TCP: []uint32{9000}},
+	}
+
+	cases := []struct {
+		name string
+		port uint32
+	}{
+		{"web-blog", 80},
+		{"web-api-v1", 8080},
+		{"web-api-admin", 9000},
+	}
+	for _, c := range cases {
+		service, ok := tuna.FindService(services, c.name)
+		if !ok {
+			t.Fatalf("expect %s to be found", c.name)
+		}
+		if service.Name != c.name || service.TCP[0] != c.port {
+			t.Fatalf("%s: expect port %d, got %s %v", c.name, c.port, service.Name, service.TCP)
+		}
+	}
+
+	if _, ok := tuna.FindService(services, "db"); ok {
+		t.Fatal("expect db not to be found")
+	}
+}
+
+func TestReadServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tuna-services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.json":   `[{"name": "web", "tcp": [80]}]`,
+		"b.json":   `[{"name": "db", "tcp": [5432]}]`,
+		"c.txt":    `not json`,
+		"dup.json": `[{"name": "web", "tcp": [8080]}]`,
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	services, err := tuna.ReadServices(filepath.Join(dir, "a.json")+", "+filepath.Join(dir, "b.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Name != "web" || services[1].Name != "db" {
+		t.Fatalf("unexpected services %+v", services)
+	}
+
+	if _, err = tuna.ReadServices(dir, true); err == nil {
+		t.Fatal("expect duplicate service error")
+	}
+
+	err = os.Remove(filepath.Join(dir, "dup.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err = tuna.ReadServices(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Name != "web" || services[1].Name != "db" {
+		t.Fatalf("unexpected services %+v", services)
+	}
+}
@@ -0,0 +1,913 @@
+package tests
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+type fakeSubscriberSource struct {
+	subscribers map[string]string
+	countCalls  int
+}
+
+func (s *fakeSubscriberSource) GetSubscriptionContext(ctx context.Context, topic string, subscriber string) (*nkn.Subscription, error) {
+	meta, ok := s.subscribers[subscriber]
+	if !ok {
+		return nil, errors.New("subscription not found")
+	}
+	return &nkn.Subscription{Meta: meta}, nil
+}
+
+func (s *fakeSubscriberSource) GetSubscribersCountContext(ctx context.Context, topic string) (int, error) {
+	s.countCalls++
+	return len(s.subscribers), nil
+}
+
+func (s *fakeSubscriberSource) GetSubscribersContext(ctx context.Context, topic string, offset, limit int, meta, txPool bool) (*nkn.Subscribers, error) {
+	m := make(map[string]string, len(s.subscribers))
+	for k, v := range s.subscribers {
+		m[k] = v
+	}
+	return &nkn.Subscribers{Subscribers: &nkn.StringMap{Map: m}}, nil
+}
+
+// asyncConn is one end of an in-memory connection that buffers writes, since
+// both entry and exit write their connection metadata before reading, which
+// would block forever on a plain net.Pipe.
+type asyncConn struct {
+	net.Conn
+	writes    chan []byte
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newAsyncPipe() (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	return newAsyncConn(a), newAsyncConn(b)
+}
+
+func newAsyncConn(conn net.Conn) *asyncConn {
+	c := &asyncConn{
+		Conn:    conn,
+		writes:  make(chan []byte, 1024),
+		closing: make(chan struct{}),
+	}
+	go func() {
+		defer conn.Close()
+		for {
+			select {
+			case b := <-c.writes:
+				if _, err := conn.Write(b); err != nil {
+					return
+				}
+			case <-c.closing:
+				// flush pending writes like a socket does on close
+				for {
+					select {
+					case b := <-c.writes:
+						if _, err := conn.Write(b); err != nil {
+							return
+						}
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return c
+}
+
+func (c *asyncConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closing:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.writes <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-c.closing:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *asyncConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return nil
+}
+
+// memDialer connects entry to exits served in memory by their TCP address in
+// metadata, so that entry and exit can be tested without network. Dialing an
+// address without exit fails after its delay.
+type memDialer struct {
+	sync.Mutex
+	exits       map[string]*tuna.TunaExit
+	delays      map[string]time.Duration
+	dialed      []string
+	served      map[string]chan struct{}
+	inFlight    int
+	maxInFlight int
+}
+
+func newMemDialer() *memDialer {
+	return &memDialer{
+		exits:  make(map[string]*tuna.TunaExit),
+		delays: make(map[string]time.Duration),
+		served: make(map[string]chan struct{}),
+	}
+}
+
+// addExit serves exit at addr, and returns a channel receiving a value each
+// time a connection to it is closed.
+func (d *memDialer) addExit(addr string, exit *tuna.TunaExit) chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	d.exits[addr] = exit
+	d.served[addr] = make(chan struct{}, 16)
+	return d.served[addr]
+}
+
+func (d *memDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	d.Lock()
+	exit, ok := d.exits[address]
+	delay := d.delays[address]
+	served := d.served[address]
+	d.dialed = append(d.dialed, address)
+	d.inFlight++
+	if d.inFlight > d.maxInFlight {
+		d.maxInFlight = d.inFlight
+	}
+	d.Unlock()
+
+	time.Sleep(delay)
+	d.Lock()
+	d.inFlight--
+	d.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s %s: connection refused", network, address)
+	}
+
+	entryConn, exitConn := newAsyncPipe()
+	go func() {
+		exit.ServeConn(exitConn)
+		served <- struct{}{}
+	}()
+	return entryConn, nil
+}
+
+func (d *memDialer) DialUDP(network string, laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("udp is not supported by memDialer")
+}
+
+func (d *memDialer) dialedAddrs() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+// maxConcurrentDials returns the maximum number of dials in progress at the
+// same time so far.
+func (d *memDialer) maxConcurrentDials() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.maxInFlight
+}
+
+// newTestExit creates an exit without payment serving TCP ports of upstream
+// services on localhost.
+func newTestExit(t *testing.T, wallet *nkn.Wallet, ports []uint32) *tuna.TunaExit {
+	exit, err := tuna.NewTunaExit([]tuna.Service{{Name: "test", TCP: ports}}, wallet, &tuna.ExitConfiguration{
+		PaymentScheme: tuna.PaymentSchemeNone,
+		Services: map[string]tuna.ExitServiceInfo{
+			"test": {Address: "127.0.0.1", Price: "0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exit
+}
+
+// startEchoServer starts a TCP server on localhost that writes prefix and then
+// echoes back what it reads, and returns its port and listener.
+func startEchoServer(t *testing.T, prefix string) (uint32, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte(prefix)); err != nil {
+					return
+				}
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return uint32(listener.Addr().(*net.TCPAddr).Port), listener
+}
+
+// freePort returns a TCP port on localhost that is free at the moment.
+func freePort(t *testing.T) uint32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// testMetadata returns raw metadata of an exit at ip:tcpPort serving ports.
+func testMetadata(t *testing.T, ports []uint32, ip string, tcpPort uint32) string {
+	raw, _, err := tuna.BuildMetadata("test", 0, ports, nil, ip, tcpPort, 0, 0, "0", "", nil, tuna.DefaultSubscriptionPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func newTestWallet(t *testing.T) *nkn.Wallet {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wallet
+}
+
+// newTestCommon creates an entry Common of service test selecting among exits
+// listed by source, using default config if config is nil.
+func newTestCommon(t *testing.T, config *tuna.EntryConfiguration, source tuna.SubscriberSource) *tuna.Common {
+	c, err := tuna.NewEntryCommon(&tuna.Service{Name: "test"}, &tuna.ServiceInfo{MaxPrice: "1"}, newTestWallet(t), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SubscriberSource = source
+	return c
+}
+
+func subscriberAddr(wallet *nkn.Wallet) string {
+	return "exit." + hex.EncodeToString(wallet.PubKey())
+}
+
+// dialEntry connects to local port of entry, retrying until entry listens
+// and is connected to exit, and checks that data is echoed back after prefix.
+func dialEntry(t *testing.T, port uint32, prefix string) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := func() error {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return err
+			}
+			b := make([]byte, len(prefix)+4)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return err
+			}
+			if string(b) != prefix+"ping" {
+				t.Fatalf("expect %q from port %d, got %q", prefix+"ping", port, b)
+			}
+			return nil
+		}()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connect through entry port %d: %v", port, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestEntryExitInMemory(t *testing.T) {
+	upstreamPort, upstream := startEchoServer(t, "a")
+	defer upstream.Close()
+	exitWallet := newTestWallet(t)
+	exit := newTestExit(t, exitWallet, []uint32{upstreamPort})
+	defer exit.Close()
+
+	dialer := newMemDialer()
+	dialer.addExit("127.0.0.1:30020", exit)
+
+	localPort := freePort(t)
+	config := tuna.DefaultEntryConfig()
+	config.PaymentScheme = tuna.PaymentSchemeNone
+	config.ServerSelectionStrategy = tuna.SelectionStrategyPrice
+	entry, err := tuna.NewTunaEntry(tuna.Service{Name: "test", TCP: []uint32{localPort}}, tuna.ServiceInfo{MaxPrice: "1"}, newTestWallet(t), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Dialer = dialer
+	entry.SubscriberSource = &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(exitWallet): testMetadata(t, []uint32{upstreamPort}, "127.0.0.1", 30020),
+	}}
+	go entry.Start(false)
+	defer entry.Close()
+
+	dialEntry(t, localPort, "a")
+
+	if status := entry.Status(); !status.Connected || status.RemoteNknAddress != subscriberAddr(exitWallet) {
+		t.Fatalf("expect entry to be connected to exit, got %+v", status)
+	}
+}
+
+func TestEntryExitRoutesPorts(t *testing.T) {
+	prefixes := []string{"a", "b", "c"}
+	upstreamPorts := make([]uint32, len(prefixes))
+	localPorts := make([]uint32, len(prefixes))
+	for i, prefix := range prefixes {
+		port, upstream := startEchoServer(t, prefix)
+		defer upstream.Close()
+		upstreamPorts[i] = port
+		localPorts[i] = freePort(t)
+	}
+	exitWallet := newTestWallet(t)
+	exit := newTestExit(t, exitWallet, upstreamPorts)
+	defer exit.Close()
+
+	dialer := newMemDialer()
+	dialer.addExit("127.0.0.1:30020", exit)
+
+	config := tuna.DefaultEntryConfig()
+	config.PaymentScheme = tuna.PaymentSchemeNone
+	config.ServerSelectionStrategy = tuna.SelectionStrategyPrice
+	entry, err := tuna.NewTunaEntry(tuna.Service{Name: "test", TCP: localPorts}, tuna.ServiceInfo{MaxPrice: "1"}, newTestWallet(t), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Dialer = dialer
+	entry.SubscriberSource = &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(exitWallet): testMetadata(t, upstreamPorts, "127.0.0.1", 30020),
+	}}
+	go entry.Start(false)
+	defer entry.Close()
+
+	// each local port of entry is routed to the upstream port at same index
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		dialEntry(t, localPorts[i], prefixes[i])
+	}
+}
+
+func TestEntryExitQUIC(t *testing.T) {
+	upstreamPort, upstream := startEchoServer(t, "a")
+	defer upstream.Close()
+	exitWallet := newTestWallet(t)
+	exit := newTestExit(t, exitWallet, []uint32{upstreamPort})
+	defer exit.Close()
+
+	listener, err := tuna.ListenQUIC("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go exit.Serve(listener)
+
+	quicPort := uint32(listener.Addr().(*net.UDPAddr).Port)
+	metadata, _, err := tuna.BuildMetadata("test", 0, []uint32{upstreamPort}, nil, "127.0.0.1", freePort(t), 0, quicPort, "0", "", nil, tuna.DefaultSubscriptionPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localPort := freePort(t)
+	config := tuna.DefaultEntryConfig()
+	config.PaymentScheme = tuna.PaymentSchemeNone
+	config.ServerSelectionStrategy = tuna.SelectionStrategyPrice
+	config.Transport = tuna.TransportQUIC
+	entry, err := tuna.NewTunaEntry(tuna.Service{Name: "test", TCP: []uint32{localPort}}, tuna.ServiceInfo{MaxPrice: "1"}, newTestWallet(t), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// exit without QUIC port is skipped in selection
+	entry.SubscriberSource = &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(exitWallet):       string(metadata),
+		subscriberAddr(newTestWallet(t)): testMetadata(t, []uint32{upstreamPort}, "127.0.0.1", freePort(t)),
+	}}
+	go entry.Start(false)
+	defer entry.Close()
+
+	dialEntry(t, localPort, "a")
+
+	if status := entry.Status(); !status.Connected || status.RemoteNknAddress != subscriberAddr(exitWallet) {
+		t.Fatalf("expect entry to be connected to exit over QUIC, got %+v", status)
+	}
+}
+
+func TestCreateServerConnInsufficientServers(t *testing.T) {
+	c := newTestCommon(t, nil, &fakeSubscriberSource{subscribers: map[string]string{subscriberAddr(newTestWallet(t)): ""}})
+	c.MinSubscribers = 2
+
+	err := c.CreateServerConn(true)
+	if !errors.Is(err, tuna.ErrInsufficientServers) {
+		t.Fatalf("expect ErrInsufficientServers, got %v", err)
+	}
+}
+
+func TestCreateServerConnStaleServerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tuna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "server")
+	err = ioutil.WriteFile(cacheFile, []byte("exit.gone"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCommon(t, nil, &fakeSubscriberSource{subscribers: map[string]string{subscriberAddr(newTestWallet(t)): ""}})
+	c.MinSubscribers = 2
+	c.ServerCacheFile = cacheFile
+
+	err = c.CreateServerConn(true)
+	if !errors.Is(err, tuna.ErrInsufficientServers) {
+		t.Fatalf("expect fallback to normal selection and ErrInsufficientServers, got %v", err)
+	}
+}
+
+func TestCreateServerConnSubscriberCache(t *testing.T) {
+	source := &fakeSubscriberSource{subscribers: map[string]string{subscriberAddr(newTestWallet(t)): ""}}
+	c := newTestCommon(t, nil, source)
+	c.MinSubscribers = 2
+	c.SubscriberCacheTTL = time.Minute
+
+	for i := 0; i < 2; i++ {
+		err := c.CreateServerConn(false)
+		if !errors.Is(err, tuna.ErrInsufficientServers) {
+			t.Fatalf("expect ErrInsufficientServers, got %v", err)
+		}
+	}
+	if source.countCalls != 1 {
+		t.Fatalf("expect 1 subscribers count query within cache TTL, got %d", source.countCalls)
+	}
+
+	err := c.CreateServerConn(true)
+	if !errors.Is(err, tuna.ErrInsufficientServers) {
+		t.Fatalf("expect ErrInsufficientServers, got %v", err)
+	}
+	if source.countCalls != 2 {
+		t.Fatalf("expect forced connect to bypass cache, got %d queries", source.countCalls)
+	}
+}
+
+func TestCreateServerConnReversePortsNotOffered(t *testing.T) {
+	// reverse entry that only offers TCP port 80
+	c := newTestCommon(t, nil, &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(newTestWallet(t)): testMetadata(t, []uint32{80}, "127.0.0.1", 30020),
+	}})
+	c.ReverseMetadata = &pb.ServiceMetadata{ServiceTcp: []uint32{22}}
+	c.SelectionStrategy = tuna.SelectionStrategyPrice
+	c.ConnectTimeout = 500 * time.Millisecond
+	var reason string
+	c.OnSubscriberRejected = func(subscriber, r string) {
+		reason = r
+	}
+
+	err := c.CreateServerConn(true)
+	if err == nil {
+		t.Fatal("expect connect error")
+	}
+	if reason != "service ports not offered" {
+		t.Fatalf("expect subscriber rejected for ports not offered, got %q", reason)
+	}
+}
+
+// newDialTestCommon creates an entry Common without payment that connects
+// through dialer to exits listed by source with parallelDial concurrent dials.
+func newDialTestCommon(t *testing.T, parallelDial int32, source tuna.SubscriberSource, dialer tuna.Dialer) *tuna.Common {
+	config := tuna.DefaultEntryConfig()
+	config.PaymentScheme = tuna.PaymentSchemeNone
+	config.ServerSelectionStrategy = tuna.SelectionStrategyPrice
+	config.ParallelDial = parallelDial
+	config.ConnectTimeout = 5
+	c := newTestCommon(t, config, source)
+	c.Service.TCP = []uint32{80}
+	c.Dialer = dialer
+	return c
+}
+
+func closeServerConn(c *tuna.Common) {
+	if conn := c.GetTCPConn(); conn != nil {
+		conn.Close()
+	}
+}
+
+func TestCreateServerConnParallelDialFirstWins(t *testing.T) {
+	slowWallet, fastWallet := newTestWallet(t), newTestWallet(t)
+	slowExit, fastExit := newTestExit(t, slowWallet, []uint32{80}), newTestExit(t, fastWallet, []uint32{80})
+	defer slowExit.Close()
+	defer fastExit.Close()
+
+	dialer := newMemDialer()
+	slowServed := dialer.addExit("127.0.0.1:30020", slowExit)
+	dialer.addExit("127.0.0.2:30020", fastExit)
+	dialer.delays["127.0.0.1:30020"] = 300 * time.Millisecond
+	dialer.delays["127.0.0.2:30020"] = 50 * time.Millisecond
+
+	c := newDialTestCommon(t, 2, &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(slowWallet): testMetadata(t, []uint32{80}, "127.0.0.1", 30020),
+		subscriberAddr(fastWallet): testMetadata(t, []uint32{80}, "127.0.0.2", 30020),
+	}}, dialer)
+	defer closeServerConn(c)
+
+	if err := c.CreateServerConn(true); err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.GetRemoteNknAddress(); addr != subscriberAddr(fastWallet) {
+		t.Fatalf("expect first connected exit %s to be selected, got %s", subscriberAddr(fastWallet), addr)
+	}
+	if n := dialer.maxConcurrentDials(); n != 2 {
+		t.Fatalf("expect 2 concurrent dials, got %d", n)
+	}
+
+	// the slow exit is connected after the fast one is selected
+	select {
+	case <-slowServed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect late connection to slow exit to be closed")
+	}
+}
+
+func TestCreateServerConnParallelDialFailedBlocked(t *testing.T) {
+	exitWallet, failedWallet := newTestWallet(t), newTestWallet(t)
+	exit := newTestExit(t, exitWallet, []uint32{80})
+	defer exit.Close()
+
+	dialer := newMemDialer()
+	dialer.addExit("127.0.0.1:30020", exit)
+	dialer.delays["127.0.0.1:30020"] = 100 * time.Millisecond
+
+	failed := subscriberAddr(failedWallet)
+	c := newDialTestCommon(t, 2, &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(exitWallet): testMetadata(t, []uint32{80}, "127.0.0.1", 30020),
+		failed:                     testMetadata(t, []uint32{80}, "127.0.0.2", 30020),
+	}}, dialer)
+	c.FailedServerBlockDuration = time.Minute
+	defer closeServerConn(c)
+	var mu sync.Mutex
+	rejected := make(map[string]string)
+	c.OnSubscriberRejected = func(subscriber, reason string) {
+		mu.Lock()
+		rejected[subscriber] = reason
+		mu.Unlock()
+	}
+
+	for i, reason := range []string{"dial failed", "recently failed"} {
+		if err := c.CreateServerConn(true); err != nil {
+			t.Fatal(err)
+		}
+		if addr := c.GetRemoteNknAddress(); addr != subscriberAddr(exitWallet) {
+			t.Fatalf("expect reachable exit to be selected, got %s", addr)
+		}
+		mu.Lock()
+		if rejected[failed] != reason {
+			t.Fatalf("expect failed exit to be rejected for %q on connect %d, got %q", reason, i, rejected[failed])
+		}
+		mu.Unlock()
+		closeServerConn(c)
+	}
+
+	n := 0
+	for _, addr := range dialer.dialedAddrs() {
+		if addr == "127.0.0.2:30020" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expect blocked exit to be dialed once, got %d", n)
+	}
+}
+
+func TestCreateServerConnFailedBlockExpires(t *testing.T) {
+	exitWallet, failedWallet := newTestWallet(t), newTestWallet(t)
+	exit := newTestExit(t, exitWallet, []uint32{80})
+	defer exit.Close()
+
+	dialer := newMemDialer()
+	dialer.addExit("127.0.0.1:30020", exit)
+	dialer.delays["127.0.0.1:30020"] = 100 * time.Millisecond
+
+	failed := subscriberAddr(failedWallet)
+	c := newDialTestCommon(t, 2, &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(exitWallet): testMetadata(t, []uint32{80}, "127.0.0.1", 30020),
+		failed:                     testMetadata(t, []uint32{80}, "127.0.0.2", 30020),
+	}}, dialer)
+	c.FailedServerBlockDuration = 500 * time.Millisecond
+	defer closeServerConn(c)
+	var mu sync.Mutex
+	var reason string
+	c.OnSubscriberRejected = func(subscriber, r string) {
+		if subscriber == failed {
+			mu.Lock()
+			reason = r
+			mu.Unlock()
+		}
+	}
+
+	connect := func(expect string) {
+		if err := c.CreateServerConn(true); err != nil {
+			t.Fatal(err)
+		}
+		closeServerConn(c)
+		mu.Lock()
+		defer mu.Unlock()
+		if reason != expect {
+			t.Fatalf("expect failed exit to be rejected for %q, got %q", expect, reason)
+		}
+	}
+
+	connect("dial failed")
+	connect("recently failed")
+	time.Sleep(c.FailedServerBlockDuration)
+	connect("dial failed")
+}
+
+func TestCreateServerConnSerialDial(t *testing.T) {
+	exitWallet := newTestWallet(t)
+	exit := newTestExit(t, exitWallet, []uint32{80})
+	defer exit.Close()
+
+	dialer := newMemDialer()
+	dialer.addExit("127.0.0.1:30020", exit)
+	dialer.delays["127.0.0.1:30020"] = 50 * time.Millisecond
+	dialer.delays["127.0.0.2:30020"] = 50 * time.Millisecond
+
+	c := newDialTestCommon(t, 1, &fakeSubscriberSource{subscribers: map[string]string{
+		subscriberAddr(exitWallet):       testMetadata(t, []uint32{80}, "127.0.0.1", 30020),
+		subscriberAddr(newTestWallet(t)): testMetadata(t, []uint32{80}, "127.0.0.2", 30020),
+	}}, dialer)
+	defer closeServerConn(c)
+
+	if err := c.CreateServerConn(true); err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.GetRemoteNknAddress(); addr != subscriberAddr(exitWallet) {
+		t.Fatalf("expect reachable exit to be selected, got %s", addr)
+	}
+	if n := dialer.maxConcurrentDials(); n != 1 {
+		t.Fatalf("expect serial dials, got %d concurrent", n)
+	}
+}
+
+func TestCreateServerConnDialRetryCanceled(t *testing.T) {
+	failed := subscriberAddr(newTestWallet(t))
+	c := newDialTestCommon(t, 1, &fakeSubscriberSource{subscribers: map[string]string{
+		failed: testMetadata(t, []uint32{80}, "127.0.0.1", 30020),
+	}}, newMemDialer())
+	c.DialRetries = 10
+	var mu sync.Mutex
+	var reason string
+	c.OnSubscriberRejected = func(subscriber, r string) {
+		mu.Lock()
+		reason = r
+		mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := c.CreateServerConnContext(ctx, true)
+	if !errors.Is(err, tuna.ErrConnectTimeout) {
+		t.Fatalf("expect connect timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect dial retry to stop when context is done, took %v", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reason) > 0 {
+		t.Fatalf("expect exit not to be rejected when dial is canceled, got %q", reason)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	wallets := []*nkn.Wallet{newTestWallet(t), newTestWallet(t)}
+	dialer := newMemDialer()
+	served := make(map[string]chan struct{})
+	subscribers := make(map[string]string)
+	for i, wallet := range wallets {
+		exit := newTestExit(t, wallet, []uint32{80})
+		defer exit.Close()
+		ip := fmt.Sprintf("127.0.0.%d", i+1)
+		served[subscriberAddr(wallet)] = dialer.addExit(ip+":30020", exit)
+		subscribers[subscriberAddr(wallet)] = testMetadata(t, []uint32{80}, ip, 30020)
+	}
+
+	c := newDialTestCommon(t, 1, &fakeSubscriberSource{subscribers: subscribers}, dialer)
+	defer closeServerConn(c)
+	if err := c.CreateServerConn(true); err != nil {
+		t.Fatal(err)
+	}
+	old := c.GetRemoteNknAddress()
+
+	var reason string
+	c.OnSubscriberRejected = func(subscriber, r string) {
+		if subscriber == old {
+			reason = r
+		}
+	}
+	if err := c.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.GetRemoteNknAddress(); addr == old {
+		t.Fatalf("expect reconnect to select another exit than %s", old)
+	}
+	if reason != "reconnecting" {
+		t.Fatalf("expect current exit to be rejected for reconnecting, got %q", reason)
+	}
+	select {
+	case <-served[old]:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect connection to previous exit to be closed")
+	}
+
+	// the previous exit can be selected again after reconnect
+	reason = ""
+	closeServerConn(c)
+	if err := c.CreateServerConn(true); err != nil {
+		t.Fatal(err)
+	}
+	if reason == "reconnecting" {
+		t.Fatal("expect previous exit not to be skipped after reconnect")
+	}
+}
+
+func TestPriceWeightedNodesSeeded(t *testing.T) {
+	subscribers := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		raw, _, err := tuna.BuildMetadata("test", 0, []uint32{80}, nil, fmt.Sprintf("10.0.0.%d", i+1), 30020, 30021, 0, "0.001", "", nil, tuna.DefaultSubscriptionPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscribers[subscriberAddr(newTestWallet(t))] = string(raw)
+	}
+
+	selected := func(seed int64) []string {
+		c := newTestCommon(t, nil, &fakeSubscriberSource{subscribers: subscribers})
+		c.SelectionRand = rand.New(rand.NewSource(seed))
+
+		nodes, err := c.GetPriceWeightedNodes(len(subscribers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			addrs = append(addrs, node.Address)
+		}
+		return addrs
+	}
+
+	first, second := selected(1), selected(1)
+	if len(first) != len(subscribers) {
+		t.Fatalf("expect %d nodes, got %d", len(subscribers), len(first))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expect same selection with same seed, got %v and %v", first, second)
+		}
+	}
+}
+
+func TestNewEntryCommon(t *testing.T) {
+	wallet := newTestWallet(t)
+
+	if _, err := tuna.NewEntryCommon(&tuna.Service{}, nil, wallet, nil); err == nil {
+		t.Fatal("expect error for empty service name")
+	}
+	if _, err := tuna.NewEntryCommon(&tuna.Service{Name: "test"}, nil, nil, nil); err == nil {
+		t.Fatal("expect error for nil wallet")
+	}
+	if _, err := tuna.NewEntryCommon(&tuna.Service{Name: "test"}, &tuna.ServiceInfo{MaxPrice: "abc"}, wallet, nil); err == nil {
+		t.Fatal("expect error for invalid max price")
+	}
+
+	invalid := []func(c *tuna.EntryConfiguration){
+		func(c *tuna.EntryConfiguration) { c.ParallelDial = -1 },
+		func(c *tuna.EntryConfiguration) { c.DNSResolver = "8.8.8.8" },
+		func(c *tuna.EntryConfiguration) { c.DialTimeout = 0 },
+	}
+	for i, f := range invalid {
+		config := tuna.DefaultEntryConfig()
+		f(config)
+		if _, err := tuna.NewEntryCommon(&tuna.Service{Name: "test"}, nil, wallet, config); err == nil {
+			t.Fatalf("expect case %d to be rejected", i)
+		}
+	}
+
+	if _, err := tuna.NewEntryCommon(&tuna.Service{Name: "test"}, nil, wallet, tuna.DefaultEntryConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := tuna.NewEntryCommon(&tuna.Service{Name: "test"}, nil, wallet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SubscriptionPrefix != tuna.DefaultSubscriptionPrefix {
+		t.Fatalf("expect default subscription prefix, got %q", c.SubscriptionPrefix)
+	}
+	if c.DialTimeout <= 0 {
+		t.Fatalf("expect default dial timeout, got %v", c.DialTimeout)
+	}
+	if c.ServiceInfo.IPFilter == nil || c.ServiceInfo.NknFilter == nil {
+		t.Fatal("expect filters to be initialized")
+	}
+}
+
+func TestEntrySessionSwap(t *testing.T) {
+	te, err := tuna.NewTunaEntry(tuna.Service{Name: "test"}, tuna.ServiceInfo{}, newTestWallet(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSession := func() *smux.Session {
+		clientConn, serverConn := net.Pipe()
+		server, err := smux.Server(serverConn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				stream, err := server.AcceptStream()
+				if err != nil {
+					return
+				}
+				stream.Close()
+			}
+		}()
+		client, err := smux.Client(clientConn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	sessions := make([]*smux.Session, 10)
+	for i := range sessions {
+		sessions[i] = newSession()
+		defer sessions[i].Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			te.SetSession(sessions[i%len(sessions)])
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				session := te.Session()
+				if session == nil {
+					continue
+				}
+				stream, err := session.OpenStream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				stream.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if te.Session() != sessions[99%len(sessions)] {
+		t.Fatal("expect last session set to be returned")
+	}
+}
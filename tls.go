@@ -0,0 +1,50 @@
+package tuna
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ExitTLSConfiguration makes exit connect to a TLS-only service with TLS, so
+// that entries can use the service as plain TCP.
+type ExitTLSConfiguration struct {
+	ServerName         string `json:"serverName"`
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+func (conf *ExitTLSConfiguration) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if len(conf.CAFile) > 0 {
+		b, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.CAFile)
+		}
+	}
+
+	if len(conf.CertFile) > 0 || len(conf.KeyFile) > 0 {
+		if len(conf.CertFile) == 0 || len(conf.KeyFile) == 0 {
+			return nil, errors.New("certFile and keyFile should be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,122 @@
+package tuna
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// TrafficRecord is a line of exit traffic log, which records traffic of a
+// payer on a service since the previous record of the same payer and service.
+type TrafficRecord struct {
+	Time             int64  `json:"time"` // unix timestamp in seconds
+	Payer            string `json:"payer"`
+	Service          string `json:"service"`
+	BytesEntryToExit uint64 `json:"bytesEntryToExit"`
+	BytesExitToEntry uint64 `json:"bytesExitToEntry"`
+}
+
+type trafficKey struct {
+	payer     string
+	serviceID int
+}
+
+// startTrafficLog periodically appends traffic records of each payer to the
+// file at path as JSON lines until exit is closed. Records are appended so
+// they survive restarts.
+func (te *TunaExit) startTrafficLog(path string, interval time.Duration) {
+	te.serviceBytesLock.Lock()
+	te.pendingTraffic = make(map[trafficKey]*TrafficRecord)
+	te.serviceBytesLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-te.closeChan:
+				te.flushTrafficLog(path)
+				return
+			}
+			te.flushTrafficLog(path)
+		}
+	}()
+}
+
+// collectTraffic adds traffic of sb not logged yet to pending records. It
+// should be called with serviceBytesLock held.
+func (te *TunaExit) collectTraffic(sb *serviceBytes) {
+	if sb.loggedEntryToExit == nil {
+		sb.loggedEntryToExit = make([]uint64, len(sb.entryToExit))
+		sb.loggedExitToEntry = make([]uint64, len(sb.exitToEntry))
+	}
+	for i, service := range te.services {
+		entryToExit := atomic.LoadUint64(&sb.entryToExit[i])
+		exitToEntry := atomic.LoadUint64(&sb.exitToEntry[i])
+		if entryToExit == sb.loggedEntryToExit[i] && exitToEntry == sb.loggedExitToEntry[i] {
+			continue
+		}
+		key := trafficKey{payer: sb.payer, serviceID: i}
+		record, ok := te.pendingTraffic[key]
+		if !ok {
+			record = &TrafficRecord{Payer: sb.payer, Service: service.Name}
+			te.pendingTraffic[key] = record
+		}
+		record.BytesEntryToExit += entryToExit - sb.loggedEntryToExit[i]
+		record.BytesExitToEntry += exitToEntry - sb.loggedExitToEntry[i]
+		sb.loggedEntryToExit[i] = entryToExit
+		sb.loggedExitToEntry[i] = exitToEntry
+	}
+}
+
+// restoreTraffic adds records that couldn't be written back to pending records
+// so that they are written by the next flush.
+func (te *TunaExit) restoreTraffic(records map[trafficKey]*TrafficRecord) {
+	te.serviceBytesLock.Lock()
+	defer te.serviceBytesLock.Unlock()
+	for key, record := range records {
+		if pending, ok := te.pendingTraffic[key]; ok {
+			pending.BytesEntryToExit += record.BytesEntryToExit
+			pending.BytesExitToEntry += record.BytesExitToEntry
+		} else {
+			te.pendingTraffic[key] = record
+		}
+	}
+}
+
+func (te *TunaExit) flushTrafficLog(path string) {
+	te.serviceBytesLock.Lock()
+	for sb := range te.activeServiceBytes {
+		te.collectTraffic(sb)
+	}
+	pending := te.pendingTraffic
+	te.pendingTraffic = make(map[trafficKey]*TrafficRecord)
+	te.serviceBytesLock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Couldn't open traffic log:", err)
+		te.restoreTraffic(pending)
+		return
+	}
+	defer Close(f)
+
+	now := time.Now().Unix()
+	encoder := json.NewEncoder(f)
+	for key, record := range pending {
+		record.Time = now
+		if err := encoder.Encode(record); err != nil {
+			log.Println("Couldn't write traffic log:", err)
+			te.restoreTraffic(pending)
+			return
+		}
+		delete(pending, key)
+	}
+}
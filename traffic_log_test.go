@@ -0,0 +1,54 @@
+package tuna
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlushTrafficLogRetry(t *testing.T) {
+	te, err := NewTunaExit([]Service{{Name: "test", TCP: []uint32{80}}}, newTestWallet(t), &ExitConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.pendingTraffic = make(map[trafficKey]*TrafficRecord)
+
+	dir, err := ioutil.TempDir("", "tuna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sb := te.addServiceBytes("payer")
+	atomic.AddUint64(&sb.entryToExit[0], 100)
+	atomic.AddUint64(&sb.exitToEntry[0], 200)
+
+	// a directory can't be opened for writing
+	te.flushTrafficLog(dir)
+
+	atomic.AddUint64(&sb.entryToExit[0], 10)
+	path := filepath.Join(dir, "traffic.log")
+	te.flushTrafficLog(path)
+	// nothing new to write
+	te.flushTrafficLog(path)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expect 1 traffic record, got %q", b)
+	}
+	var record TrafficRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Payer != "payer" || record.Service != "test" || record.BytesEntryToExit != 110 || record.BytesExitToEntry != 200 {
+		t.Fatalf("expect traffic of failed flush to be kept, got %+v", record)
+	}
+}
@@ -0,0 +1,81 @@
+package tuna
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+// Dialer dials connections to remote tuna nodes. Network is tcp, or quic if
+// entry uses TransportQUIC, in which case the returned connection is a QUIC
+// stream. It can be replaced by an in-memory implementation for testing.
+// Streams are multiplexed by smux over the returned connection.
+type Dialer interface {
+	DialTimeout(network, address string, timeout time.Duration) (net.Conn, error)
+	// DialUDP dials UDP connection to raddr from laddr, which can be nil to
+	// choose local address automatically.
+	DialUDP(network string, laddr, raddr *net.UDPAddr) (*net.UDPConn, error)
+}
+
+// SubscriberSource looks up service subscribers. It is implemented by
+// *nkn.Wallet and can be replaced by an in-memory implementation for testing.
+type SubscriberSource interface {
+	GetSubscriptionContext(ctx context.Context, topic string, subscriber string) (*nkn.Subscription, error)
+	GetSubscribersCountContext(ctx context.Context, topic string) (int, error)
+	GetSubscribersContext(ctx context.Context, topic string, offset, limit int, meta, txPool bool) (*nkn.Subscribers, error)
+}
+
+type netDialer struct{}
+
+// DefaultDialer dials connections using net package.
+var DefaultDialer Dialer = netDialer{}
+
+func (netDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == TransportQUIC {
+		return dialQUIC(address, timeout)
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+func (netDialer) DialUDP(network string, laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.DialUDP(network, laddr, raddr)
+}
+
+// NewResolver returns a resolver that sends DNS queries to addr (host:port)
+// instead of servers configured in system.
+func NewResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// resolveHostPort resolves host to an IP address using resolver and returns
+// it joined with port. Host is returned as is if it's already an IP address
+// or resolver is nil, leaving resolution to whoever dials it.
+func resolveHostPort(ctx context.Context, resolver *net.Resolver, host string, port uint32) (string, error) {
+	if resolver != nil && net.ParseIP(host) == nil {
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("no address found for %s", host)
+		}
+		host = addrs[0].IP.String()
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				host = addr.IP.String()
+				break
+			}
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
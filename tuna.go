@@ -13,6 +13,8 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
@@ -29,7 +31,6 @@ import (
 	"github.com/nknorg/nkn/v2/common"
 	"github.com/nknorg/nkn/v2/config"
 	"github.com/nknorg/nkn/v2/crypto/ed25519"
-	"github.com/nknorg/nkn/v2/transaction"
 	"github.com/nknorg/nkn/v2/util"
 	"github.com/nknorg/nkn/v2/util/address"
 	"github.com/nknorg/nkn/v2/vault"
@@ -37,6 +38,7 @@ import (
 	"github.com/nknorg/tuna/geo"
 	"github.com/nknorg/tuna/pb"
 	tunaUtil "github.com/nknorg/tuna/util"
+	"github.com/patrickmn/go-cache"
 	"github.com/xtaci/smux"
 	"golang.org/x/crypto/nacl/box"
 )
@@ -44,6 +46,11 @@ import (
 const (
 	TrafficUnit = 1024 * 1024
 
+	// ServiceMetadataVersion is the version of service metadata created by this
+	// package. Metadata created before versioning has version 0 and is still
+	// compatible.
+	ServiceMetadataVersion = 1
+
 	tcp                           = "tcp"
 	udp                           = "udp"
 	trafficPaymentThreshold       = 32
@@ -57,8 +64,30 @@ const (
 	pipeBufferSize                = 4096 // should be <= 4096 to be compatible with c++ smux
 	maxConnMetadataSize           = 1024
 	maxStreamMetadataSize         = 1024
-	maxServiceMetadataSize        = 4096
+	defaultMaxMetadataSize        = 4096
+	maxServiceHandshakeSize       = 1024
 	maxNanoPayTxnSize             = 4096
+	minPriceWeightOffset          = 1 // avoid infinite weight for free services
+	connIDSize                    = 2
+	udpHeaderSize                 = connIDSize + 2 // conn id, service id, port id
+	maxUDPFrameSize               = udpHeaderSize + 65535
+	getPublicIPRetries            = 3
+	getPublicIPBackoffMin         = time.Second
+	getPublicIPBackoffMax         = 8 * time.Second
+	drainCheckInterval            = 100 * time.Millisecond
+	serviceHandshakeTimeout       = 10 * time.Second
+	closeChannelTimeout           = 10 * time.Second
+	dialRetryInterval             = 500 * time.Millisecond
+	startupRetryIntervalMax       = time.Minute
+)
+
+const (
+	// SelectionStrategyPerformance selects servers with the lowest delay (and
+	// highest bandwidth if bandwidth measurement is enabled).
+	SelectionStrategyPerformance = "performance"
+	// SelectionStrategyPrice selects servers randomly, weighted inversely by
+	// their advertised price so that cheaper servers are favored.
+	SelectionStrategyPrice = "price"
 )
 
 var (
@@ -69,10 +98,15 @@ var (
 )
 
 type ServiceInfo struct {
-	MaxPrice  string            `json:"maxPrice"`
-	ListenIP  string            `json:"listenIP"`
-	IPFilter  *geo.IPFilter     `json:"ipFilter"`
-	NknFilter *filter.NknFilter `json:"nknFilter"`
+	MaxPrice              string            `json:"maxPrice"`
+	ListenIP              string            `json:"listenIP"`
+	IPFilter              *geo.IPFilter     `json:"ipFilter"`
+	NknFilter             *filter.NknFilter `json:"nknFilter"`
+	SOCKS5ListenAddr      string            `json:"socks5ListenAddr"`
+	HTTPProxyListenAddr   string            `json:"httpProxyListenAddr"`
+	NanoPayUpdateInterval int32             `json:"nanoPayUpdateInterval"`
+	Topic                 string            `json:"topic"`
+	ListenUnix            []string          `json:"listenUnix"`
 }
 
 type Service struct {
@@ -82,11 +116,138 @@ type Service struct {
 	Encryption string   `json:"encryption"`
 }
 
+// Port returns the protocol and port of portID in stream metadata. Entry opens
+// streams with port id i for connections accepted by the listener of TCP[i],
+// so that exit forwards each stream to the service port matching the local
+// port it came from. Port ids from len(TCP) on refer to UDP ports in order.
+func (s *Service) Port(portID int) (string, uint32, error) {
+	if portID < 0 {
+		return "", 0, fmt.Errorf("invalid portId: %d", portID)
+	}
+	if portID < len(s.TCP) {
+		return tcp, s.TCP[portID], nil
+	}
+	if portID-len(s.TCP) < len(s.UDP) {
+		return udp, s.UDP[portID-len(s.TCP)], nil
+	}
+	return "", 0, fmt.Errorf("invalid portId: %d", portID)
+}
+
+// FindService returns the service in services named name. The name of a
+// service can also be a glob pattern like "web-*" matching a family of
+// services. A service of exactly the same name takes precedence over
+// patterns, and among matching patterns the one with the most non-wildcard
+// characters is used, then the first one in services. The returned service has
+// Name set to name.
+func FindService(services []Service, name string) (Service, bool) {
+	var found *Service
+	specificity := -1
+	for i := range services {
+		if services[i].Name == name {
+			return services[i], true
+		}
+		if ok, _ := path.Match(services[i].Name, name); !ok {
+			continue
+		}
+		n := len(services[i].Name) - strings.Count(services[i].Name, "*") - strings.Count(services[i].Name, "?")
+		if n > specificity {
+			found = &services[i]
+			specificity = n
+		}
+	}
+	if found == nil {
+		return Service{}, false
+	}
+	service := *found
+	service.Name = name
+	return service, true
+}
+
+// ReadServices reads and merges services from a comma separated list of
+// sources. Each source can be a file, a URL, "-" for stdin, or a directory
+// in which all *.json files are read in lexical order. A service name defined
+// more than once is an error.
+func ReadServices(sources string, strict bool) ([]Service, error) {
+	var files []string
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if len(source) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(source); err == nil && fi.IsDir() {
+			matches, err := filepath.Glob(filepath.Join(source, "*.json"))
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(matches)
+			files = append(files, matches...)
+			continue
+		}
+		files = append(files, source)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no services file found")
+	}
+
+	var services []Service
+	definedIn := make(map[string]string)
+	for _, file := range files {
+		var s []Service
+		err := tunaUtil.ReadConfigSource(file, &s, strict)
+		if err != nil {
+			return nil, fmt.Errorf("read %s error: %v", file, err)
+		}
+		for _, service := range s {
+			if prev, ok := definedIn[service.Name]; ok {
+				return nil, fmt.Errorf("duplicate service %s in %s and %s", service.Name, prev, file)
+			}
+			definedIn[service.Name] = file
+		}
+		services = append(services, s...)
+	}
+	return services, nil
+}
+
+// ConnectionStatus is a snapshot of the connection state of a tuna instance.
+type ConnectionStatus struct {
+	Connected        bool
+	RemoteNknAddress string
+	PaymentReceiver  string
+	IP               string
+	TCPPort          uint32
+	UDPPort          uint32
+	EntryToExitPrice common.Fixed64
+	ExitToEntryPrice common.Fixed64
+	BytesEntryToExit uint64
+	BytesExitToEntry uint64
+	ActiveSessions   int
+}
+
 type Common struct {
+	// It's important to keep these 64-bit fields on top to avoid panic on arm32
+	// architecture: https://github.com/golang/go/issues/23345
+	serverConnCount   uint64
+	subscriberRejects uint64
+	paymentSent       int64
+	lastDialRTT       int64
+	streamCount       uint64
+
 	Service                        *Service
 	ServiceInfo                    *ServiceInfo
 	Wallet                         *nkn.Wallet
-	DialTimeout                    int32
+	PaymentScheme                  PaymentScheme
+	NanoPayUpdateInterval          time.Duration
+	Compression                    bool
+	Dialer                         Dialer
+	Resolver                       *net.Resolver
+	SubscriberSource               SubscriberSource
+	DialTimeout                    time.Duration
+	WriteTimeout                   time.Duration
+	DialRetries                    int
+	ParallelDial                   int
+	LogDialRTT                     bool
+	FailedServerBlockDuration      time.Duration
+	SubscriberCacheTTL             time.Duration
 	SubscriptionPrefix             string
 	Reverse                        bool
 	ReverseMetadata                *pb.ServiceMetadata
@@ -101,10 +262,51 @@ type Common struct {
 	MeasurementBytesDownLink       int32
 	MeasureStoragePath             string
 	MaxPoolSize                    int32
+	SelectionStrategy              string
+	AllowSelfConnect               bool
+	MinSubscribers                 int
+	RequiredTags                   map[string]string
+	ExcludedTags                   map[string]string
+	AllowedBeneficiaries           map[common.Uint160]struct{}
+	ConnectTimeout                 time.Duration
+	PreferredServer                string
+	ServerCacheFile                string
+	StartupRetry                   bool
+	StartupRetryInterval           time.Duration
+	UDPLocalIP                     net.IP
+	UDPLocalPortMin                int
+	UDPLocalPortMax                int
+	OnSubscriberRejected           func(subscriber string, reason string)
+	OnSubscriberSelected           func(subscriber string)
+	OnPayment                      func(receiver string, amount common.Fixed64, totalBytes uint64)
+	MaxTotalSpend                  common.Fixed64
+	OnSpendLimitReached            func(totalSpend common.Fixed64)
+	OnStreamEnd                    func(err error)
+	OnStreamOpen                   func(id string)
+	OnStreamClose                  func(id string, bytesIn, bytesOut uint64, err error)
+	// UDPOverTCP, if true, sends UDP traffic of service to server in streams
+	// of the TCP session, framed by WriteVarBytes, instead of a UDP
+	// connection. It is ignored in reverse mode.
+	UDPOverTCP bool
+	// Transport is the transport used to connect to server, TransportTCP
+	// (default if empty) or TransportQUIC. Session is multiplexed by smux over
+	// either of them. It is ignored in reverse mode.
+	Transport string
+	// SelectionRand, if set, is used instead of global random source to select
+	// subscribers so that selection by price is reproducible, e.g. in tests.
+	// It is not safe for concurrent use, so it should not be shared.
+	SelectionRand *rand.Rand
+	// MaxMetadataSize is the max size in bytes of encoded service metadata
+	// accepted from server, larger ones are rejected with ErrMetadataTooLarge.
+	MaxMetadataSize int
+	// HealthCheckInterval is the interval between health check pings sent to
+	// server over session, 0 means no health check. Session is closed if pong
+	// is not received within HealthCheckTimeout.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
 
 	udpReadChan                       chan []byte
 	udpWriteChan                      chan []byte
-	udpCloseChan                      chan struct{}
 	tcpListener                       *net.TCPListener
 	curveSecretKey                    *[sharedKeySize]byte
 	encryptionAlgo                    pb.EncryptionAlgo
@@ -114,27 +316,36 @@ type Common struct {
 	measureDelayConcurrentWorkers     int
 	measureBandwidthConcurrentWorkers int
 	sessionsWaitGroup                 *sync.WaitGroup
+	activeStreams                     int32
+	paymentChannels                   map[*trackedChannel]struct{}
+	failedServers                     *cache.Cache
+	subscriberCache                   *cache.Cache
+	spendLimitReached                 int32
 
 	sync.RWMutex
-	paymentReceiver  string
-	entryToExitPrice common.Fixed64
-	exitToEntryPrice common.Fixed64
-	metadata         *pb.ServiceMetadata
-	connected        bool
-	tcpConn          net.Conn
-	udpConn          *net.UDPConn
-	isClosed         bool
-	sharedKeys       map[string]*[sharedKeySize]byte
-	remoteNknAddress string
-	activeSessions   int
-	linger           time.Duration
+	paymentReceiver   string
+	entryToExitPrice  common.Fixed64
+	exitToEntryPrice  common.Fixed64
+	priceUnit         uint64
+	metadata          *pb.ServiceMetadata
+	connected         bool
+	tcpConn           net.Conn
+	udpConn           *net.UDPConn
+	isClosed          bool
+	sharedKeys        map[string]*[sharedKeySize]byte
+	remoteNknAddress  string
+	skippedServer     string
+	remoteCompression bool
+	remoteHealthCheck bool
+	activeSessions    int
+	linger            time.Duration
 }
 
 func NewCommon(
 	service *Service,
 	serviceInfo *ServiceInfo,
 	wallet *nkn.Wallet,
-	dialTimeout int32,
+	dialTimeout time.Duration,
 	subscriptionPrefix string,
 	reverse, isServer bool,
 	geoDBPath string,
@@ -177,6 +388,10 @@ func NewCommon(
 		Service:                        service,
 		ServiceInfo:                    serviceInfo,
 		Wallet:                         wallet,
+		PaymentScheme:                  NewNanoPayScheme(wallet),
+		NanoPayUpdateInterval:          time.Duration(defaultNanoPayUpdateInterval) * time.Second,
+		Dialer:                         DefaultDialer,
+		SubscriberSource:               wallet,
 		DialTimeout:                    dialTimeout,
 		SubscriptionPrefix:             subscriptionPrefix,
 		Reverse:                        reverse,
@@ -201,6 +416,10 @@ func NewCommon(
 		measureBandwidthConcurrentWorkers: measureBandwidthConcurrentWorkers,
 		sortMeasuredNodes:                 sortMeasuredNodes,
 		sessionsWaitGroup:                 &wg,
+		MaxMetadataSize:                   defaultMaxMetadataSize,
+		paymentChannels:                   make(map[*trackedChannel]struct{}),
+		failedServers:                     cache.New(cache.NoExpiration, time.Minute),
+		subscriberCache:                   cache.New(cache.NoExpiration, time.Minute),
 	}
 
 	if !c.IsServer && c.ServiceInfo.IPFilter.NeedGeoInfo() {
@@ -238,6 +457,12 @@ func (c *Common) SetServerUDPConn(conn *net.UDPConn) {
 	c.udpConn = conn
 }
 
+// LastDialRTT returns the duration of the last successful TCP dial to server,
+// which approximates the round trip time to server, or 0 if never dialed.
+func (c *Common) LastDialRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.lastDialRTT))
+}
+
 func (c *Common) GetConnected() bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -303,11 +528,26 @@ func (c *Common) GetMetadata() *pb.ServiceMetadata {
 }
 
 func (c *Common) SetMetadata(metadata *pb.ServiceMetadata) {
+	if metadata != nil && metadata.Version > ServiceMetadataVersion {
+		log.Printf("Warning: service metadata version %d is newer than supported version %d", metadata.Version, ServiceMetadataVersion)
+	}
 	c.Lock()
 	defer c.Unlock()
 	c.metadata = metadata
 }
 
+// SelectedExit returns a copy of the metadata and the NKN address of the
+// server currently connected to, or nil and empty string if not connected.
+// The returned metadata is not changed by later reconnection.
+func (c *Common) SelectedExit() (*pb.ServiceMetadata, string) {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.connected || c.metadata == nil {
+		return nil, ""
+	}
+	return proto.Clone(c.metadata).(*pb.ServiceMetadata), c.remoteNknAddress
+}
+
 func (c *Common) GetRemoteNknAddress() string {
 	c.RLock()
 	defer c.RUnlock()
@@ -338,46 +578,222 @@ func (c *Common) SetPaymentReceiver(paymentReceiver string) error {
 	return nil
 }
 
+// isBeneficiaryAllowed returns whether payment to beneficiary is allowed by
+// AllowedBeneficiaries. All beneficiaries are allowed if it's nil.
+func (c *Common) isBeneficiaryAllowed(beneficiary string) bool {
+	if c.AllowedBeneficiaries == nil {
+		return true
+	}
+	programHash, err := common.ToScriptHash(beneficiary)
+	if err != nil {
+		return false
+	}
+	_, ok := c.AllowedBeneficiaries[programHash]
+	return ok
+}
+
+// ParseBeneficiaries parses wallet addresses into a set of program hashes. It
+// returns nil if addrs is empty.
+func ParseBeneficiaries(addrs []string) (map[common.Uint160]struct{}, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	beneficiaries := make(map[common.Uint160]struct{}, len(addrs))
+	for _, addr := range addrs {
+		programHash, err := common.ToScriptHash(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid beneficiary address %s: %v", addr, err)
+		}
+		beneficiaries[programHash] = struct{}{}
+	}
+	return beneficiaries, nil
+}
+
 func (c *Common) GetPrice() (common.Fixed64, common.Fixed64) {
 	c.Lock()
 	defer c.Unlock()
 	return c.entryToExitPrice, c.exitToEntryPrice
 }
 
+// EstimateCost returns the cost of the given traffic at the price of the
+// server currently selected, e.g. to warn user before a large transfer.
+func (c *Common) EstimateCost(bytesEntryToExit, bytesExitToEntry uint64) (common.Fixed64, error) {
+	if len(c.GetRemoteNknAddress()) == 0 {
+		return 0, errors.New("no server selected")
+	}
+	entryToExitPrice, exitToEntryPrice := c.GetPrice()
+	price := Price{EntryToExit: entryToExitPrice, ExitToEntry: exitToEntryPrice, Unit: c.GetPriceUnit()}
+	return price.Cost(bytesEntryToExit, bytesExitToEntry), nil
+}
+
+// GetPriceUnit returns the number of bytes the price returned by GetPrice is
+// charged per.
+func (c *Common) GetPriceUnit() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return Price{Unit: c.priceUnit}.unit()
+}
+
+func (c *Common) subscriberRejected(subscriber string, reason string) {
+	atomic.AddUint64(&c.subscriberRejects, 1)
+	if c.OnSubscriberRejected != nil {
+		c.OnSubscriberRejected(subscriber, reason)
+	}
+}
+
+// streamEnded calls OnStreamEnd with the error that terminated a piped stream,
+// which is nil if the stream ended by EOF.
+func (c *Common) streamEnded(err error) {
+	if c.OnStreamEnd != nil {
+		c.OnStreamEnd(err)
+	}
+}
+
+// streamID returns an ID of stream for OnStreamOpen and OnStreamClose, which
+// is remote address and smux stream ID if available, or a sequence number
+// otherwise.
+func (c *Common) streamID(stream io.ReadWriteCloser) string {
+	if s, ok := stream.(interface {
+		ID() uint32
+		RemoteAddr() net.Addr
+	}); ok {
+		return fmt.Sprintf("%s/%d", s.RemoteAddr(), s.ID())
+	}
+	return strconv.FormatUint(atomic.AddUint64(&c.streamCount, 1), 10)
+}
+
+// paymentMade calls OnPayment in a new goroutine so that it does not block the
+// payment loop. Amount is the incremental payment just sent and totalBytes is
+// the total traffic paid so far in this session.
+func (c *Common) paymentMade(receiver string, amount common.Fixed64, totalBytes uint64) {
+	if c.OnPayment != nil {
+		go c.OnPayment(receiver, amount, totalBytes)
+	}
+}
+
+// spendLimitHit marks MaxTotalSpend as reached and calls OnSpendLimitReached
+// in a new goroutine for the first time.
+func (c *Common) spendLimitHit(totalSpend common.Fixed64) {
+	if atomic.CompareAndSwapInt32(&c.spendLimitReached, 0, 1) && c.OnSpendLimitReached != nil {
+		go c.OnSpendLimitReached(totalSpend)
+	}
+}
+
+// IsSpendLimitReached returns true if paying for more traffic would exceed
+// MaxTotalSpend. New streams are rejected with ErrSpendLimitReached and no
+// more payment is sent after that.
+func (c *Common) IsSpendLimitReached() bool {
+	return atomic.LoadInt32(&c.spendLimitReached) == 1
+}
+
+func (c *Common) subscriberSelected(subscriber string) {
+	if c.OnSubscriberSelected != nil {
+		c.OnSubscriberSelected(subscriber)
+	}
+}
+
+// Status returns the current connection status. Byte counters are filled by
+// TunaEntry and TunaExit.
+func (c *Common) Status() *ConnectionStatus {
+	c.RLock()
+	defer c.RUnlock()
+	status := &ConnectionStatus{
+		Connected:        c.connected,
+		RemoteNknAddress: c.remoteNknAddress,
+		PaymentReceiver:  c.paymentReceiver,
+		EntryToExitPrice: c.entryToExitPrice,
+		ExitToEntryPrice: c.exitToEntryPrice,
+		ActiveSessions:   c.activeSessions,
+	}
+	if c.metadata != nil {
+		status.IP = c.metadata.Ip
+		status.TCPPort = c.metadata.TcpPort
+		status.UDPPort = c.metadata.UdpPort
+	}
+	return status
+}
+
+// StartUDPReaderWriter forwards data between conn and the channels set by
+// SetServerUDPReadChan and SetServerUDPWriteChan until conn is closed. Data
+// read from conn is dropped if read channel is not set.
 func (c *Common) StartUDPReaderWriter(conn *net.UDPConn) {
+	udpReadChan, udpWriteChan := c.udpReadChan, c.udpWriteChan
+	if udpReadChan == nil {
+		log.Println("UDP read channel is not set, data from server will be dropped")
+	}
+	if udpWriteChan == nil {
+		log.Println("UDP write channel is not set, no data will be sent to server")
+	}
+
+	// closed when reader stops because conn or c is closed, so that writer of
+	// a replaced conn stops instead of competing with the writer of the new conn
+	connClosed := make(chan struct{})
+
 	go func() {
+		defer close(connClosed)
 		for {
 			buffer := make([]byte, 2048)
 			n, err := conn.Read(buffer)
 			if err != nil {
 				log.Println("Couldn't receive data from server:", err)
 				if strings.Contains(err.Error(), "use of closed network connection") {
-					c.udpCloseChan <- struct{}{}
 					return
 				}
 				continue
 			}
 
+			if udpReadChan == nil {
+				continue
+			}
 			data := make([]byte, n)
 			copy(data, buffer)
-			c.udpReadChan <- data
+			if !sendDatagram(udpReadChan, data, c.closeChan) {
+				return
+			}
 		}
 	}()
 	go func() {
 		for {
 			select {
-			case data := <-c.udpWriteChan:
+			case data := <-udpWriteChan:
 				_, err := conn.Write(data)
 				if err != nil {
 					log.Println("Couldn't send data to server:", err)
 				}
-			case <-c.udpCloseChan:
+			case <-connClosed:
 				return
 			}
 		}
 	}()
 }
 
+// sendDatagram sends data to c and returns false if closeChan is closed first.
+// If c is buffered and full, the oldest datagram in it is dropped instead of
+// blocking, so that a slow receiver only loses stale datagrams.
+func sendDatagram(c chan []byte, data []byte, closeChan chan struct{}) bool {
+	if cap(c) == 0 {
+		select {
+		case c <- data:
+			return true
+		case <-closeChan:
+			return false
+		}
+	}
+	for {
+		select {
+		case c <- data:
+			return true
+		case <-closeChan:
+			return false
+		default:
+		}
+		select {
+		case <-c:
+		default:
+		}
+	}
+}
+
 func (c *Common) getOrComputeSharedKey(remotePublicKey []byte) (*[sharedKeySize]byte, error) {
 	c.RLock()
 	sharedKey, ok := c.sharedKeys[string(remotePublicKey)]
@@ -421,6 +837,8 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 
 	defer conn.SetDeadline(time.Time{})
 
+	localConnMetadata.Compression = c.Compression
+
 	if len(remotePublicKey) > 0 {
 		encryptionAlgo = c.encryptionAlgo
 		localConnMetadata.EncryptionAlgo = encryptionAlgo
@@ -438,8 +856,12 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 
 		connNonce = remoteConnMetadata.Nonce
 	} else {
-		connNonce = util.RandomBytes(connNonceSize)
-		localConnMetadata.Nonce = connNonce
+		// nonce can be chosen by caller to authenticate remote with it later
+		connNonce = localConnMetadata.Nonce
+		if len(connNonce) == 0 {
+			connNonce = util.RandomBytes(connNonceSize)
+			localConnMetadata.Nonce = connNonce
+		}
 
 		err := writeConnMetadata(conn, localConnMetadata)
 		if err != nil {
@@ -478,46 +900,240 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 	return encryptedConn, remoteConnMetadata, nil
 }
 
+func (c *Common) setRemoteCompression(compression bool) {
+	c.Lock()
+	c.remoteCompression = compression
+	c.Unlock()
+}
+
+// useCompression returns whether streams opened to remote should be
+// compressed, which requires both sides to enable compression.
+func (c *Common) useCompression() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Compression && c.remoteCompression
+}
+
+// topic returns the topic servers of service subscribe to, which is
+// ServiceInfo.Topic if set, or SubscriptionPrefix + Service.Name otherwise.
+func (c *Common) topic() string {
+	if c.ServiceInfo != nil && len(c.ServiceInfo.Topic) > 0 {
+		return c.ServiceInfo.Topic
+	}
+	return c.SubscriptionPrefix + c.Service.Name
+}
+
+// blockFailedServer skips server in selection for FailedServerBlockDuration
+// after failing to connect to it, since it's likely offline while its
+// subscription has not expired yet.
+func (c *Common) blockFailedServer(addr string) {
+	if c.FailedServerBlockDuration > 0 && len(c.PreferredServer) == 0 {
+		c.failedServers.Set(addr, struct{}{}, c.FailedServerBlockDuration)
+	}
+}
+
+func (c *Common) isServerBlocked(addr string) bool {
+	_, ok := c.failedServers.Get(addr)
+	return ok
+}
+
+// getSubscribersCountContext is like SubscriberSource.GetSubscribersCountContext
+// but reuses the result for SubscriberCacheTTL.
+func (c *Common) getSubscribersCountContext(ctx context.Context, topic string) (int, error) {
+	key := "count:" + topic
+	if count, ok := c.subscriberCache.Get(key); ok {
+		return count.(int), nil
+	}
+	count, err := c.SubscriberSource.GetSubscribersCountContext(ctx, topic)
+	if err != nil {
+		return 0, err
+	}
+	if c.SubscriberCacheTTL > 0 {
+		c.subscriberCache.Set(key, count, c.SubscriberCacheTTL)
+	}
+	return count, nil
+}
+
+// getSubscribersContext returns subscribers of topic in a batch with their
+// metadata, and reuses the result for SubscriberCacheTTL. The returned map
+// is a copy and can be modified by caller.
+func (c *Common) getSubscribersContext(ctx context.Context, topic string, offset, limit int) (map[string]string, error) {
+	key := fmt.Sprintf("subscribers:%s:%d:%d", topic, offset, limit)
+	subscribers, ok := c.subscriberCache.Get(key)
+	if !ok {
+		res, err := c.SubscriberSource.GetSubscribersContext(ctx, topic, offset, limit, true, false)
+		if err != nil {
+			return nil, err
+		}
+		subscribers = res.Subscribers.Map
+		if c.SubscriberCacheTTL > 0 {
+			c.subscriberCache.Set(key, subscribers, c.SubscriberCacheTTL)
+		}
+	}
+	m := subscribers.(map[string]string)
+	subscriberRaw := make(map[string]string, len(m))
+	for k, v := range m {
+		subscriberRaw[k] = v
+	}
+	return subscriberRaw, nil
+}
+
+// needTCP returns whether a TCP connection to server is needed by service.
+func (c *Common) needTCP() bool {
+	return len(c.Service.TCP) > 0 || (c.UDPOverTCP && !c.Reverse && len(c.Service.UDP) > 0) || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceTcp) > 0) || (c.ServiceInfo != nil && (len(c.ServiceInfo.SOCKS5ListenAddr) > 0 || len(c.ServiceInfo.HTTPProxyListenAddr) > 0))
+}
+
+// needUDP returns whether a UDP connection to server is needed by service,
+// which is not the case if UDP is tunneled over TCP.
+func (c *Common) needUDP() bool {
+	if c.UDPOverTCP && !c.Reverse {
+		return false
+	}
+	return len(c.Service.UDP) > 0 || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceUdp) > 0)
+}
+
+// useQUIC returns whether session to server runs over QUIC instead of TCP.
+func (c *Common) useQUIC() bool {
+	return c.Transport == TransportQUIC && !c.Reverse
+}
+
+// serverTCPConn is a TCP connection to server that has completed handshake.
+type serverTCPConn struct {
+	net.Conn
+	addr               string
+	dialRTT            time.Duration
+	remoteConnMetadata *pb.ConnectionMetadata
+}
+
+// dialServerTCP connects to TCP port of server in metadata and completes
+// handshake. It does not change the state of c, so multiple servers can be
+// dialed concurrently. Retrying failed dial stops when ctx is done.
+func (c *Common) dialServerTCP(ctx context.Context, metadata *pb.ServiceMetadata, remotePublicKey []byte) (*serverTCPConn, error) {
+	network, port := tcp, metadata.TcpPort
+	if c.useQUIC() {
+		network, port = TransportQUIC, metadata.QuicPort
+		if port == 0 {
+			return nil, errors.New("server has no QUIC port")
+		}
+	}
+	addr, err := c.resolveServerAddr(metadata.Ip, port)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s address: %w", network, err)
+	}
+	dialStart := time.Now()
+	tcpConn, err := c.Dialer.DialTimeout(
+		network,
+		addr,
+		c.DialTimeout,
+	)
+	// retry transient dial failure before giving up an otherwise good
+	// server
+	for i := 0; err != nil && i < c.DialRetries; i++ {
+		log.Printf("Dial %s %s error: %v, retry in %v", network, addr, err, dialRetryInterval)
+		if err := sleepContext(ctx, dialRetryInterval); err != nil {
+			return nil, fmt.Errorf("dial %s %s: %w", network, addr, err)
+		}
+		dialStart = time.Now()
+		tcpConn, err = c.Dialer.DialTimeout(network, addr, c.DialTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s: %w", network, addr, err)
+	}
+	// TCP and QUIC dial return after handshake, so its duration approximates
+	// RTT
+	dialRTT := time.Since(dialStart)
+	if c.LogDialRTT {
+		log.Printf("Dial %s %s RTT: %v", network, addr, dialRTT)
+	}
+
+	serviceHandshake := !c.Reverse && !c.IsServer
+	encryptedConn, remoteConnMetadata, err := c.wrapConn(tcpConn, remotePublicKey, &pb.ConnectionMetadata{
+		ServiceHandshake: serviceHandshake,
+	})
+	if err != nil {
+		Close(tcpConn)
+		return nil, fmt.Errorf("tcp handshake with %s: %w", addr, err)
+	}
+
+	if remoteConnMetadata.EntryAuth {
+		err = requestEntryAuth(encryptedConn, c.Wallet, remoteConnMetadata.Nonce)
+		if err != nil {
+			Close(encryptedConn)
+			return nil, fmt.Errorf("authenticate to %s: %w", addr, err)
+		}
+	}
+
+	if serviceHandshake && remoteConnMetadata.ServiceHandshake {
+		err = requestService(encryptedConn, metadata.ServiceId, c.Service.Name)
+		if err != nil {
+			Close(encryptedConn)
+			return nil, fmt.Errorf("request service from %s: %w", addr, err)
+		}
+	}
+
+	return &serverTCPConn{
+		Conn:               encryptedConn,
+		addr:               addr,
+		dialRTT:            dialRTT,
+		remoteConnMetadata: remoteConnMetadata,
+	}, nil
+}
+
+// UpdateServerConn connects to server in metadata. Returned error tells which
+// of TCP and UDP connection failed and wraps the cause, e.g.
+// ErrServiceNotProvided.
 func (c *Common) UpdateServerConn(remotePublicKey []byte) error {
-	hasTCP := len(c.Service.TCP) > 0 || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceTcp) > 0)
-	hasUDP := len(c.Service.UDP) > 0 || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceUdp) > 0)
+	return c.updateServerConn(context.Background(), remotePublicKey, nil)
+}
+
+// updateServerConn is like UpdateServerConn but uses tcpConn as the TCP
+// connection to server if it's not nil.
+func (c *Common) updateServerConn(ctx context.Context, remotePublicKey []byte, tcpConn *serverTCPConn) error {
+	hasTCP := c.needTCP()
+	hasUDP := c.needUDP()
 	metadata := c.GetMetadata()
 
 	if hasTCP {
 		Close(c.GetTCPConn())
 
-		addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TcpPort))
-		tcpConn, err := net.DialTimeout(
-			tcp,
-			addr,
-			time.Duration(c.DialTimeout)*time.Second,
-		)
-		if err != nil {
-			return err
+		if tcpConn == nil {
+			var err error
+			tcpConn, err = c.dialServerTCP(ctx, metadata, remotePublicKey)
+			if err != nil {
+				return err
+			}
 		}
+		atomic.StoreInt64(&c.lastDialRTT, int64(tcpConn.dialRTT))
 
-		encryptedConn, _, err := c.wrapConn(tcpConn, remotePublicKey, nil)
-		if err != nil {
-			Close(tcpConn)
-			return err
-		}
+		c.setRemoteCompression(tcpConn.remoteConnMetadata.Compression)
+		c.setRemoteHealthCheck(tcpConn.remoteConnMetadata.HealthCheck)
 
-		c.SetServerTCPConn(encryptedConn)
+		c.SetServerTCPConn(tcpConn.Conn)
 
-		log.Println("Connected to TCP at", addr)
+		if c.useQUIC() {
+			log.Println("Connected to QUIC at", tcpConn.addr)
+		} else {
+			log.Println("Connected to TCP at", tcpConn.addr)
+		}
+	} else if tcpConn != nil {
+		Close(tcpConn.Conn)
 	}
 	if hasUDP {
 		udpConn := c.GetUDPConn()
 		Close(udpConn)
 
-		addr := net.UDPAddr{IP: net.ParseIP(metadata.Ip), Port: int(metadata.UdpPort)}
-		udpConn, err := net.DialUDP(
-			udp,
-			nil,
-			&addr,
-		)
+		// metadata ip can be a host name, which also needs to work for UDP
+		hostPort, err := c.resolveServerAddr(metadata.Ip, metadata.UdpPort)
 		if err != nil {
-			return err
+			return fmt.Errorf("resolve udp address: %w", err)
+		}
+		addr, err := net.ResolveUDPAddr(udp, hostPort)
+		if err != nil {
+			return fmt.Errorf("resolve udp address: %w", err)
+		}
+		udpConn, err = c.dialUDP(addr)
+		if err != nil {
+			return fmt.Errorf("dial udp %s: %w", addr, err)
 		}
 		c.SetServerUDPConn(udpConn)
 		log.Println("Connected to UDP at", addr.String())
@@ -526,86 +1142,534 @@ func (c *Common) UpdateServerConn(remotePublicKey []byte) error {
 	}
 
 	c.SetConnected(true)
+	atomic.AddUint64(&c.serverConnCount, 1)
 
 	c.OnConnect.receive()
 
 	return nil
 }
 
+// resolveServerAddr returns host:port of server with host name resolved by
+// Resolver if set. Both TCP and UDP use it so that they reach the same server.
+func (c *Common) resolveServerAddr(host string, port uint32) (string, error) {
+	ctx := context.Background()
+	if c.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+	return resolveHostPort(ctx, c.Resolver, host, port)
+}
+
+// dialUDP dials remote UDP address from UDPLocalIP and a port within
+// [UDPLocalPortMin, UDPLocalPortMax] if set, so that outbound UDP traffic can
+// pass firewalls only allowing specific source ports.
+func (c *Common) dialUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if c.UDPLocalPortMax == 0 {
+		var laddr *net.UDPAddr
+		if c.UDPLocalIP != nil {
+			laddr = &net.UDPAddr{IP: c.UDPLocalIP}
+		}
+		return c.Dialer.DialUDP(udp, laddr, addr)
+	}
+
+	numPorts := c.UDPLocalPortMax - c.UDPLocalPortMin + 1
+	offset := rand.Intn(numPorts)
+	var err error
+	for i := 0; i < numPorts; i++ {
+		laddr := &net.UDPAddr{IP: c.UDPLocalIP, Port: c.UDPLocalPortMin + (offset+i)%numPorts}
+		var conn *net.UDPConn
+		conn, err = c.Dialer.DialUDP(udp, laddr, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no available local udp port in [%d, %d]: %v", c.UDPLocalPortMin, c.UDPLocalPortMax, err)
+}
+
+// Reconnect drops the connection to current server and connects to a newly
+// selected one, e.g. when current server is slow. Streams on the old
+// connection are terminated. Current server is skipped in this selection
+// unless it is PreferredServer.
+func (c *Common) Reconnect() error {
+	return c.ReconnectContext(context.Background())
+}
+
+// ReconnectContext is like Reconnect but gives up when ctx is done.
+func (c *Common) ReconnectContext(ctx context.Context) error {
+	if c.IsServer {
+		return errors.New("reconnect is not supported by server")
+	}
+
+	c.Lock()
+	if len(c.PreferredServer) == 0 {
+		c.skippedServer = c.remoteNknAddress
+	}
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.skippedServer = ""
+		c.Unlock()
+	}()
+
+	return c.CreateServerConnContext(ctx, true)
+}
+
+// serverCandidate is a subscriber that passed the checks before connecting.
+type serverCandidate struct {
+	node            *types.Node
+	metadata        *pb.ServiceMetadata
+	price           Price
+	paymentReceiver string
+	remotePublicKey []byte
+}
+
+// checkCandidate returns the candidate of subscriber, or nil if subscriber is
+// rejected. It does not change the state of c.
+func (c *Common) checkCandidate(subscriber *types.Node) *serverCandidate {
+	metadata := subscriber.Metadata
+
+	log.Printf("IP: %s, address: %s, delay: %.3f ms, bandwidth: %f KB/s", metadata.Ip, subscriber.Address, subscriber.Delay, subscriber.Bandwidth/1024)
+
+	price, err := parseMetadataPrice(metadata)
+	if err != nil {
+		log.Println(err)
+		c.subscriberRejected(subscriber.Address, "invalid price")
+		return nil
+	}
+	if maxPrice, err := ParsePrice(c.ServiceInfo.MaxPrice); err == nil && price.Exceeds(maxPrice) {
+		c.subscriberRejected(subscriber.Address, "price too high")
+		return nil
+	}
+
+	paymentReceiver := metadata.BeneficiaryAddr
+	if len(paymentReceiver) > 0 {
+		err = nkn.VerifyWalletAddress(paymentReceiver)
+		if err != nil {
+			log.Println(err)
+			c.subscriberRejected(subscriber.Address, "invalid beneficiary address")
+			return nil
+		}
+	} else {
+		paymentReceiver, err = nkn.ClientAddrToWalletAddr(subscriber.Address)
+		if err != nil {
+			log.Println(err)
+			c.subscriberRejected(subscriber.Address, "invalid address")
+			return nil
+		}
+
+		err = nkn.VerifyWalletAddress(paymentReceiver)
+		if err != nil {
+			log.Println(err)
+			c.subscriberRejected(subscriber.Address, "invalid payment receiver")
+			return nil
+		}
+	}
+	if !c.isBeneficiaryAllowed(paymentReceiver) {
+		c.subscriberRejected(subscriber.Address, "beneficiary not allowed")
+		return nil
+	}
+
+	remotePublicKey, err := nkn.ClientAddrToPubKey(subscriber.Address)
+	if err != nil {
+		log.Println(err)
+		c.subscriberRejected(subscriber.Address, "invalid public key")
+		return nil
+	}
+
+	if c.ReverseMetadata != nil {
+		metadata, err = mergeReverseMetadata(metadata, c.ReverseMetadata)
+		if err != nil {
+			log.Println(err)
+			c.subscriberRejected(subscriber.Address, "service ports not offered")
+			return nil
+		}
+	}
+
+	return &serverCandidate{
+		node:            subscriber,
+		metadata:        metadata,
+		price:           price,
+		paymentReceiver: paymentReceiver,
+		remotePublicKey: remotePublicKey,
+	}
+}
+
+// mergeReverseMetadata returns a copy of metadata of selected server with
+// service ports replaced by the ones of reverse metadata, since a reverse entry
+// serves whatever ports the reverse exit asks for. An error is returned if
+// selected server doesn't have a listener for the protocol needed by reverse
+// ports, or doesn't offer some of them when it advertises service ports.
+func mergeReverseMetadata(selected, reverse *pb.ServiceMetadata) (*pb.ServiceMetadata, error) {
+	if len(reverse.ServiceTcp) > 0 {
+		if selected.TcpPort == 0 {
+			return nil, errors.New("server has no TCP port for reverse TCP service")
+		}
+		if err := checkPortsOffered(tcp, reverse.ServiceTcp, selected.ServiceTcp); err != nil {
+			return nil, err
+		}
+	}
+	if len(reverse.ServiceUdp) > 0 {
+		if selected.UdpPort == 0 {
+			return nil, errors.New("server has no UDP port for reverse UDP service")
+		}
+		if err := checkPortsOffered(udp, reverse.ServiceUdp, selected.ServiceUdp); err != nil {
+			return nil, err
+		}
+	}
+	merged := proto.Clone(selected).(*pb.ServiceMetadata)
+	merged.ServiceTcp = reverse.ServiceTcp
+	merged.ServiceUdp = reverse.ServiceUdp
+	return merged, nil
+}
+
+// checkPortsOffered returns an error if some of ports are not in offered.
+// Empty offered means any port is offered.
+func checkPortsOffered(protocol string, ports, offered []uint32) error {
+	if len(offered) == 0 {
+		return nil
+	}
+	for _, port := range ports {
+		found := false
+		for _, p := range offered {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s port %d is not offered by server", protocol, port)
+		}
+	}
+	return nil
+}
+
+// parallelDial returns the number of servers to dial concurrently.
+func (c *Common) parallelDial() int {
+	if c.ParallelDial > 1 {
+		return c.ParallelDial
+	}
+	return 1
+}
+
+// dialCandidates dials TCP of candidates concurrently and returns the first
+// one connected with its connection. Connections to the others are closed.
+// Candidate is returned with nil connection if TCP is not needed, and nil
+// candidate is returned if all of them failed.
+func (c *Common) dialCandidates(ctx context.Context, candidates []*serverCandidate) (*serverCandidate, *serverTCPConn) {
+	if !c.needTCP() {
+		return candidates[0], nil
+	}
+
+	type dialResult struct {
+		candidate *serverCandidate
+		conn      *serverTCPConn
+		err       error
+	}
+	results := make(chan dialResult, len(candidates))
+	for _, candidate := range candidates {
+		go func(candidate *serverCandidate) {
+			conn, err := c.dialServerTCP(ctx, candidate.node.Metadata, candidate.remotePublicKey)
+			results <- dialResult{candidate: candidate, conn: conn, err: err}
+		}(candidate)
+	}
+
+	for i := range candidates {
+		result := <-results
+		if result.err == nil {
+			// close connections established too late in background
+			go func(n int) {
+				for ; n > 0; n-- {
+					if result := <-results; result.conn != nil {
+						Close(result.conn.Conn)
+					}
+				}
+			}(len(candidates) - i - 1)
+			return result.candidate, result.conn
+		}
+
+		log.Println(result.err)
+		if ctx.Err() != nil {
+			// dial was given up, which is not the fault of server
+			continue
+		}
+		address := result.candidate.node.Address
+		if errors.Is(result.err, ErrServiceNotProvided) {
+			c.subscriberRejected(address, "service not provided")
+		} else {
+			c.subscriberRejected(address, "dial failed")
+			c.blockFailedServer(address)
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *Common) isServerSkipped(addr string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.skippedServer) > 0 && addr == c.skippedServer
+}
+
 func (c *Common) CreateServerConn(force bool) error {
+	return c.CreateServerConnContext(context.Background(), force)
+}
+
+// CreateServerConnContext selects a server and connects to it, retrying until
+// success, ctx is done, or ConnectTimeout (if positive) is reached.
+func (c *Common) CreateServerConnContext(ctx context.Context, force bool) error {
 	if !c.IsServer && (!c.GetConnected() || force) {
+		if c.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.ConnectTimeout)
+			defer cancel()
+		}
+
+		if force {
+			// subscribers may have changed, e.g. current server is gone
+			c.subscriberCache.Flush()
+		}
+
+		tryCachedServer := len(c.ServerCacheFile) > 0 && len(c.PreferredServer) == 0
+		startupBackoff := tunaUtil.NewBackoff(c.StartupRetryInterval, startupRetryIntervalMax)
+
 		for {
+			c.RLock()
+			isClosed := c.isClosed
+			c.RUnlock()
+			if isClosed {
+				return ErrClosed
+			}
+
+			if err := connectContextErr(ctx); err != nil {
+				return err
+			}
+
 			err := c.SetPaymentReceiver("")
 			if err != nil {
 				return err
 			}
 
-			candidateSubs, err := c.GetTopPerformanceNodes(c.MeasureBandwidth, measureBandwidthTopCount)
+			var candidateSubs types.Nodes
+			if tryCachedServer {
+				tryCachedServer = false
+				candidateSubs, err = c.getCachedServerNodesContext(ctx)
+				if err != nil {
+					log.Println("Couldn't use cached server:", err)
+					continue
+				}
+			} else {
+				candidateSubs, err = c.getCandidateNodesContext(ctx, measureBandwidthTopCount)
+			}
 			if err != nil {
+				if c.StartupRetry && isNoServersErr(err) {
+					delay := startupBackoff.Next()
+					log.Printf("%v, retry in %v", err, delay)
+					sleepContext(ctx, delay)
+					continue
+				}
+				if errors.Is(err, ErrInsufficientServers) || errors.Is(err, ErrServerNotSubscribed) {
+					return err
+				}
 				log.Println(err)
-				time.Sleep(time.Second)
+				sleepContext(ctx, time.Second)
 				continue
 			}
 
-			for _, subscriber := range candidateSubs {
-				metadata := subscriber.Metadata
-				c.SetMetadata(metadata)
+			for i := 0; i < len(candidateSubs); {
+				batch := make([]*serverCandidate, 0, c.parallelDial())
+				for ; i < len(candidateSubs) && len(batch) < cap(batch); i++ {
+					if candidate := c.checkCandidate(candidateSubs[i]); candidate != nil {
+						batch = append(batch, candidate)
+					}
+				}
+				if len(batch) == 0 {
+					break
+				}
 
-				log.Printf("IP: %s, address: %s, delay: %.3f ms, bandwidth: %f KB/s", metadata.Ip, subscriber.Address, subscriber.Delay, subscriber.Bandwidth/1024)
+				candidate, tcpConn := c.dialCandidates(ctx, batch)
+				if candidate == nil {
+					if err := sleepContext(ctx, time.Second); err != nil {
+						return connectContextErr(ctx)
+					}
+					continue
+				}
+				subscriber := candidate.node
+
+				c.SetMetadata(candidate.metadata)
+				c.Lock()
+				c.paymentReceiver = candidate.paymentReceiver
+				c.remoteNknAddress = subscriber.Address
+				c.entryToExitPrice = candidate.price.EntryToExit
+				c.exitToEntryPrice = candidate.price.ExitToEntry
+				c.priceUnit = candidate.price.Unit
+				c.Unlock()
 
-				entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+				err = c.updateServerConn(ctx, candidate.remotePublicKey, tcpConn)
 				if err != nil {
 					log.Println(err)
+					c.subscriberRejected(subscriber.Address, "dial failed")
+					c.blockFailedServer(subscriber.Address)
+					if err := sleepContext(ctx, time.Second); err != nil {
+						return connectContextErr(ctx)
+					}
 					continue
 				}
 
-				if len(metadata.BeneficiaryAddr) > 0 {
-					err = c.SetPaymentReceiver(metadata.BeneficiaryAddr)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-				} else {
-					addr, err := nkn.ClientAddrToWalletAddr(subscriber.Address)
+				c.subscriberSelected(subscriber.Address)
+
+				if len(c.ServerCacheFile) > 0 {
+					err = ioutil.WriteFile(c.ServerCacheFile, []byte(subscriber.Address), 0644)
 					if err != nil {
-						log.Println(err)
-						continue
+						log.Println("Couldn't save server cache:", err)
 					}
+				}
+
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Common) getCandidateNodesContext(ctx context.Context, n int) (types.Nodes, error) {
+	switch c.SelectionStrategy {
+	case SelectionStrategyPrice:
+		return c.GetPriceWeightedNodesContext(ctx, n)
+	default:
+		return c.GetTopPerformanceNodesContext(ctx, c.MeasureBandwidth, n)
+	}
+}
+
+// getCachedServerNodesContext returns the server saved in ServerCacheFile by
+// last successful connection if it's still subscribed and passes filters.
+func (c *Common) getCachedServerNodesContext(ctx context.Context) (types.Nodes, error) {
+	content, err := ioutil.ReadFile(c.ServerCacheFile)
+	if err != nil {
+		return nil, err
+	}
+	addr := strings.TrimSpace(string(content))
+	if len(addr) == 0 {
+		return nil, errors.New("empty server cache file")
+	}
+
+	topic := c.topic()
+	subscription, err := c.SubscriberSource.GetSubscriptionContext(ctx, topic, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(subscription.Meta) == 0 {
+		return nil, fmt.Errorf("%w: %s is not subscribed to %s", ErrServerNotSubscribed, addr, topic)
+	}
+
+	return c.filterSubscribers([]string{addr}, map[string]string{addr: subscription.Meta})
+}
+
+// isNoServersErr returns true if err means there are not enough servers to
+// select from yet, which may be resolved by servers subscribing later.
+func isNoServersErr(err error) bool {
+	return errors.Is(err, ErrNoServiceProviders) ||
+		errors.Is(err, ErrNoAllowedServiceProviders) ||
+		errors.Is(err, ErrInsufficientServers) ||
+		errors.Is(err, ErrServerNotSubscribed)
+}
+
+// connectContextErr returns ErrConnectTimeout if ctx deadline is exceeded, or
+// ctx.Err() otherwise.
+func connectContextErr(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrConnectTimeout, err)
+	}
+	return err
+}
+
+// sleepContext sleeps for duration d or until ctx is done, in which case
+// ctx.Err() is returned.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// GetPriceWeightedNodes returns up to n nodes in weighted random order, where
+// the weight of each node is inversely proportional to its total price.
+func (c *Common) GetPriceWeightedNodes(n int) (types.Nodes, error) {
+	return c.GetPriceWeightedNodesContext(context.Background(), n)
+}
+
+func (c *Common) GetPriceWeightedNodesContext(ctx context.Context, n int) (types.Nodes, error) {
+	if len(c.ServiceInfo.IPFilter.GetProviders()) > 0 {
+		c.ServiceInfo.IPFilter.UpdateDataFileContext(ctx)
+	}
+
+	if c.measureStorage != nil {
+		measureStorageMutex.Lock()
+		err := c.measureStorage.Load()
+		measureStorageMutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	allSubscribers, subscriberRaw, err := c.nknFilterContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filterSubs, err := c.filterSubscribers(allSubscribers, subscriberRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	candidateSubs := c.weightedShuffleByPrice(filterSubs)
+	if len(candidateSubs) > n {
+		candidateSubs = candidateSubs[:n]
+	}
+
+	return candidateSubs, nil
+}
 
-					err = c.SetPaymentReceiver(addr)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-				}
-				c.Lock()
-				c.remoteNknAddress = subscriber.Address
-				c.entryToExitPrice = entryToExitPrice
-				c.exitToEntryPrice = exitToEntryPrice
-				if c.ReverseMetadata != nil {
-					c.metadata.ServiceTcp = c.ReverseMetadata.ServiceTcp
-					c.metadata.ServiceUdp = c.ReverseMetadata.ServiceUdp
-				}
-				c.Unlock()
-				remotePublicKey, err := nkn.ClientAddrToPubKey(subscriber.Address)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+func (c *Common) randIntn(n int) int {
+	if c.SelectionRand != nil {
+		return c.SelectionRand.Intn(n)
+	}
+	return rand.Intn(n)
+}
 
-				err = c.UpdateServerConn(remotePublicKey)
-				if err != nil {
-					log.Println(err)
-					time.Sleep(time.Second)
-					continue
-				}
+func (c *Common) randExpFloat64() float64 {
+	if c.SelectionRand != nil {
+		return c.SelectionRand.ExpFloat64()
+	}
+	return rand.ExpFloat64()
+}
 
-				return nil
-			}
+// weightedShuffleByPrice returns nodes in weighted random order without
+// replacement, using weight 1 / (price + minPriceWeightOffset).
+func (c *Common) weightedShuffleByPrice(nodes types.Nodes) types.Nodes {
+	keys := make(map[*types.Node]float64, len(nodes))
+	for _, node := range nodes {
+		price, err := parseMetadataPrice(node.Metadata)
+		if err != nil {
+			continue
 		}
+		weight := 1 / (price.perTrafficUnit() + minPriceWeightOffset)
+		keys[node] = c.randExpFloat64() / weight
 	}
 
-	return nil
+	shuffled := make(types.Nodes, 0, len(keys))
+	for node := range keys {
+		shuffled = append(shuffled, node)
+	}
+	sort.Slice(shuffled, func(i, j int) bool {
+		return keys[shuffled[i]] < keys[shuffled[j]]
+	})
+
+	return shuffled
 }
 
 func (c *Common) GetTopPerformanceNodes(measureBandwidth bool, n int) (types.Nodes, error) {
@@ -633,7 +1697,10 @@ func (c *Common) GetTopPerformanceNodesContext(ctx context.Context, measureBandw
 		return nil, err
 	}
 
-	filterSubs = c.filterSubscribers(allSubscribers, subscriberRaw)
+	filterSubs, err = c.filterSubscribers(allSubscribers, subscriberRaw)
+	if err != nil {
+		return nil, err
+	}
 
 	var candidateSubs types.Nodes
 	if len(filterSubs) == 0 {
@@ -665,10 +1732,21 @@ func (c *Common) nknFilter() ([]string, map[string]string, error) {
 }
 
 func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]string, error) {
-	topic := c.SubscriptionPrefix + c.Service.Name
+	topic := c.topic()
 	var allSubscribers []string
 	var subscriberRaw map[string]string
 
+	if len(c.PreferredServer) > 0 {
+		subscription, err := c.SubscriberSource.GetSubscriptionContext(ctx, topic, c.PreferredServer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(subscription.Meta) == 0 {
+			return nil, nil, fmt.Errorf("%w: %s is not subscribed to %s", ErrServerNotSubscribed, c.PreferredServer, topic)
+		}
+		return []string{c.PreferredServer}, map[string]string{c.PreferredServer: subscription.Meta}, nil
+	}
+
 	if c.ServiceInfo.NknFilter != nil && len(c.ServiceInfo.NknFilter.Allow) > 0 {
 		nknFilterLength := len(c.ServiceInfo.NknFilter.Allow)
 		subscriberRaw = make(map[string]string, nknFilterLength)
@@ -677,7 +1755,7 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 			if len(f.Metadata) > 0 {
 				subscriberRaw[f.Address] = f.Metadata
 			} else {
-				subscription, err := c.Wallet.GetSubscriptionContext(ctx, topic, f.Address)
+				subscription, err := c.SubscriberSource.GetSubscriptionContext(ctx, topic, f.Address)
 				if err != nil {
 					log.Println(err)
 					continue
@@ -687,25 +1765,29 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 			allSubscribers = append(allSubscribers, f.Address)
 		}
 		if len(allSubscribers) == 0 {
-			return nil, nil, errors.New("none of the NKN address whitelist can provide service")
+			return nil, nil, fmt.Errorf("%w for %s", ErrNoAllowedServiceProviders, c.Service.Name)
+		}
+		if len(allSubscribers) < c.MinSubscribers {
+			return nil, nil, fmt.Errorf("%w: %d available, %d required", ErrInsufficientServers, len(allSubscribers), c.MinSubscribers)
 		}
 	} else {
-		subscribersCount, err := c.Wallet.GetSubscribersCountContext(ctx, topic)
+		subscribersCount, err := c.getSubscribersCountContext(ctx, topic)
 		if err != nil {
 			return nil, nil, err
 		}
 		if subscribersCount == 0 {
-			return nil, nil, errors.New("there is no service providers for " + c.Service.Name)
+			return nil, nil, fmt.Errorf("%w for %s", ErrNoServiceProviders, c.Service.Name)
+		}
+		if subscribersCount < c.MinSubscribers {
+			return nil, nil, fmt.Errorf("%w: %d available, %d required", ErrInsufficientServers, subscribersCount, c.MinSubscribers)
 		}
 
-		offset := rand.Intn((subscribersCount-1)/c.GetSubscribersBatchSize + 1)
-		subscribers, err := c.Wallet.GetSubscribersContext(ctx, topic, offset*c.GetSubscribersBatchSize, c.GetSubscribersBatchSize, true, false)
+		offset := c.randIntn((subscribersCount-1)/c.GetSubscribersBatchSize + 1)
+		subscriberRaw, err = c.getSubscribersContext(ctx, topic, offset*c.GetSubscribersBatchSize, c.GetSubscribersBatchSize)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		subscriberRaw = subscribers.Subscribers.Map
-
 		allSubscribers = make([]string, 0, len(subscriberRaw))
 		if c.measureStorage != nil {
 			nodes := c.measureStorage.FavoriteNodes.GetData()
@@ -718,17 +1800,25 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 		for subscriber := range subscriberRaw {
 			allSubscribers = append(allSubscribers, subscriber)
 		}
+		if c.SelectionRand != nil {
+			// map order is random and should not affect selection
+			sort.Strings(allSubscribers)
+		}
 	}
 
 	return allSubscribers, subscriberRaw, nil
 }
 
-func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[string]string) types.Nodes {
-	entryToExitMaxPrice, exitToEntryMaxPrice, err := ParsePrice(c.ServiceInfo.MaxPrice)
+// filterSubscribers returns subscribers that pass price, nkn and ip filters.
+// ErrPriceTooHigh is returned if no subscriber passes and some of them are
+// rejected because of price.
+func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[string]string) (types.Nodes, error) {
+	maxPrice, err := ParsePrice(c.ServiceInfo.MaxPrice)
 	if err != nil {
-		log.Fatalf("Parse price of service error: %v", err)
+		return nil, fmt.Errorf("parse max price of service %s: %w", c.Service.Name, err)
 	}
 	filterSubs := make(types.Nodes, 0, len(allSubscribers))
+	priceTooHighCount := 0
 
 	var nodes []*net.IPNet
 	if c.measureStorage != nil {
@@ -737,21 +1827,69 @@ func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[st
 
 	for _, subscriber := range allSubscribers {
 		metadataString := subscriberRaw[subscriber]
-		metadata, err := ReadMetadata(metadataString)
+		metadata, err := c.readMetadata(metadataString)
 		if err != nil {
 			log.Println("Couldn't unmarshal metadata:", err)
+			if errors.Is(err, ErrUnsupportedMetadataVersion) {
+				c.subscriberRejected(subscriber, "incompatible metadata version")
+			} else if errors.Is(err, ErrMetadataTooLarge) {
+				c.subscriberRejected(subscriber, "metadata too large")
+			} else {
+				c.subscriberRejected(subscriber, "invalid metadata")
+			}
 			continue
 		}
-		entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+		price, err := parseMetadataPrice(metadata)
 		if err != nil {
 			log.Println(err)
+			c.subscriberRejected(subscriber, "invalid price")
+			continue
+		}
+		if price.Exceeds(maxPrice) {
+			if subscriber == c.GetRemoteNknAddress() {
+				log.Printf("Exit %s raised price to %s above max price %s, dropped", subscriber, price, maxPrice)
+				c.subscriberRejected(subscriber, "price raised")
+			} else {
+				c.subscriberRejected(subscriber, "price too high")
+			}
+			priceTooHighCount++
+			continue
+		}
+
+		// a server without UDP (or TCP) port is useless if service needs it,
+		// which would otherwise only be found when forwarding fails
+		if (c.needTCP() && metadata.TcpPort == 0) || (c.needUDP() && metadata.UdpPort == 0) {
+			c.subscriberRejected(subscriber, "protocol not supported")
+			continue
+		}
+
+		if c.useQUIC() && metadata.QuicPort == 0 {
+			c.subscriberRejected(subscriber, "quic not supported")
+			continue
+		}
+
+		if !matchTags(metadata.Tags, c.RequiredTags, c.ExcludedTags) {
+			c.subscriberRejected(subscriber, "tags mismatch")
 			continue
 		}
-		if entryToExitPrice > entryToExitMaxPrice || exitToEntryPrice > exitToEntryMaxPrice {
+
+		if c.isServerBlocked(subscriber) {
+			c.subscriberRejected(subscriber, "recently failed")
+			continue
+		}
+
+		if c.isServerSkipped(subscriber) {
+			c.subscriberRejected(subscriber, "reconnecting")
+			continue
+		}
+
+		if !c.AllowSelfConnect && c.isSelf(subscriber) {
+			c.subscriberRejected(subscriber, "self connection")
 			continue
 		}
 
 		if !c.ServiceInfo.NknFilter.IsAllow(&filter.NknClient{Address: subscriber}) {
+			c.subscriberRejected(subscriber, "disallowed by nkn filter")
 			continue
 		}
 
@@ -760,16 +1898,13 @@ func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[st
 			log.Println(err)
 		}
 		if !res {
+			c.subscriberRejected(subscriber, "disallowed by ip filter")
 			continue
 		}
 
-		if c.measureStorage != nil { // disallow avoid nodes
-			for _, ip := range nodes {
-				if ip.Contains(net.ParseIP(metadata.Ip)) {
-					log.Printf("disallow avoid subnet: %s, ip: %s", ip.String(), metadata.Ip)
-					continue
-				}
-			}
+		if c.measureStorage != nil && isAvoided(nodes, metadata.Ip) { // disallow avoid nodes
+			c.subscriberRejected(subscriber, "in avoided subnet")
+			continue
 		}
 
 		filterSubs = append(filterSubs, &types.Node{
@@ -779,7 +1914,46 @@ func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[st
 		})
 	}
 
-	return filterSubs
+	if len(filterSubs) == 0 && priceTooHighCount > 0 {
+		return nil, fmt.Errorf("%w: %d service providers of %s exceed max price %s", ErrPriceTooHigh, priceTooHighCount, c.Service.Name, c.ServiceInfo.MaxPrice)
+	}
+
+	return filterSubs, nil
+}
+
+// matchTags returns whether tags contain all of requiredTags and none of
+// excludedTags. A tag matches if both key and value are equal.
+func matchTags(tags, requiredTags, excludedTags map[string]string) bool {
+	for k, v := range requiredTags {
+		if tag, ok := tags[k]; !ok || tag != v {
+			return false
+		}
+	}
+	for k, v := range excludedTags {
+		if tag, ok := tags[k]; ok && tag == v {
+			return false
+		}
+	}
+	return true
+}
+
+// isSelf returns whether subscriber has the same public key as local wallet.
+func (c *Common) isSelf(subscriber string) bool {
+	pubKey, err := nkn.ClientAddrToPubKey(subscriber)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(pubKey, c.Wallet.PubKey())
+}
+
+func isAvoided(avoidCIDR []*net.IPNet, ip string) bool {
+	for _, subnet := range avoidCIDR {
+		if subnet.Contains(net.ParseIP(ip)) {
+			log.Printf("disallow avoid subnet: %s, ip: %s", subnet.String(), ip)
+			return true
+		}
+	}
+	return false
 }
 
 func measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, numResults int, timeout time.Duration) types.Nodes {
@@ -793,7 +1967,7 @@ func measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, num
 		func(node *types.Node) {
 			wg.Add(1)
 			tunaUtil.Enqueue(measurementDelayJobChan, func() {
-				addr := node.Metadata.Ip + ":" + strconv.Itoa(int(node.Metadata.TcpPort))
+				addr := net.JoinHostPort(node.Metadata.Ip, strconv.Itoa(int(node.Metadata.TcpPort)))
 				delay, err := tunaUtil.DelayMeasurementContext(ctx, tcp, addr, timeout)
 				if err != nil {
 					if _, ok := err.(net.Error); !ok {
@@ -848,7 +2022,7 @@ func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int,
 			}
 
 			d := net.Dialer{Timeout: defaultMeasureDelayTimeout}
-			addr := sub.Metadata.Ip + ":" + strconv.Itoa(int(sub.Metadata.TcpPort))
+			addr := net.JoinHostPort(sub.Metadata.Ip, strconv.Itoa(int(sub.Metadata.TcpPort)))
 			conn, err := d.DialContext(ctx, tcp, addr)
 			if err != nil {
 				if _, ok := err.(net.Error); !ok {
@@ -862,7 +2036,7 @@ func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int,
 				conn.SetDeadline(time.Now())
 			}()
 
-			encryptedConn, _, err := c.wrapConn(conn, remotePublicKey, &pb.ConnectionMetadata{
+			encryptedConn, remoteConnMetadata, err := c.wrapConn(conn, remotePublicKey, &pb.ConnectionMetadata{
 				IsMeasurement:            true,
 				MeasurementBytesDownlink: uint32(c.MeasurementBytesDownLink),
 			})
@@ -877,6 +2051,18 @@ func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int,
 			}
 			defer encryptedConn.Close()
 
+			if remoteConnMetadata.EntryAuth {
+				err = requestEntryAuth(encryptedConn, c.Wallet, remoteConnMetadata.Nonce)
+				if err != nil {
+					select {
+					case <-ctx.Done():
+					default:
+						log.Println(err)
+					}
+					return
+				}
+			}
+
 			timeStart := time.Now()
 			min, max, err := tunaUtil.BandwidthMeasurementClientContext(ctx, encryptedConn, int(c.MeasurementBytesDownLink), c.MeasureBandwidthTimeout)
 			dur := time.Since(timeStart)
@@ -953,66 +2139,116 @@ func (c *Common) startPayment(
 	nanoPayFee string,
 	getPaymentStream func() (*smux.Stream, error),
 ) {
-	var np *nkn.NanoPay
+	var pc *trackedChannel
 	var bytesEntryToExit, bytesExitToEntry uint64
 	var cost, lastCost common.Fixed64
 	entryToExitPrice, exitToEntryPrice := c.GetPrice()
+	price := Price{EntryToExit: entryToExitPrice, ExitToEntry: exitToEntryPrice, Unit: c.GetPriceUnit()}
 	lastPaymentTime := time.Now()
 
+	defer func() {
+		if pc != nil {
+			c.removePaymentChannel(pc)
+		}
+	}()
+
 	for {
+		settle := false
 		for {
 			time.Sleep(100 * time.Millisecond)
-			if c.isClosed {
+			c.RLock()
+			isClosed := c.isClosed
+			c.RUnlock()
+			if isClosed {
 				return
 			}
+			if pc != nil && pc.isCloseRequested() {
+				settle = true
+				break
+			}
 			bytesEntryToExit = atomic.LoadUint64(bytesEntryToExitUsed)
 			bytesExitToEntry = atomic.LoadUint64(bytesExitToEntryUsed)
 			if (bytesEntryToExit+bytesExitToEntry)-(*bytesEntryToExitPaid+*bytesExitToEntryPaid) > trafficPaymentThreshold*TrafficUnit {
 				break
 			}
-			if time.Since(lastPaymentTime) > defaultNanoPayUpdateInterval {
+			if time.Since(lastPaymentTime) > c.NanoPayUpdateInterval {
 				break
 			}
 		}
 
 		bytesEntryToExit = atomic.LoadUint64(bytesEntryToExitUsed)
 		bytesExitToEntry = atomic.LoadUint64(bytesExitToEntryUsed)
-		cost = entryToExitPrice*common.Fixed64(bytesEntryToExit-*bytesEntryToExitPaid)/TrafficUnit + exitToEntryPrice*common.Fixed64(bytesExitToEntry-*bytesExitToEntryPaid)/TrafficUnit
-		if cost == lastCost || cost <= common.Fixed64(0) {
-			continue
+		cost = price.Cost(bytesEntryToExit-*bytesEntryToExitPaid, bytesExitToEntry-*bytesExitToEntryPaid)
+		if settle && cost <= common.Fixed64(0) {
+			return
 		}
-		costTimeStamp := time.Now()
-
-		paymentStream, err := getPaymentStream()
-		if err != nil {
-			log.Printf("Get payment stream err: %v", err)
+		if !settle && (cost == lastCost || cost <= common.Fixed64(0)) {
 			continue
 		}
+		costTimeStamp := time.Now()
 
 		paymentReceiver := c.GetPaymentReceiver()
-		if np == nil || np.Recipient() != paymentReceiver {
-			np, err = c.Wallet.NewNanoPay(paymentReceiver, nanoPayFee, defaultNanoPayDuration)
+		if pc == nil || pc.Recipient() != paymentReceiver {
+			if settle {
+				return
+			}
+			if pc != nil {
+				c.removePaymentChannel(pc)
+				pc = nil
+			}
+			channel, err := c.PaymentScheme.OpenChannel(paymentReceiver, nanoPayFee)
 			if err != nil {
-				log.Printf("Create nanopay err: %v", err)
+				log.Printf("Create payment channel err: %v", err)
 				continue
 			}
+			if channel == nil {
+				return
+			}
+			pc = c.addPaymentChannel(channel)
+		}
+
+		if c.MaxTotalSpend > 0 {
+			totalSpend := common.Fixed64(atomic.LoadInt64(&c.paymentSent))
+			if totalSpend+cost > c.MaxTotalSpend {
+				log.Printf("Stop payment: %v, spent %s, max %s", ErrSpendLimitReached, totalSpend.String(), c.MaxTotalSpend.String())
+				c.spendLimitHit(totalSpend)
+				return
+			}
+		}
+
+		paymentStream, err := getPaymentStream()
+		if err != nil {
+			log.Printf("Get payment stream err: %v", err)
+			if settle {
+				return
+			}
+			continue
 		}
 
-		err = sendNanoPay(np, paymentStream, cost)
+		err = sendPayment(pc, paymentStream, cost)
 		if err != nil {
-			log.Printf("Send nanopay err: %v", err)
+			log.Printf("Send payment err: %v", err)
 			return
 		}
-		log.Printf("send nanopay success: %s", cost.String())
+		log.Printf("send payment success: %s", cost.String())
+		atomic.AddInt64(&c.paymentSent, int64(cost))
+		pc.addPaid(cost)
+		c.paymentMade(paymentReceiver, cost, bytesEntryToExit+bytesExitToEntry)
 
 		*bytesEntryToExitPaid = bytesEntryToExit
 		*bytesExitToEntryPaid = bytesExitToEntry
 		lastCost = cost
 		lastPaymentTime = costTimeStamp
+
+		if settle {
+			return
+		}
 	}
 }
 
-func (c *Common) pipe(dest io.WriteCloser, src io.ReadCloser, written *uint64) {
+// pipe copies src to dest until src reaches EOF or an error occurs, then
+// closes both. It returns nil on EOF, or the error that stopped copying.
+func (c *Common) pipe(dest io.WriteCloser, src io.ReadCloser, written *uint64) error {
 	c.sessionsWaitGroup.Add(1)
 
 	c.Lock()
@@ -1030,7 +2266,102 @@ func (c *Common) pipe(dest io.WriteCloser, src io.ReadCloser, written *uint64) {
 		c.sessionsWaitGroup.Done()
 	}()
 
-	copyBuffer(dest, src, written)
+	return copyBuffer(dest, src, written, c.WriteTimeout)
+}
+
+// pipeStream pipes data between stream and conn in both directions. Bytes
+// written to and read from stream are added to toStream and fromStream. If
+// compress is true, stream data is compressed and the counters reflect
+// compressed bytes on wire. The stream slots acquired from limiters, if not
+// nil, are released when piping ends.
+func (c *Common) pipeStream(stream io.ReadWriteCloser, conn io.ReadWriteCloser, compress bool, toStream, fromStream *uint64, limiters ...*streamLimiter) error {
+	var id string
+	var bytesReceived, bytesSent uint64
+	if c.OnStreamOpen != nil || c.OnStreamClose != nil {
+		id = c.streamID(stream)
+		// counted on conn side so that bytes are not affected by compression:
+		// data read from conn is sent through the tunnel, and data written to
+		// conn has been received from it
+		conn = newCountingStream(conn, &bytesSent, &bytesReceived)
+		if c.OnStreamOpen != nil {
+			c.OnStreamOpen(id)
+		}
+	}
+
+	var rw io.ReadWriteCloser = stream
+	if compress {
+		cs, err := newCompressedStream(newCountingStream(stream, fromStream, toStream))
+		if err != nil {
+			if c.OnStreamClose != nil {
+				c.OnStreamClose(id, 0, 0, err)
+			}
+			return err
+		}
+		rw = cs
+		toStream, fromStream = nil, nil
+	}
+
+	atomic.AddInt32(&c.activeStreams, 1)
+	var releaseOnce sync.Once
+	var pipeErr error
+	release := func(err error) {
+		releaseOnce.Do(func() {
+			// the other direction will fail because of closing, so the first
+			// result is the one that terminated the stream
+			pipeErr = err
+			atomic.AddInt32(&c.activeStreams, -1)
+			for _, limiter := range limiters {
+				if limiter != nil {
+					limiter.release()
+				}
+			}
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		release(c.pipe(rw, conn, toStream))
+	}()
+	go func() {
+		defer wg.Done()
+		release(c.pipe(conn, rw, fromStream))
+	}()
+	go func() {
+		wg.Wait()
+		c.streamEnded(pipeErr)
+		if c.OnStreamClose != nil {
+			c.OnStreamClose(id, atomic.LoadUint64(&bytesReceived), atomic.LoadUint64(&bytesSent), pipeErr)
+		}
+	}()
+
+	return nil
+}
+
+// streamLimiter limits the number of concurrent streams. Max <= 0 means no
+// limit.
+type streamLimiter struct {
+	max   int32
+	count int32
+}
+
+func newStreamLimiter(max int32) *streamLimiter {
+	return &streamLimiter{max: max}
+}
+
+// acquire reserves a stream slot and returns false if limit is reached.
+func (l *streamLimiter) acquire() bool {
+	count := atomic.AddInt32(&l.count, 1)
+	if l.max > 0 && count > l.max {
+		atomic.AddInt32(&l.count, -1)
+		return false
+	}
+	return true
+}
+
+func (l *streamLimiter) release() {
+	atomic.AddInt32(&l.count, -1)
 }
 
 func (c *Common) GetNumActiveSessions() int {
@@ -1083,16 +2414,52 @@ func (c *Common) WaitSessions() {
 func ReadMetadata(metadataString string) (*pb.ServiceMetadata, error) {
 	metadataRaw, err := base64.StdEncoding.DecodeString(metadataString)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
 	}
 	metadata := &pb.ServiceMetadata{}
 	err = proto.Unmarshal(metadataRaw, metadata)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	if metadata.Version > ServiceMetadataVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedMetadataVersion, metadata.Version)
 	}
 	return metadata, nil
 }
 
+// readMetadata is like ReadMetadata but rejects metadata larger than
+// MaxMetadataSize before decoding it.
+func (c *Common) readMetadata(metadataString string) (*pb.ServiceMetadata, error) {
+	if c.MaxMetadataSize > 0 && len(metadataString) > c.MaxMetadataSize {
+		return nil, fmt.Errorf("%w: %d bytes, max %d bytes", ErrMetadataTooLarge, len(metadataString), c.MaxMetadataSize)
+	}
+	return ReadMetadata(metadataString)
+}
+
+// ReadMetadataFromStream reads a length prefixed service metadata from r and
+// decodes it. Metadata larger than default max size is rejected.
+func ReadMetadataFromStream(r io.Reader) (*pb.ServiceMetadata, error) {
+	return readMetadataFromStream(r, defaultMaxMetadataSize)
+}
+
+func (c *Common) readMetadataFromStream(r io.Reader) (*pb.ServiceMetadata, error) {
+	return readMetadataFromStream(r, c.MaxMetadataSize)
+}
+
+func readMetadataFromStream(r io.Reader, maxSize int) (*pb.ServiceMetadata, error) {
+	buf, err := ReadVarBytes(r, uint32(maxSize))
+	if err != nil {
+		if errors.Is(err, errMsgTooLarge) {
+			return nil, fmt.Errorf("%w: %v", ErrMetadataTooLarge, err)
+		}
+		return nil, err
+	}
+	return ReadMetadata(string(buf))
+}
+
+// CreateRawMetadata encodes service metadata as subscription meta. It's
+// protobuf (fields with default value take no space) encoded in base64, since
+// subscription meta has to be a valid string.
 func CreateRawMetadata(
 	serviceID byte,
 	serviceTCP []uint32,
@@ -1100,26 +2467,92 @@ func CreateRawMetadata(
 	ip string,
 	tcpPort uint32,
 	udpPort uint32,
+	quicPort uint32,
 	price string,
 	beneficiaryAddr string,
+	tags map[string]string,
 ) []byte {
 	metadata := &pb.ServiceMetadata{
 		Ip:              ip,
 		TcpPort:         tcpPort,
 		UdpPort:         udpPort,
+		QuicPort:        quicPort,
 		ServiceId:       uint32(serviceID),
 		ServiceTcp:      serviceTCP,
 		ServiceUdp:      serviceUDP,
 		Price:           price,
 		BeneficiaryAddr: beneficiaryAddr,
+		Version:         ServiceMetadataVersion,
+		Tags:            tags,
+	}
+	// Price string keeps its unit suffix so that peers unaware of PriceUnit
+	// reject it instead of charging per MB.
+	if p, err := ParsePrice(price); err == nil && p.Unit > 0 {
+		metadata.PriceUnit = p.Unit
 	}
-	metadataRaw, err := proto.Marshal(metadata)
+	// Deterministic so that the same metadata with tags is encoded to the same
+	// subscription meta.
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	err := buf.Marshal(metadata)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	metadataRaw := buf.Bytes()
 	return []byte(base64.StdEncoding.EncodeToString(metadataRaw))
 }
 
+// subscribeJitter randomly shortens the wait d before next subscription by up
+// to subscribeDurationRandomFactor, so that exits started together do not
+// re-subscribe in lockstep. The wait is never extended to avoid subscription
+// expiring before renewal.
+func subscribeJitter(d time.Duration) time.Duration {
+	return time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * float64(d))
+}
+
+// BuildMetadata returns the raw metadata and topic that UpdateMetadata would
+// subscribe with, or error if they are invalid. It does not subscribe, so it
+// can be used to verify config before paying subscription fee.
+func BuildMetadata(
+	serviceName string,
+	serviceID byte,
+	serviceTCP []uint32,
+	serviceUDP []uint32,
+	ip string,
+	tcpPort uint32,
+	udpPort uint32,
+	quicPort uint32,
+	price string,
+	beneficiaryAddr string,
+	tags map[string]string,
+	subscriptionPrefix string,
+) ([]byte, string, error) {
+	if len(serviceName) == 0 {
+		return nil, "", errors.New("service name is empty")
+	}
+	if len(ip) == 0 {
+		return nil, "", errors.New("ip is empty")
+	}
+	if _, err := ParsePrice(price); err != nil {
+		return nil, "", fmt.Errorf("invalid price %s: %v", price, err)
+	}
+	if len(beneficiaryAddr) > 0 {
+		if err := nkn.VerifyWalletAddress(beneficiaryAddr); err != nil {
+			return nil, "", fmt.Errorf("invalid beneficiary address %s: %v", beneficiaryAddr, err)
+		}
+	}
+
+	metadataRaw := CreateRawMetadata(serviceID, serviceTCP, serviceUDP, ip, tcpPort, udpPort, quicPort, price, beneficiaryAddr, tags)
+	if _, err := ReadMetadata(string(metadataRaw)); err != nil {
+		return nil, "", err
+	}
+
+	return metadataRaw, subscriptionPrefix + serviceName, nil
+}
+
+// UpdateMetadata subscribes to topic subscriptionPrefix + serviceName with the
+// given service metadata and keeps renewing the subscription until closeChan is
+// closed or the returned stop function is called.
 func UpdateMetadata(
 	serviceName string,
 	serviceID byte,
@@ -1128,15 +2561,18 @@ func UpdateMetadata(
 	ip string,
 	tcpPort uint32,
 	udpPort uint32,
+	quicPort uint32,
 	price string,
 	beneficiaryAddr string,
+	tags map[string]string,
 	subscriptionPrefix string,
 	subscriptionDuration uint32,
 	subscriptionFee string,
+	maxSubscribesPerDay int32,
 	wallet *nkn.Wallet,
 	closeChan chan struct{},
-) {
-	metadataRaw := CreateRawMetadata(serviceID, serviceTCP, serviceUDP, ip, tcpPort, udpPort, price, beneficiaryAddr)
+) func() {
+	metadataRaw := CreateRawMetadata(serviceID, serviceTCP, serviceUDP, ip, tcpPort, udpPort, quicPort, price, beneficiaryAddr, tags)
 	topic := subscriptionPrefix + serviceName
 	identifier := ""
 	subInterval := config.ConsensusDuration
@@ -1144,6 +2580,23 @@ func UpdateMetadata(
 		subInterval = time.Duration(subscriptionDuration-3) * config.ConsensusDuration
 	}
 	nextSub := time.After(0)
+	stopChan := make(chan struct{})
+	var stopOnce sync.Once
+	limiter := newSubscribeLimiter(int(maxSubscribesPerDay))
+	backoff := tunaUtil.NewBackoff(resubscribeIntervalMin, subInterval)
+	stop := func() {
+		stopOnce.Do(func() {
+			close(stopChan)
+		})
+	}
+
+	if len(subscriptionFee) > 0 {
+		if _, err := common.StringToFixed64(subscriptionFee); err != nil {
+			// every subscribe would fail the same way
+			log.Printf("WARNING: invalid subscription fee %q for topic %s: %v, not subscribing", subscriptionFee, topic, err)
+			return stop
+		}
+	}
 
 	go func() {
 		func() {
@@ -1176,7 +2629,7 @@ func UpdateMetadata(
 			log.Println("Existing subscription expires after", sub.ExpiresAt-height, "blocks")
 
 			maxSubDuration := float64(sub.ExpiresAt-height) * float64(config.ConsensusDuration)
-			nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * maxSubDuration))
+			nextSub = time.After(subscribeJitter(time.Duration(maxSubDuration)))
 		}()
 
 		for {
@@ -1184,25 +2637,72 @@ func UpdateMetadata(
 			case <-nextSub:
 			case <-closeChan:
 				return
+			case <-stopChan:
+				return
+			}
+			result := make(chan error, 1)
+			addToSubscribeQueue(&subscribeData{
+				wallet:     wallet,
+				identifier: identifier,
+				topic:      topic,
+				duration:   int(subscriptionDuration),
+				meta:       string(metadataRaw),
+				config:     &nkn.TransactionConfig{Fee: subscriptionFee},
+				limiter:    limiter,
+				result:     result,
+			})
+			var err error
+			select {
+			case err = <-result:
+			case <-closeChan:
+				return
+			case <-stopChan:
+				return
+			}
+			if err != nil {
+				retryInterval := backoff.Next()
+				if errors.Is(err, ErrSubscriptionFeeTooLow) {
+					log.Printf("WARNING: subscription fee %q for topic %s is too low to be accepted by the network, please increase subscription fee in config. Retry after %v", subscriptionFee, topic, retryInterval)
+				}
+				log.Printf("Subscribe to topic %s failed, retry after %v", topic, retryInterval)
+				nextSub = time.After(retryInterval)
+				continue
 			}
-			addToSubscribeQueue(wallet, identifier, topic, int(subscriptionDuration), string(metadataRaw), &nkn.TransactionConfig{Fee: subscriptionFee})
-			nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * float64(subInterval)))
+			backoff.Reset()
+			nextSub = time.After(subscribeJitter(subInterval))
 		}
 	}()
+
+	return stop
 }
 
-func copyBuffer(dest io.Writer, src io.Reader, written *uint64) error {
+// copyBuffer copies src to dest until src reaches EOF. If writeTimeout is
+// positive and dest has SetWriteDeadline (e.g. net.Conn or smux stream), a
+// write blocked for longer than writeTimeout because the consumer stopped
+// reading aborts copying. Writes to other writers, e.g. compressed streams,
+// are not limited.
+func copyBuffer(dest io.Writer, src io.Reader, written *uint64, writeTimeout time.Duration) error {
+	var deadliner interface{ SetWriteDeadline(time.Time) error }
+	if writeTimeout > 0 {
+		deadliner, _ = dest.(interface{ SetWriteDeadline(time.Time) error })
+	}
+	if written != nil {
+		dest = NewCountingWriter(dest, written)
+	}
 	buf := make([]byte, pipeBufferSize)
 	for {
 		nr, err := src.Read(buf)
 		if nr > 0 {
-			nw, err := dest.Write(buf[0:nr])
-			if nw > 0 {
-				if written != nil {
-					atomic.AddUint64(written, uint64(nw))
+			if deadliner != nil {
+				if err := deadliner.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+					return err
 				}
 			}
+			nw, err := dest.Write(buf[0:nr])
 			if err != nil {
+				if deadliner != nil && isTimeoutErr(err) {
+					return fmt.Errorf("write stalled for %v: %w", writeTimeout, err)
+				}
 				return err
 			}
 			if nr != nw {
@@ -1218,24 +2718,41 @@ func copyBuffer(dest io.Writer, src io.Reader, written *uint64) error {
 	}
 }
 
+func isTimeoutErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Close closes conn and logs the error if any. It does nothing if conn is nil.
 func Close(conn io.Closer) {
-	if conn == nil || reflect.ValueOf(conn).IsNil() {
-		return
-	}
-	err := conn.Close()
+	err := CloseErr(conn)
 	if err != nil {
 		log.Println("Error while closing:", err)
 	}
 }
 
+// CloseErr closes conn and returns the error. It returns nil if conn is nil or
+// a typed nil.
+func CloseErr(conn io.Closer) error {
+	if conn == nil || reflect.ValueOf(conn).IsNil() {
+		return nil
+	}
+	return conn.Close()
+}
+
 func PortToConnID(port uint16) []byte {
-	b := make([]byte, 2)
+	b := make([]byte, connIDSize)
 	binary.LittleEndian.PutUint16(b, port)
 	return b
 }
 
-func ConnIDToPort(data []byte) uint16 {
-	return binary.LittleEndian.Uint16(data)
+// ConnIDToPort decodes the port encoded by PortToConnID from the first two
+// bytes of data.
+func ConnIDToPort(data []byte) (uint16, error) {
+	if len(data) < connIDSize {
+		return 0, fmt.Errorf("conn id should be at least %d bytes, got %d", connIDSize, len(data))
+	}
+	return binary.LittleEndian.Uint16(data), nil
 }
 
 func LoadPassword(path string) (string, error) {
@@ -1297,28 +2814,13 @@ func openPaymentStream(session *smux.Session) (*smux.Stream, error) {
 	return stream, nil
 }
 
-func sendNanoPay(np *nkn.NanoPay, paymentStream *smux.Stream, cost common.Fixed64) error {
-	var tx *transaction.Transaction
-	var err error
-	for i := 0; i < 3; i++ {
-		if i > 0 {
-			time.Sleep(1 * time.Second)
-		}
-		tx, err = np.IncrementAmount(cost.String())
-		if err == nil {
-			break
-		}
-	}
-	if err != nil || tx == nil || tx.GetSize() == 0 {
-		return fmt.Errorf("send nanopay tx failed: %v", err)
-	}
-
-	txBytes, err := tx.Marshal()
+func sendPayment(pc PaymentChannel, paymentStream *smux.Stream, cost common.Fixed64) error {
+	data, err := pc.Pay(cost)
 	if err != nil {
 		return err
 	}
 
-	err = WriteVarBytes(paymentStream, txBytes)
+	err = WriteVarBytes(paymentStream, data)
 	if err != nil {
 		return err
 	}
@@ -1326,70 +2828,64 @@ func sendNanoPay(np *nkn.NanoPay, paymentStream *smux.Stream, cost common.Fixed6
 	return nil
 }
 
-func nanoPayClaim(txBytes []byte, npc *nkn.NanoPayClaimer) (*nkn.Amount, error) {
-	if len(txBytes) == 0 {
-		return nil, errors.New("empty txn bytes")
-	}
-
-	tx := &transaction.Transaction{}
-	if err := tx.Unmarshal(txBytes); err != nil {
-		return nil, fmt.Errorf("couldn't unmarshal payment stream data: %v", err)
-	}
-
-	if tx.UnsignedTx == nil {
-		return nil, errors.New("nil txn body")
-	}
-
-	return npc.Claim(tx)
-}
-
-func checkNanoPayClaim(session *smux.Session, npc *nkn.NanoPayClaimer, onErr *nkn.OnError, isClosed *bool) {
+func checkPaymentClaim(session *smux.Session, npc PaymentClaimer, onErr *nkn.OnError, sessionClosed <-chan struct{}) {
 	for {
-		err, ok := <-onErr.C
+		var err error
+		var ok bool
+		select {
+		case err, ok = <-onErr.C:
+		case <-sessionClosed:
+			return
+		}
 		if !ok {
 			break
 		}
 		if err != nil {
-			log.Println("Couldn't claim nano pay:", err)
+			log.Println("Couldn't claim payment:", err)
 			if npc.IsClosed() {
 				Close(session)
-				*isClosed = true
 				break
 			}
 		}
 	}
 }
 
-func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, isClosed *bool, getTotalCost func() (common.Fixed64, common.Fixed64)) {
+func checkPayment(session *smux.Session, updateInterval time.Duration, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, sessionClosed <-chan struct{}, getTotalCost func() (common.Fixed64, common.Fixed64)) {
 	var totalCost, totalBytes, totalCostDelayed, totalBytesDelayed common.Fixed64
+	var delayedLock sync.Mutex
 
 	go func() {
 		for {
-			time.Sleep(time.Second)
-			if *isClosed {
+			select {
+			case <-time.After(time.Second):
+			case <-sessionClosed:
 				return
 			}
 			totalCostNow, totalBytesNow := getTotalCost()
 			time.AfterFunc(trafficDelay, func() {
+				delayedLock.Lock()
 				totalCostDelayed, totalBytesDelayed = totalCostNow, totalBytesNow
+				delayedLock.Unlock()
 			})
 		}
 	}()
 
 	for {
 		for {
-			time.Sleep(100 * time.Millisecond)
-
-			if *isClosed {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-sessionClosed:
 				return
 			}
 
+			delayedLock.Lock()
 			totalCost, totalBytes = totalCostDelayed, totalBytesDelayed
+			delayedLock.Unlock()
 			if totalCost <= *lastPaymentAmount {
 				continue
 			}
 
-			if time.Since(*lastPaymentTime) > defaultNanoPayUpdateInterval {
+			if time.Since(*lastPaymentTime) > updateInterval {
 				break
 			}
 
@@ -1402,14 +2898,17 @@ func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPayment
 
 		if *lastPaymentAmount < common.Fixed64(minTrafficCoverage*float64(totalCost)) && totalCost-*lastPaymentAmount > common.Fixed64(maxTrafficUnpaid*TrafficUnit*float64(totalCost)/float64(totalBytes)) {
 			Close(session)
-			*isClosed = true
 			log.Printf("Not enough payment. Since last payment: %s. Last claimed: %v, expected: %v", time.Since(*lastPaymentTime).String(), *lastPaymentAmount, totalCost)
 			return
 		}
 	}
 }
 
-func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, getTotalCost func() (common.Fixed64, common.Fixed64)) error {
+func handlePaymentStream(stream *smux.Stream, npc PaymentClaimer, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, getTotalCost func() (common.Fixed64, common.Fixed64)) error {
+	if npc == nil {
+		return errors.New("payment is not required")
+	}
+
 	for {
 		tx, err := ReadVarBytes(stream, maxNanoPayTxnSize)
 		if err != nil {
@@ -1418,27 +2917,27 @@ func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPayme
 
 		_, totalBytes := getTotalCost()
 
-		var amount *nkn.Amount
+		var amount common.Fixed64
 		for i := 0; i < 3; i++ {
 			if i > 0 {
 				time.Sleep(3 * time.Second)
 			}
-			amount, err = nanoPayClaim(tx, npc)
+			amount, err = npc.Claim(tx)
 			if err == nil {
 				break
 			} else {
-				log.Printf("could't claim nanoPay: %v", err)
+				log.Printf("could't claim payment: %v", err)
 			}
 		}
-		if err != nil || amount == nil {
+		if err != nil {
 			if npc.IsClosed() {
-				log.Printf("nanopayclaimer closed: %v", err)
+				log.Printf("payment claimer closed: %v", err)
 				return nil
 			}
 			continue
 		}
 
-		*lastPaymentAmount = amount.ToFixed64()
+		*lastPaymentAmount = amount
 		*lastPaymentTime = time.Now()
 		*bytesPaid = totalBytes
 	}
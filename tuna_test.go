@@ -0,0 +1,197 @@
+package tuna
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCopyBufferWriteTimeout(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		reader, writer := net.Pipe()
+		// reader never reads, so that every write stalls
+		var dest io.Writer = writer
+		if wrap {
+			dest = newCountingStream(writer, nil, nil)
+		}
+
+		writeTimeout := 50 * time.Millisecond
+		start := time.Now()
+		err := copyBuffer(dest, strings.NewReader("stalled"), nil, writeTimeout)
+		elapsed := time.Since(start)
+		reader.Close()
+		writer.Close()
+
+		if !isTimeoutErr(err) {
+			t.Fatalf("expect timeout error with wrap %v, got %v", wrap, err)
+		}
+		if elapsed < writeTimeout || elapsed > time.Second {
+			t.Fatalf("expect copy to stop after %v with wrap %v, took %v", writeTimeout, wrap, elapsed)
+		}
+	}
+}
+
+func TestSendDatagramDropOldest(t *testing.T) {
+	c := make(chan []byte, 2)
+	for _, data := range []string{"1", "2", "3"} {
+		if !sendDatagram(c, []byte(data), nil) {
+			t.Fatal("expect send to buffered channel not to block")
+		}
+	}
+	for _, expect := range []string{"2", "3"} {
+		if data := <-c; string(data) != expect {
+			t.Fatalf("expect %s after oldest datagram is dropped, got %s", expect, data)
+		}
+	}
+}
+
+func TestSendDatagramUnbufferedBlocks(t *testing.T) {
+	c := make(chan []byte)
+	closeChan := make(chan struct{})
+	sent := make(chan bool, 1)
+	go func() {
+		sent <- sendDatagram(c, []byte("1"), closeChan)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expect send to block without receiver")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if data := <-c; string(data) != "1" {
+		t.Fatalf("expect datagram to be received, got %s", data)
+	}
+	if !<-sent {
+		t.Fatal("expect send to succeed once received")
+	}
+
+	go func() {
+		sent <- sendDatagram(c, []byte("2"), closeChan)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expect send to block without receiver")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(closeChan)
+	select {
+	case ok := <-sent:
+		if ok {
+			t.Fatal("expect send to fail when closeChan is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect send to stop when closeChan is closed")
+	}
+}
+
+func TestUDPReaderWriterStopsOnClose(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &Common{
+		closeChan:    make(chan struct{}),
+		udpReadChan:  make(chan []byte),
+		udpWriteChan: make(chan []byte),
+	}
+	close(c.closeChan)
+	c.StartUDPReaderWriter(conn)
+
+	// reader stops when it can't deliver the datagram after c is closed,
+	// which should stop writer as well although conn is still open
+	if _, err := server.WriteToUDP([]byte("data"), conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case c.udpWriteChan <- []byte("data"):
+		case <-time.After(50 * time.Millisecond):
+			return
+		case <-deadline:
+			t.Fatal("expect UDP writer to stop when reader stops")
+		}
+	}
+}
+
+func TestPipeStreamHooks(t *testing.T) {
+	type closed struct {
+		id                string
+		bytesIn, bytesOut uint64
+	}
+	for _, compress := range []bool{false, true} {
+		opened := make(chan string, 2)
+		closes := make(chan closed, 2)
+		c := &Common{
+			sessionsWaitGroup: &sync.WaitGroup{},
+			OnStreamOpen: func(id string) {
+				opened <- id
+			},
+			OnStreamClose: func(id string, bytesIn, bytesOut uint64, err error) {
+				closes <- closed{id: id, bytesIn: bytesIn, bytesOut: bytesOut}
+			},
+		}
+
+		stream, remoteStream := net.Pipe()
+		conn, localConn := net.Pipe()
+		if err := c.pipeStream(stream, conn, compress, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		var remote io.ReadWriteCloser = remoteStream
+		if compress {
+			cs, err := newCompressedStream(remoteStream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote = cs
+		}
+
+		// 3 bytes are sent from local conn through the tunnel and 5 bytes are
+		// received from the other side
+		go localConn.Write([]byte("out"))
+		if _, err := io.ReadFull(remote, make([]byte, 3)); err != nil {
+			t.Fatal(err)
+		}
+		go remote.Write([]byte("in..."))
+		if _, err := io.ReadFull(localConn, make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+		localConn.Close()
+		remoteStream.Close()
+
+		var id string
+		select {
+		case id = <-opened:
+		default:
+			t.Fatalf("expect OnStreamOpen to be called with compress %v", compress)
+		}
+		select {
+		case cl := <-closes:
+			if cl.id != id {
+				t.Fatalf("expect OnStreamClose id %q, got %q", id, cl.id)
+			}
+			if cl.bytesIn != 5 || cl.bytesOut != 3 {
+				t.Fatalf("expect 5 bytes in and 3 bytes out with compress %v, got %d and %d", compress, cl.bytesIn, cl.bytesOut)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect OnStreamClose to be called with compress %v", compress)
+		}
+		select {
+		case <-closes:
+			t.Fatal("expect OnStreamClose to be called once")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if len(opened) != 0 {
+			t.Fatal("expect OnStreamOpen to be called once")
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package tuna
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// upstreamKey identifies the upstream connections of a service. Services at
+// the same address can be dialed differently, e.g. with and without TLS, so
+// their connections are kept apart.
+type upstreamKey struct {
+	service string
+	addr    string
+}
+
+// upstreamPool pre-dials up to size idle connections to each upstream of a
+// service, so that streams don't need to wait for connection setup. It is not
+// a pool that connections are returned to: a connection taken from pool is
+// used by one stream only and closed with it, because stream data can end at
+// any point of upstream protocol and reusing the connection would mix data of
+// different streams.
+type upstreamPool struct {
+	size        int
+	idleTimeout time.Duration
+
+	sync.Mutex
+	idle    map[upstreamKey][]idleConn
+	filling map[upstreamKey]bool
+	closed  bool
+}
+
+func newUpstreamPool(size int, idleTimeout time.Duration) *upstreamPool {
+	return &upstreamPool{
+		size:        size,
+		idleTimeout: idleTimeout,
+		idle:        make(map[upstreamKey][]idleConn),
+		filling:     make(map[upstreamKey]bool),
+	}
+}
+
+// get returns an idle connection to addr of service if there is one, or a new
+// one by dial otherwise. Pool of service and addr is refilled in background.
+func (p *upstreamPool) get(service, addr string, dial func() (net.Conn, error)) (net.Conn, error) {
+	key := upstreamKey{service: service, addr: addr}
+	var conn net.Conn
+	p.Lock()
+	conns := p.idle[key]
+	for len(conns) > 0 && conn == nil {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if p.idleTimeout > 0 && time.Since(c.since) > p.idleTimeout {
+			Close(c.conn)
+			continue
+		}
+		conn = c.conn
+	}
+	p.idle[key] = conns
+	p.Unlock()
+
+	go p.fill(key, dial)
+
+	if conn != nil {
+		return conn, nil
+	}
+	return dial()
+}
+
+func (p *upstreamPool) fill(key upstreamKey, dial func() (net.Conn, error)) {
+	p.Lock()
+	if p.closed || p.filling[key] {
+		p.Unlock()
+		return
+	}
+	p.filling[key] = true
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		delete(p.filling, key)
+		p.Unlock()
+	}()
+
+	for {
+		p.Lock()
+		full := p.closed || len(p.idle[key]) >= p.size
+		p.Unlock()
+		if full {
+			return
+		}
+
+		conn, err := dial()
+		if err != nil {
+			log.Printf("Couldn't dial upstream %s of service %s for pool: %v", key.addr, key.service, err)
+			return
+		}
+
+		p.Lock()
+		if p.closed {
+			p.Unlock()
+			Close(conn)
+			return
+		}
+		p.idle[key] = append(p.idle[key], idleConn{conn: conn, since: time.Now()})
+		p.Unlock()
+	}
+}
+
+// reapIdle closes connections idle longer than idleTimeout until done is
+// closed, so that pool does not hold connections upstream already dropped.
+func (p *upstreamPool) reapIdle(done <-chan struct{}) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		p.Lock()
+		for key, conns := range p.idle {
+			active := conns[:0]
+			for _, c := range conns {
+				if time.Since(c.since) > p.idleTimeout {
+					Close(c.conn)
+				} else {
+					active = append(active, c)
+				}
+			}
+			p.idle[key] = active
+		}
+		p.Unlock()
+	}
+}
+
+func (p *upstreamPool) close() {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	for key, conns := range p.idle {
+		for _, c := range conns {
+			Close(c.conn)
+		}
+		delete(p.idle, key)
+	}
+}
@@ -0,0 +1,61 @@
+package tuna
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPoolSeparatesServices(t *testing.T) {
+	p := newUpstreamPool(1, 0)
+	defer p.close()
+
+	// each service dials its own kind of connection to the same address
+	dialer := func(local string) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			a, b := net.Pipe()
+			b.Close()
+			return &namedConn{Conn: a, local: local}, nil
+		}
+	}
+
+	addr := "127.0.0.1:443"
+	for _, service := range []string{"tls", "plain"} {
+		conn, err := p.get(service, addr, dialer(service))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// wait for both pools to be filled in background
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.Lock()
+		filled := len(p.idle[upstreamKey{service: "tls", addr: addr}]) == 1 && len(p.idle[upstreamKey{service: "plain", addr: addr}]) == 1
+		p.Unlock()
+		if filled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect pool of each service to be filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, service := range []string{"tls", "plain"} {
+		conn, err := p.get(service, addr, dialer("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local := conn.(*namedConn).local; local != service {
+			t.Fatalf("expect pooled connection of service %s, got one dialed by %s", service, local)
+		}
+		conn.Close()
+	}
+}
+
+type namedConn struct {
+	net.Conn
+	local string
+}
@@ -3,19 +3,23 @@ package tuna
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/nknorg/nkn-sdk-go"
-	"github.com/nknorg/nkn/v2/common"
 	nknPb "github.com/nknorg/nkn/v2/pb"
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/storage"
+	"github.com/nknorg/tuna/util"
+	"github.com/rdegges/go-ipify"
 	"github.com/xtaci/smux"
 )
 
@@ -89,23 +93,11 @@ func ParseEncryptionAlgo(encryptionAlgoStr string) (pb.EncryptionAlgo, error) {
 	return 0, fmt.Errorf("unknown encryption algo %v", encryptionAlgoStr)
 }
 
-func ParsePrice(priceStr string) (common.Fixed64, common.Fixed64, error) {
-	price := strings.Split(priceStr, ",")
-	entryToExitPrice, err := common.StringToFixed64(strings.Trim(price[0], " "))
-	if err != nil {
-		return 0, 0, err
-	}
-	var exitToEntryPrice common.Fixed64
-	if len(price) > 1 {
-		exitToEntryPrice, err = common.StringToFixed64(strings.Trim(price[1], " "))
-		if err != nil {
-			return 0, 0, err
-		}
-	} else {
-		exitToEntryPrice = entryToExitPrice
-	}
-	return entryToExitPrice, exitToEntryPrice, nil
-}
+// ReadVarBytes reads a length prefixed message written by WriteVarBytes,
+// regardless of read boundaries of reader. Message larger than maxMsgSize is
+// rejected, 0 means no limit.
+// errMsgTooLarge is returned by ReadVarBytes if message exceeds max size.
+var errMsgTooLarge = errors.New("message too large")
 
 func ReadVarBytes(reader io.Reader, maxMsgSize uint32) ([]byte, error) {
 	b := make([]byte, 4)
@@ -114,7 +106,12 @@ func ReadVarBytes(reader io.Reader, maxMsgSize uint32) ([]byte, error) {
 		return nil, err
 	}
 
-	b = make([]byte, int(binary.LittleEndian.Uint32(b)))
+	msgSize := binary.LittleEndian.Uint32(b)
+	if maxMsgSize > 0 && msgSize > maxMsgSize {
+		return nil, fmt.Errorf("%w: size %d exceeds max size %d", errMsgTooLarge, msgSize, maxMsgSize)
+	}
+
+	b = make([]byte, int(msgSize))
 	_, err = io.ReadFull(reader, b)
 	if err != nil {
 		return nil, err
@@ -193,6 +190,115 @@ func writeStreamMetadata(stream *smux.Stream, streamMetadata *pb.StreamMetadata)
 	return nil
 }
 
+// requestService sends a service handshake request through conn and waits
+// for server to confirm it provides the service. ErrServiceNotProvided is
+// returned if server rejects the request.
+func requestService(conn net.Conn, serviceID uint32, serviceName string) error {
+	err := conn.SetDeadline(time.Now().Add(serviceHandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	b, err := proto.Marshal(&pb.ServiceHandshakeRequest{
+		ServiceId:   serviceID,
+		ServiceName: serviceName,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarBytes(conn, b)
+	if err != nil {
+		return err
+	}
+
+	b, err = ReadVarBytes(conn, maxServiceHandshakeSize)
+	if err != nil {
+		return err
+	}
+
+	resp := &pb.ServiceHandshakeResponse{}
+	err = proto.Unmarshal(b, resp)
+	if err != nil {
+		return err
+	}
+
+	if !resp.Accepted {
+		return fmt.Errorf("%w: %s", ErrServiceNotProvided, resp.Error)
+	}
+
+	return nil
+}
+
+// handleServiceRequest reads a service handshake request from conn, checks it
+// with checkService and writes the result back.
+func handleServiceRequest(conn net.Conn, checkService func(serviceID uint32, serviceName string) error) error {
+	err := conn.SetDeadline(time.Now().Add(serviceHandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	b, err := ReadVarBytes(conn, maxServiceHandshakeSize)
+	if err != nil {
+		return err
+	}
+
+	req := &pb.ServiceHandshakeRequest{}
+	err = proto.Unmarshal(b, req)
+	if err != nil {
+		return err
+	}
+
+	resp := &pb.ServiceHandshakeResponse{Accepted: true}
+	checkErr := checkService(req.ServiceId, req.ServiceName)
+	if checkErr != nil {
+		resp.Accepted = false
+		resp.Error = checkErr.Error()
+	}
+
+	b, err = proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarBytes(conn, b)
+	if err != nil {
+		return err
+	}
+
+	if checkErr != nil {
+		return fmt.Errorf("%w: %v", ErrServiceNotProvided, checkErr)
+	}
+
+	return nil
+}
+
+// ParsePortRange parses port range like "40000-40100" or a single port like
+// "40000". Empty string returns zero range meaning any port.
+func ParsePortRange(portRange string) (int, int, error) {
+	if len(portRange) == 0 {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(portRange, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	minPort, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %s: %v", portRange, err)
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %s: %v", portRange, err)
+	}
+	if minPort <= 0 || maxPort > 65535 || minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid port range %s", portRange)
+	}
+	return minPort, maxPort, nil
+}
+
 // GetFavoriteSeedRPCServer returns an array of node rpc address from favorite
 // node file. Timeout is in unit of millisecond.
 func GetFavoriteSeedRPCServer(path, filenamePrefix string, timeout int32) ([]string, error) {
@@ -249,3 +355,54 @@ func GetFavoriteSeedRPCServerContext(ctx context.Context, path, filenamePrefix s
 
 	return rpcAddrs, nil
 }
+
+// ListServices returns the subscriber count of each service in serviceNames
+// that currently has at least one subscriber under subscriptionPrefix. NKN has
+// no way to enumerate topics, so candidate service names (e.g. the names in a
+// services file) need to be provided.
+func ListServices(wallet *nkn.Wallet, subscriptionPrefix string, serviceNames []string) (map[string]int, error) {
+	return ListServicesContext(context.Background(), wallet, subscriptionPrefix, serviceNames)
+}
+
+func ListServicesContext(ctx context.Context, wallet *nkn.Wallet, subscriptionPrefix string, serviceNames []string) (map[string]int, error) {
+	if len(subscriptionPrefix) == 0 {
+		subscriptionPrefix = DefaultSubscriptionPrefix
+	}
+
+	services := make(map[string]int, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		count, err := wallet.GetSubscribersCountContext(ctx, subscriptionPrefix+serviceName)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			services[serviceName] = count
+		}
+	}
+
+	return services, nil
+}
+
+// getPublicIP returns the public IP of this host detected by ipify, retrying
+// with backoff since external IP detection services can be flaky.
+func getPublicIP(ctx context.Context) (string, error) {
+	backoff := util.NewBackoff(getPublicIPBackoffMin, getPublicIPBackoffMax)
+	var ip string
+	var err error
+	for i := 0; i < getPublicIPRetries; i++ {
+		if i > 0 {
+			delay := backoff.Next()
+			log.Printf("Couldn't get IP: %v, retry in %v", err, delay)
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		ip, err = ipify.GetIp()
+		if err == nil {
+			return ip, nil
+		}
+	}
+	return "", err
+}
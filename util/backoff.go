@@ -0,0 +1,40 @@
+package util
+
+import "time"
+
+// Backoff computes exponentially increasing delays between Min and Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	current time.Duration
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	if max < min {
+		max = min
+	}
+	return &Backoff{
+		Min: min,
+		Max: max,
+	}
+}
+
+// Next returns the delay to wait before the next attempt and doubles the delay
+// for the attempt after, up to Max.
+func (b *Backoff) Next() time.Duration {
+	if b.current < b.Min {
+		b.current = b.Min
+	}
+	d := b.current
+	b.current *= 2
+	if b.current > b.Max {
+		b.current = b.Max
+	}
+	return d
+}
+
+// Reset makes the next delay start from Min again.
+func (b *Backoff) Reset() {
+	b.current = 0
+}
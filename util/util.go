@@ -1,27 +1,104 @@
 package util
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 func ReadJSON(fileName string, value interface{}) error {
-	file, err := ioutil.ReadFile(fileName)
+	file, err := os.Open(fileName)
 	if err != nil {
 		return fmt.Errorf("read file error: %v", err)
 	}
+	defer file.Close()
 
-	err = json.Unmarshal(file, value)
+	return ReadJSONFrom(file, value)
+}
+
+// ReadJSONFrom reads all data from r and parses it as JSON into value.
+func ReadJSONFrom(r io.Reader, value interface{}) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read error: %v", err)
+	}
+
+	err = json.Unmarshal(b, value)
+	if err != nil {
+		return fmt.Errorf("parse json error: %v", err)
+	}
+
+	return nil
+}
+
+// ReadJSONURL downloads JSON from url and parses it into value.
+func ReadJSONURL(url string, value interface{}) error {
+	client := http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("download error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download error: %s", resp.Status)
+	}
+
+	return ReadJSONFrom(resp.Body, value)
+}
+
+// ReadJSONSource reads JSON into value from stdin if source is "-", from URL
+// if source starts with http:// or https://, or from file otherwise.
+func ReadJSONSource(source string, value interface{}) error {
+	switch {
+	case source == "-":
+		return ReadJSONFrom(os.Stdin, value)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		return ReadJSONURL(source, value)
+	default:
+		return ReadJSON(source, value)
+	}
+}
+
+// ReadConfigSource is like ReadJSONSource but also checks for keys that don't
+// match any field of value, which are usually typos. Unknown keys are errors
+// if strict is true, or logged as warning otherwise.
+func ReadConfigSource(source string, value interface{}, strict bool) error {
+	var raw json.RawMessage
+	err := ReadJSONSource(source, &raw)
 	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(value)
+	if err == nil {
+		return nil
+	}
+	if !strings.HasPrefix(err.Error(), "json: unknown field") {
 		return fmt.Errorf("parse json error: %v", err)
 	}
+	if strict {
+		return fmt.Errorf("parse %s error: %v", source, err)
+	}
 
+	log.Printf("Warning: %s: %v", source, err)
+	err = json.Unmarshal(raw, value)
+	if err != nil {
+		return fmt.Errorf("parse json error: %v", err)
+	}
 	return nil
 }
 